@@ -2,19 +2,211 @@ package main
 
 import (
 	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
+	tokens "github.com/dileban/atomic-swaps/fabric/lib/asset/fungible"
+	"github.com/dileban/atomic-swaps/fabric/lib/asset/htlc"
+	"github.com/dileban/atomic-swaps/fabric/lib/safemath"
+	"github.com/dileban/atomic-swaps/fabric/lib/security"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"golang.org/x/crypto/ripemd160"
 )
 
+// requiredCapabilities lists the capabilities a token contract must
+// support for the swap chaincode to lock tokens in each escrow mode.
+var requiredCapabilities = map[string][]string{
+	htlc.EscrowCustody: {tokens.CapTransferFrom, tokens.CapChaincodeAddresses, tokens.CapTransferFromBalance},
+	htlc.EscrowHold:    {tokens.CapHold},
+}
+
+// hashFunctions maps the supported hash algorithms to functions
+// returning the digest of their input.
+var hashFunctions = map[string]func([]byte) []byte{
+	htlc.HashSHA256: func(b []byte) []byte {
+		h := sha256.Sum256(b)
+		return h[:]
+	},
+	htlc.HashSHA512: func(b []byte) []byte {
+		h := sha512.Sum512(b)
+		return h[:]
+	},
+	htlc.HashSHA256d: func(b []byte) []byte {
+		h := sha256.Sum256(b)
+		h = sha256.Sum256(h[:])
+		return h[:]
+	},
+	htlc.HashRIPEMD160: func(b []byte) []byte {
+		h := ripemd160.New()
+		h.Write(b)
+		return h.Sum(nil)
+	},
+}
+
+// weakSecrets lists well-known secrets whose images are rejected at
+// Lock, since tokens locked under them could be claimed by anyone.
+var weakSecrets = [][]byte{
+	{},
+	{0x00},
+	make([]byte, 32),
+}
+
+// ownerCounterpartyIndex is the object type of composite keys
+// indexing active agreements by owner and counterparty.
+const ownerCounterpartyIndex = "owner~counterparty"
+
+// revealedKeyPrefix is the prefix of the keys holding the secrets
+// revealed by successful claims, ordered by the time of the claim,
+// and lastRevealedKey bounds their range. Unlike composite keys, the
+// simple keys may be listed from any position.
+const (
+	revealedKeyPrefix = "revealed:"
+	lastRevealedKey   = "revealed;"
+)
+
+// mirrorIndex is the object type of composite keys indexing
+// agreements by the reference to their mirror agreement.
+const mirrorIndex = "mirror"
+
+// claimedIndex is the object type of composite keys indexing claimed
+// agreements by the image of the secret revealed to claim them.
+const claimedIndex = "claimed"
+
+// abortIndex is the object type of composite keys marking active
+// agreements the counterparty has agreed to abort.
+const abortIndex = "abort"
+
+// createdIndex is the object type of composite keys indexing
+// agreements by the time of their creation, grouped into buckets of
+// createdBucketSize seconds.
+const createdIndex = "created"
+
+// timelineIndex is the object type of composite keys holding the
+// lifecycle events of an agreement, keyed by agreement ID and the
+// stage of the lifecycle at which the event occurred. Timelines are
+// kept once agreements are settled and deleted.
+const timelineIndex = "timeline"
+
+// Lifecycle events recorded on the timeline of an agreement.
+const (
+	eventLocked    = "locked"
+	eventClaimed   = "claimed"
+	eventUnlocked  = "unlocked"
+	eventCancelled = "cancelled"
+)
+
+// statusActive is the status of agreements that have not been settled.
+const statusActive = "active"
+
+// Codes for the reason an agreement may or may not be settled now.
+// Settled agreements give the settling event as the reason.
+const (
+	reasonNotExpired = "notExpired"
+	reasonExpired    = "expired"
+	reasonSettled    = "settled"
+)
+
+// Stages of the lifecycle of an agreement, ordering the events on its
+// timeline. An agreement is settled by at most one event.
+const (
+	stageCreated = "0"
+	stageSettled = "1"
+)
+
+// deniedIndex is the object type of composite keys marking images on
+// the denylist maintained by the administrator, e.g. images of secrets
+// known to have leaked.
+const deniedIndex = "denied"
+
+// pausedIndex is the object type of composite keys marking token
+// contracts for which the administrator has paused new agreements.
+const pausedIndex = "paused"
+
+// deregisteredIndex is the object type of composite keys marking token
+// contracts the administrator no longer recognizes. Token contracts
+// are registered unless deregistered.
+const deregisteredIndex = "deregistered"
+
+// lockerIndex is the object type of composite keys marking lockers
+// authorized by an owner to lock tokens on the owner's behalf.
+const lockerIndex = "owner~locker"
+
+// createdBucketSize is the time, in seconds, spanned by a bucket of
+// the index of agreements by creation time.
+const createdBucketSize = 24 * 60 * 60
+
+// maxCreatedBuckets is the maximum number of buckets of the index of
+// agreements by creation time spanned by a single query.
+const maxCreatedBuckets = 31
+
+// maxRevealedSecrets is the maximum number of revealed secrets
+// returned by a single query.
+const maxRevealedSecrets = 100
+
+// maxHashRounds is the maximum number of times a secret may be hashed
+// to obtain the image of an agreement.
+const maxHashRounds = 16
+
+// maxHintLength is the maximum length of the hint about the secret
+// recorded with an agreement.
+const maxHintLength = 256
+
+// maxImages is the maximum number of images of an agreement, including
+// the image supplied to Lock.
+const maxImages = 8
+
+// configKey is the key under which the chaincode configuration is
+// stored on the ledger.
+const configKey = "config"
+
 // CrossChainSwap implements the HTLC interface.
 //
 // See lib/asset/htlc/HTLC
 type CrossChainSwap struct {
+	config *Config
+
+	// caller is the context of the invocation operating on the swap.
+	caller *CallerProps
+}
+
+// Config holds the settings of the swap chaincode, set at the time of
+// instantiation. The administrator may change the hash algorithm
+// afterwards with SetHashAlgorithm, the other settings are fixed.
+type Config struct {
+	// Admin is the address permitted to administer the chaincode. This
+	// is the instantiator of the chaincode.
+	Admin string `json:"admin"`
+
+	// DefaultLockTime is the lock time, in seconds, applied to
+	// agreements created without one. Must lie between minLockTime
+	// and maxLockTime.
+	DefaultLockTime int64 `json:"defaultLockTime"`
+
+	// CancellationWindow is the time, in seconds, after creating an
+	// agreement during which the owner may cancel it. Must not exceed
+	// minLockTime. Zero disables early cancellation.
+	CancellationWindow int64 `json:"cancellationWindow"`
+
+	// MaxAgreementBps caps the amount of a single agreement at a
+	// fraction of the token supply, in basis points. Zero leaves
+	// agreements uncapped.
+	MaxAgreementBps uint64 `json:"maxAgreementBps"`
+
+	// HashAlgorithm is the algorithm used to hash the secrets of new
+	// agreements that do not specify one. Changing it with
+	// SetHashAlgorithm leaves existing agreements unaffected.
+	HashAlgorithm string `json:"hashAlgorithm"`
+
+	// Debug enables diagnostics revealing how secrets are hashed, such
+	// as DebugImage. It should be left disabled in production.
+	Debug bool `json:"debug,omitempty"`
 }
 
 // Agreement represents a swap contract between an owner of tokens and
@@ -23,9 +215,14 @@ type CrossChainSwap struct {
 // the image of a secret required to claim tokens. An agreement
 // expires after a pre-agreed period of time.
 type Agreement struct {
-	// The address of the token owner and creator of an agreement.
+	// The address of the token owner of an agreement.
 	Owner string `json:"owner"`
 
+	// The address of the invoker who submitted the lock. This differs
+	// from the owner for locks submitted on the owner's behalf.
+	// Agreements without a creator were created by their owner.
+	CreatedBy string `json:"createdBy,omitempty"`
+
 	// The address of the counterparty in the agreement who is allowed
 	// to claim tokens before the expiry.
 	Counterparty string `json:"counterparty"`
@@ -33,9 +230,13 @@ type Agreement struct {
 	// The image of a secret required to claim tokens.
 	Image string `json:"image"`
 
-	// The amount of tokens to be swapped in the agreement.
+	// The amount of tokens to be swapped in the agreement. Partial
+	// claims reduce the amount to what remains to be claimed.
 	Amount uint64 `json:"amount"`
 
+	// The amount of tokens claimed so far by partial claims.
+	Claimed uint64 `json:"claimed,omitempty"`
+
 	// The name of the token contract representing the tokens to be
 	// swaped in the agreement.
 	TokenContract string `json:"tokenContract"`
@@ -43,13 +244,128 @@ type Agreement struct {
 	// The time (wall clock) after which the agreement is considered to
 	// have expired and tokens can be unlocked by the owner.
 	Expiry int64 `json:"expiry"`
+
+	// The time (wall clock) at which the agreement was created.
+	CreatedAt int64 `json:"createdAt,omitempty"`
+
+	// The encoding of the secret, decoded before hashing to compare
+	// against the image.
+	SecretEncoding string `json:"secretEncoding"`
+
+	// The number of times the secret is hashed to obtain the image.
+	// Agreements without hash rounds hash the secret once.
+	HashRounds int `json:"hashRounds,omitempty"`
+
+	// The algorithm used to hash the secret. Agreements without an
+	// algorithm hash the secret using SHA-256.
+	HashAlgorithm string `json:"hashAlgorithm,omitempty"`
+
+	// A human readable hint about where to find the secret. The hint
+	// is informational only and plays no part in claiming tokens.
+	Hint string `json:"hint,omitempty"`
+
+	// The mode of holding locked tokens. Agreements without an escrow
+	// mode hold tokens in custody.
+	Escrow string `json:"escrow,omitempty"`
+
+	// The channel and ID of the agreement forming the other leg of the
+	// swap, on the mirror chain.
+	MirrorChannel     string `json:"mirrorChannel,omitempty"`
+	MirrorAgreementID string `json:"mirrorAgreementId,omitempty"`
+
+	// Whether the delegate is permitted to claim tokens on behalf of
+	// the counterparty, and the address of the delegate.
+	AllowDelegatedClaim bool   `json:"allowDelegatedClaim,omitempty"`
+	Delegate            string `json:"delegate,omitempty"`
+
+	// The images of further secrets, in addition to Image, and whether
+	// the secrets of all images or of any one image are required to
+	// claim tokens.
+	Images     []string `json:"images,omitempty"`
+	Combinator string   `json:"combinator,omitempty"`
+
+	// The address tokens are returned to when unlocked by the owner.
+	// Agreements without a refund address return tokens to the owner.
+	RefundAddress string `json:"refundAddress,omitempty"`
+}
+
+// AgreementEntry is an agreement listed along with its ID.
+type AgreementEntry struct {
+	AgreementID string `json:"agreementId"`
+	Agreement
+}
+
+// HealthReport is the outcome of checking the invariants of the swap
+// state, listing the violations found.
+type HealthReport struct {
+	Healthy    bool     `json:"healthy"`
+	Agreements int      `json:"agreements"`
+	Violations []string `json:"violations"`
+}
+
+// TimelineEvent is an event in the lifecycle of an agreement, along
+// with the invoker causing it and the time of the transaction.
+type TimelineEvent struct {
+	Event     string `json:"event"`
+	Actor     string `json:"actor"`
+	Timestamp int64  `json:"timestamp"`
+	TxID      string `json:"txId"`
+}
+
+// AgreementStatus summarises whether an agreement may be settled now,
+// as of the current transaction. Status is 'active' for active
+// agreements, or the event that settled the agreement otherwise.
+// Claimable and Unlockable disregard who may claim or unlock the
+// agreement. The reason is given both as a code for clients to act on
+// and as text to display.
+type AgreementStatus struct {
+	Status          string `json:"status"`
+	Claimable       bool   `json:"claimable"`
+	Unlockable      bool   `json:"unlockable"`
+	SecondsToExpiry int64  `json:"secondsToExpiry"`
+	ReasonCode      string `json:"reasonCode"`
+	ReasonText      string `json:"reasonText"`
+}
+
+// ImageDiagnostics traces the computation of the image of a secret,
+// for clients to pinpoint why a secret does not match an image. The
+// secret is given as the hex representation of its decoded bytes and
+// Rounds holds the hex digest of each round, the last being the image.
+type ImageDiagnostics struct {
+	SecretEncoding string   `json:"secretEncoding"`
+	HashAlgorithm  string   `json:"hashAlgorithm"`
+	HashRounds     int      `json:"hashRounds"`
+	Secret         string   `json:"secret"`
+	Rounds         []string `json:"rounds"`
+	Image          string   `json:"image"`
+}
+
+// RevealedSecret is a secret revealed by the counterparty of an
+// agreement to claim tokens. Revealed secrets are public, and allow
+// the owner to claim tokens on the other chain.
+type RevealedSecret struct {
+	AgreementID    string `json:"agreementId"`
+	Secret         string `json:"secret"`
+	SecretEncoding string `json:"secretEncoding"`
+	Image          string `json:"image"`
+	ClaimedAt      int64  `json:"claimedAt"`
+}
+
+// RevealedSecretsPage is a page of revealed secrets, along with the
+// bookmark to supply for fetching the next page.
+type RevealedSecretsPage struct {
+	Secrets  []RevealedSecret `json:"secrets"`
+	Bookmark string           `json:"bookmark"`
 }
 
 // Lock creates a new swap agreement between the token owner and a
 // counterparty. The agreement includes the image of a known secret,
 // the amount of tokens to swap, the name of the underlying token
 // contract to invoke and an agreed upon lock time during which the
-// invoker is unable to withdraw her tokens.
+// invoker is unable to withdraw her tokens. The encoding of the
+// secret and the number of hashing rounds may be specified in the
+// options, and are recorded in the agreement so that claims decode
+// and hash the secret consistently.
 //
 // The token owner must ensure an allowance to the amount specified in
 // the agreement is made to the current contract's address. Invoking
@@ -57,10 +373,18 @@ type Agreement struct {
 // address to the current contract's address. The transfer is executed
 // on the target contract by way of invoking the contract
 // chaincode. The function returns the agreement ID.
-func (ccs *CrossChainSwap) Lock(counterparty string, image string, amount uint64, tokenContract string, lockTime int64) (string, error) {
+//
+// Alternatively, for token contracts supporting holds, the options
+// may specify the EscrowHold mode. The tokens then remain at the
+// owner's address, held by the token contract under the agreement ID
+// until released.
+func (ccs *CrossChainSwap) Lock(counterparty string, image string, amount uint64, tokenContract string, lockTime int64, options htlc.LockOptions) (string, error) {
 	var agreement *Agreement
-	var err error
-	agreementID := newAgreementID()
+	options, owner, err := ccs.checkLock(counterparty, image, amount, tokenContract, lockTime, options)
+	if err != nil {
+		return "", err
+	}
+	agreementID := ccs.newAgreementID()
 	// Verify if agreement ID is unique
 	if agreement, err = ccs.getAgreement(agreementID); err != nil {
 		return "", err
@@ -69,29 +393,142 @@ func (ccs *CrossChainSwap) Lock(counterparty string, image string, amount uint64
 		return "", fmt.Errorf("Agreement %s already exists", agreementID)
 	}
 	// Create new agreement and write to ledger
-	invoker := getInvokerAddress()
-	expiry := getExpiryTime(lockTime)
+	invoker := getInvokerAddress(ccs.caller)
+	if options.RefundAddress == "" {
+		options.RefundAddress = owner
+	}
+	expiry, err := getExpiryTime(ccs.caller, lockTime)
+	if err != nil {
+		return "", err
+	}
 	agreement = &Agreement{
-		Owner:         invoker,
-		Counterparty:  counterparty,
-		Image:         image,
-		Amount:        amount,
-		TokenContract: tokenContract,
-		Expiry:        expiry}
+		Owner:               owner,
+		CreatedBy:           invoker,
+		Counterparty:        counterparty,
+		Image:               image,
+		Amount:              amount,
+		TokenContract:       tokenContract,
+		Expiry:              expiry,
+		CreatedAt:           getTxTime(ccs.caller),
+		SecretEncoding:      options.SecretEncoding,
+		HashRounds:          options.HashRounds,
+		HashAlgorithm:       options.HashAlgorithm,
+		Hint:                options.Hint,
+		Escrow:              options.Escrow,
+		MirrorChannel:       options.MirrorChannel,
+		MirrorAgreementID:   options.MirrorAgreementID,
+		AllowDelegatedClaim: options.AllowDelegatedClaim,
+		Delegate:            options.Delegate,
+		Images:              options.Images,
+		Combinator:          options.Combinator,
+		RefundAddress:       options.RefundAddress}
 	if err = ccs.putAgreement(agreementID, agreement); err != nil {
 		return "", err
 	}
-	// TODO: Invoke token contract to check if the contract has
-	// implemented support for 'chaincode addresses'.
+	if err = ccs.putIndex(agreementID, agreement); err != nil {
+		return "", err
+	}
+	if err = ccs.putMirrorIndex(agreementID, agreement); err != nil {
+		return "", err
+	}
+	if err = ccs.putCreatedIndex(agreementID, agreement); err != nil {
+		return "", err
+	}
+	if err = ccs.putTimelineEvent(agreementID, stageCreated, eventLocked); err != nil {
+		return "", err
+	}
+	// Invoke token contract to hold tokens in place, or 'lock' them
+	// to custom (chaincode) address.
+	if options.Escrow == htlc.EscrowHold {
+		args := argArray("Hold", owner, agreementID, strconv.FormatUint(amount, 10))
+		result := ccs.caller.stub.InvokeChaincode(tokenContract, args, "")
+		if result.Status != shim.OK {
+			return "", fmt.Errorf("Error transferring tokens in contract %s: %s", tokenContract, result.Message)
+		}
+		return agreementID, nil
+	}
+	if err = ccs.transferToCustody(tokenContract, owner, amount); err != nil {
+		return "", err
+	}
+	return agreementID, nil
+}
+
+// checkLock validates the arguments of Lock against the state of the
+// ledger and the token contract, returning the options completed with
+// their defaults and the owner of the tokens to be locked. Lock and
+// SimulateLock share these checks so that a simulation gives the same
+// verdict as the lock itself.
+func (ccs *CrossChainSwap) checkLock(counterparty string, image string, amount uint64, tokenContract string, lockTime int64, options htlc.LockOptions) (htlc.LockOptions, string, error) {
+	if lockTime < minLockTime || lockTime > maxLockTime {
+		return options, "", fmt.Errorf("Lock time must be between %d and %d seconds", minLockTime, maxLockTime)
+	}
+	options, err := ccs.readLockOptions(options)
+	if err != nil {
+		return options, "", err
+	}
+	owner, err := ccs.lockOwner(options)
+	if err != nil {
+		return options, "", err
+	}
+	if counterparty == "" || counterparty == owner {
+		return options, "", fmt.Errorf("Invalid counterparty '%s'", counterparty)
+	}
+	if amount == 0 {
+		return options, "", fmt.Errorf("Attempting to lock zero amount")
+	}
+	if err = checkImages(image, options.Images); err != nil {
+		return options, "", err
+	}
+	images := append([]string{image}, options.Images...)
+	if err = checkWeakImages(images, options); err != nil {
+		return options, "", err
+	}
+	if err = ccs.checkDenied(images); err != nil {
+		return options, "", err
+	}
+	if err = ccs.checkPaused(tokenContract); err != nil {
+		return options, "", err
+	}
+	if err = ccs.checkRegistered(tokenContract); err != nil {
+		return options, "", err
+	}
+	// Verify the token contract is able to hold tokens in escrow
+	if err = ccs.checkCapabilities(tokenContract, requiredCapabilities[options.Escrow]); err != nil {
+		return options, "", err
+	}
+	if err = ccs.checkAgreementCap(tokenContract, amount); err != nil {
+		return options, "", err
+	}
+	return options, owner, nil
+}
 
-	// Invoke token contract to 'lock' tokens to custom (chaincode) address.
-	chaincodeAddress := getChaincodeAddress()
-	args := argArray("TransferFrom", invoker, chaincodeAddress, strconv.FormatUint(amount, 10))
-	result := caller.stub.InvokeChaincode(tokenContract, args, "")
+// SimulateLock checks whether a call to Lock with the same arguments
+// is expected to succeed, without creating an agreement or
+// transferring tokens. The returned error gives the reason a lock
+// would fail.
+func (ccs *CrossChainSwap) SimulateLock(counterparty string, image string, amount uint64, tokenContract string, lockTime int64, options htlc.LockOptions) error {
+	options, owner, err := ccs.checkLock(counterparty, image, amount, tokenContract, lockTime, options)
+	if err != nil {
+		return err
+	}
+	// Holds are approved by the token contract's own rules
+	if options.Escrow == htlc.EscrowHold {
+		return nil
+	}
+	// Check the allowance made to the current contract's address
+	chaincodeAddress := getChaincodeAddress(ccs.caller)
+	result := ccs.caller.stub.InvokeChaincode(tokenContract, argArray("Allowance", owner, chaincodeAddress), "")
 	if result.Status != shim.OK {
-		return "", fmt.Errorf("Error transferring tokens in contract %s: %s", tokenContract, result.Message)
+		return fmt.Errorf("Error querying allowance in contract %s: %s", tokenContract, result.Message)
 	}
-	return agreementID, nil
+	allowance, err := strconv.ParseUint(string(result.Payload), 10, 64)
+	if err != nil {
+		return fmt.Errorf("Error reading allowance in contract %s: %s", tokenContract, err)
+	}
+	if allowance < amount {
+		return fmt.Errorf("Insufficient allowance of %d approved for %s", allowance, chaincodeAddress)
+	}
+	return nil
 }
 
 // Unlock releases tokens locked by the invoker (owner) under a given
@@ -99,104 +536,1545 @@ func (ccs *CrossChainSwap) Lock(counterparty string, image string, amount uint64
 // elapsed.
 //
 // Invoking this function results in a transfer of funds from the
-// current contract's address to the owner's address. The transfer is
-// executed on the target contract by way of invoking the contract
+// current contract's address to the refund address of the agreement,
+// which is the owner's address unless specified otherwise. The
+// transfer is executed on the target contract by way of invoking the contract
 // chaincode.
 func (ccs *CrossChainSwap) Unlock(agreementID string) error {
-	var agreement *Agreement
-	var err error
-	if agreement, err = ccs.getAgreement(agreementID); err != nil {
+	agreement, err := ccs.checkUnlock(agreementID)
+	if err != nil {
 		return err
 	}
-	invoker := getInvokerAddress()
-	if invoker != agreement.Owner {
-		return fmt.Errorf("Attempting to unlock tokens belonging to %s", agreement.Owner)
+	refundAddress := agreement.RefundAddress
+	if refundAddress == "" {
+		refundAddress = agreement.Owner
+	}
+	// Invoke token contract to 'unlock' tokens from custom (chaincode) address.
+	if err = ccs.release(agreementID, agreement, refundAddress, agreement.Amount); err != nil {
+		return err
+	}
+	if err = ccs.putTimelineEvent(agreementID, stageSettled, eventUnlocked); err != nil {
+		return err
+	}
+	return ccs.deleteAgreement(agreementID, agreement)
+}
+
+// CanUnlock returns an error giving the reason the invoker cannot
+// unlock the tokens of an agreement now, or nil if Unlock is expected
+// to succeed. Owners may thereby avoid submitting transactions bound
+// to fail near the expiry.
+func (ccs *CrossChainSwap) CanUnlock(agreementID string) error {
+	_, err := ccs.checkUnlock(agreementID)
+	return err
+}
+
+// checkUnlock returns the agreement with the specified ID if the
+// invoker is permitted to unlock its tokens now, i.e. the invoker is
+// the owner and the agreement is active and has expired.
+func (ccs *CrossChainSwap) checkUnlock(agreementID string) (*Agreement, error) {
+	agreement, err := ccs.getAgreement(agreementID)
+	if err != nil {
+		return nil, err
+	}
+	if agreement == nil {
+		return nil, fmt.Errorf("Agreement %s not found", agreementID)
+	}
+	if !sameAddress(getInvokerAddress(ccs.caller), agreement.Owner) {
+		return nil, fmt.Errorf("Invoker is not authorized to unlock tokens")
+	}
+	// Agreements settled before they were deleted on settlement remain
+	// on the ledger, but are no longer indexed as active
+	active, err := ccs.isActive(agreementID, agreement)
+	if err != nil {
+		return nil, err
+	}
+	if !active {
+		return nil, fmt.Errorf("Agreement %s is no longer active", agreementID)
 	}
-	if agreement.Expiry > time.Now().Unix() {
+	if err = ccs.checkExpired(agreement); err != nil {
+		return nil, err
+	}
+	return agreement, nil
+}
+
+// checkExpired returns an error if the agreement has not expired as of
+// the current transaction. Expiry is compared against the transaction
+// timestamp, as at Lock, so that endorsing peers agree regardless of
+// their clocks.
+func (ccs *CrossChainSwap) checkExpired(agreement *Agreement) error {
+	if agreement.Expiry > getTxTime(ccs.caller) {
 		return fmt.Errorf("Agreement is set to expire on %s", time.Unix(agreement.Expiry, 0).Format(time.RFC850))
 	}
-	// Invoke token contract to 'unlock' tokens from custom (chaincode) address.
-	args := argArray("Transfer", agreement.Owner, strconv.FormatUint(agreement.Amount, 10))
-	result := caller.stub.InvokeChaincode(agreement.TokenContract, args, "")
-	if result.Status != shim.OK {
-		return fmt.Errorf("Error transferring tokens in contract %s: %s", agreement.TokenContract, result.Message)
+	return nil
+}
+
+// checkUnexpired returns an error if the agreement has expired as of
+// the current transaction.
+func (ccs *CrossChainSwap) checkUnexpired(agreement *Agreement) error {
+	if agreement.Expiry < getTxTime(ccs.caller) {
+		return fmt.Errorf("Agreement expired on %s", time.Unix(agreement.Expiry, 0).Format(time.RFC850))
 	}
 	return nil
 }
 
 // Claim allows the counterparty to claim tokens from the agreement
 // setup by the creator. The counterparty must provide the correct
-// agreement id and secret to claim her tokens.
+// agreement id and secret to claim her tokens. Agreements allowing
+// delegated claims may also be claimed by the delegate, in which case
+// the tokens are still credited to the counterparty.
+//
+// Agreements with several images require the secrets of all images,
+// or of any one image, depending on the combinator of the agreement.
+// Each secret supplied must match one of the images.
 //
 // Invoking this function results in a transfer of funds from the
 // current contract's address to the counterparty's address. The
 // transfer is executed on the target contract by way of invoking the
 // contract chaincode.
-func (ccs *CrossChainSwap) Claim(agreementID string, secret string) error {
+func (ccs *CrossChainSwap) Claim(agreementID string, secrets ...string) error {
+	_, _, err := ccs.ClaimPartial(agreementID, 0, secrets...)
+	return err
+}
+
+// ClaimPartial allows the counterparty to claim part of the tokens of
+// an agreement, e.g. to settle it in tranches, returning the amount
+// claimed and the amount remaining. An amount of zero claims all
+// remaining tokens. The secrets must match as for Claim on every
+// claim, and the agreement is only settled once all tokens have been
+// claimed. Agreements holding tokens in place may only be claimed in
+// full, since holds are released as a whole.
+func (ccs *CrossChainSwap) ClaimPartial(agreementID string, amount uint64, secrets ...string) (uint64, uint64, error) {
+	var agreement *Agreement
+	var err error
+	if agreement, err = ccs.getAgreement(agreementID); err != nil {
+		return 0, 0, err
+	}
+	if agreement == nil {
+		return 0, 0, fmt.Errorf("Agreement %s not found", agreementID)
+	}
+	invoker := getInvokerAddress(ccs.caller)
+	delegated := agreement.AllowDelegatedClaim && invoker == agreement.Delegate
+	if invoker != agreement.Counterparty && !delegated {
+		return 0, 0, fmt.Errorf("Attempting to claim tokens belonging to %s", agreement.Counterparty)
+	}
+	active, err := ccs.isActive(agreementID, agreement)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !active {
+		return 0, 0, fmt.Errorf("Agreement %s is no longer active", agreementID)
+	}
+	if err = ccs.checkUnexpired(agreement); err != nil {
+		return 0, 0, err
+	}
+	revealed, err := matchSecrets(agreement, secrets)
+	if err != nil {
+		return 0, 0, err
+	}
+	if amount == 0 {
+		amount = agreement.Amount
+	}
+	if amount > agreement.Amount {
+		return 0, 0, fmt.Errorf("Claim of %d exceeds the remaining amount of %d", amount, agreement.Amount)
+	}
+	remaining := agreement.Amount - amount
+	if remaining > 0 && agreement.Escrow == htlc.EscrowHold {
+		return 0, 0, fmt.Errorf("Agreements holding tokens in place may only be claimed in full")
+	}
+	// Invoke token contract to 'unlock' tokens from custom (chaincode) address.
+	if err = ccs.release(agreementID, agreement, agreement.Counterparty, amount); err != nil {
+		return 0, 0, err
+	}
+	if remaining > 0 {
+		agreement.Amount = remaining
+		agreement.Claimed += amount
+		if err = ccs.putAgreement(agreementID, agreement); err != nil {
+			return 0, 0, err
+		}
+	} else {
+		if err = ccs.putTimelineEvent(agreementID, stageSettled, eventClaimed); err != nil {
+			return 0, 0, err
+		}
+		if err = ccs.deleteAgreement(agreementID, agreement); err != nil {
+			return 0, 0, err
+		}
+	}
+	for _, image := range agreementImages(agreement) {
+		secret, ok := revealed[image]
+		if !ok {
+			continue
+		}
+		// Secrets revealed by an earlier partial claim are recorded once
+		claimed, err := ccs.hasClaimedIndex(agreementID, image)
+		if err != nil {
+			return 0, 0, err
+		}
+		if claimed {
+			continue
+		}
+		if err = ccs.putClaimedIndex(agreementID, image); err != nil {
+			return 0, 0, err
+		}
+		err = ccs.putRevealedSecret(&RevealedSecret{
+			AgreementID:    agreementID,
+			Secret:         secret,
+			SecretEncoding: agreement.SecretEncoding,
+			Image:          image,
+			ClaimedAt:      getTxTime(ccs.caller)})
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return amount, remaining, nil
+}
+
+// CancelEarly allows the owner to cancel an agreement created by
+// mistake, provided it is still active and the cancellation window
+// following its creation has not elapsed. Cancelling early undermines
+// the lock time the counterparty relies on, hence the window is kept
+// short.
+//
+// Invoking this function results in a transfer of funds from the
+// current contract's address back to the owner's address.
+func (ccs *CrossChainSwap) CancelEarly(agreementID string) error {
 	var agreement *Agreement
 	var err error
 	if agreement, err = ccs.getAgreement(agreementID); err != nil {
 		return err
 	}
-	invoker := getInvokerAddress()
-	if invoker != agreement.Counterparty {
-		return fmt.Errorf("Attempting to claim tokens belonging to %s", agreement.Counterparty)
+	if agreement == nil {
+		return fmt.Errorf("Agreement %s not found", agreementID)
 	}
-	if agreement.Expiry < time.Now().Unix() {
-		return fmt.Errorf("Agreement expired on %s", time.Unix(agreement.Expiry, 0).Format(time.RFC850))
+	invoker := getInvokerAddress(ccs.caller)
+	if invoker != agreement.Owner {
+		return fmt.Errorf("Attempting to cancel agreement belonging to %s", agreement.Owner)
+	}
+	active, err := ccs.isActive(agreementID, agreement)
+	if err != nil {
+		return err
+	}
+	if !active {
+		return fmt.Errorf("Agreement %s is no longer active", agreementID)
+	}
+	if ccs.config.CancellationWindow == 0 {
+		return fmt.Errorf("Early cancellation is disabled")
 	}
-	if imageOf(secret) != agreement.Image {
-		return fmt.Errorf("SHA256 of secret '%s' does not match image '%s'", secret, agreement.Image)
+	if agreement.CreatedAt == 0 || getTxTime(ccs.caller)-agreement.CreatedAt >= ccs.config.CancellationWindow {
+		return fmt.Errorf("Cancellation window of %d seconds has elapsed", ccs.config.CancellationWindow)
 	}
 	// Invoke token contract to 'unlock' tokens from custom (chaincode) address.
-	args := argArray("Transfer", agreement.Counterparty, strconv.FormatUint(agreement.Amount, 10))
-	result := caller.stub.InvokeChaincode(agreement.TokenContract, args, "")
-	if result.Status != shim.OK {
-		return fmt.Errorf("Error transferring tokens in contract %s: %s", agreement.TokenContract, result.Message)
+	if err = ccs.release(agreementID, agreement, agreement.Owner, agreement.Amount); err != nil {
+		return err
 	}
-	return nil
+	if err = ccs.putTimelineEvent(agreementID, stageSettled, eventCancelled); err != nil {
+		return err
+	}
+	return ccs.deleteAgreement(agreementID, agreement)
 }
 
-// getAgreement returns the agreement with the specified ID from the ledger.
-func (ccs *CrossChainSwap) getAgreement(agreementID string) (*Agreement, error) {
-	var b []byte
+// Abort records the consent of the counterparty to the owner
+// cancelling an active agreement before its expiry. The tokens remain
+// locked until the owner cancels the agreement.
+func (ccs *CrossChainSwap) Abort(agreementID string) error {
+	var agreement *Agreement
 	var err error
-	if b, err = caller.stub.GetState(agreementID); err != nil {
-		return nil, err
+	if agreement, err = ccs.getAgreement(agreementID); err != nil {
+		return err
 	}
-	var agreement Agreement
-	if b == nil {
-		return nil, nil
+	if agreement == nil {
+		return fmt.Errorf("Agreement %s not found", agreementID)
 	}
-	if err = json.Unmarshal(b, &agreement); err != nil {
-		return nil, err
+	if getInvokerAddress(ccs.caller) != agreement.Counterparty {
+		return fmt.Errorf("Attempting to abort agreement with counterparty %s", agreement.Counterparty)
 	}
-	return &agreement, nil
+	active, err := ccs.isActive(agreementID, agreement)
+	if err != nil {
+		return err
+	}
+	if !active {
+		return fmt.Errorf("Agreement %s is no longer active", agreementID)
+	}
+	key, err := ccs.caller.stub.CreateCompositeKey(abortIndex, []string{agreementID})
+	if err != nil {
+		return err
+	}
+	return ccs.caller.stub.PutState(key, []byte{0x00})
 }
 
-// putAgreement writes the given agreement to the ledger.
-func (ccs *CrossChainSwap) putAgreement(agreementID string, agreement *Agreement) error {
-	b, err := json.Marshal(&agreement)
+// Cancel allows the owner to cancel an active agreement before its
+// expiry, provided the counterparty has agreed to abort it.
+//
+// Invoking this function results in a transfer of funds from the
+// current contract's address back to the owner's address.
+func (ccs *CrossChainSwap) Cancel(agreementID string) error {
+	var agreement *Agreement
+	var err error
+	if agreement, err = ccs.getAgreement(agreementID); err != nil {
+		return err
+	}
+	if agreement == nil {
+		return fmt.Errorf("Agreement %s not found", agreementID)
+	}
+	if getInvokerAddress(ccs.caller) != agreement.Owner {
+		return fmt.Errorf("Attempting to cancel agreement belonging to %s", agreement.Owner)
+	}
+	active, err := ccs.isActive(agreementID, agreement)
+	if err != nil {
+		return err
+	}
+	if !active {
+		return fmt.Errorf("Agreement %s is no longer active", agreementID)
+	}
+	key, err := ccs.caller.stub.CreateCompositeKey(abortIndex, []string{agreementID})
 	if err != nil {
 		return err
 	}
-	if err = caller.stub.PutState(agreementID, b); err != nil {
+	b, err := ccs.caller.stub.GetState(key)
+	if err != nil {
 		return err
 	}
-	return nil
+	if b == nil {
+		return fmt.Errorf("Counterparty %s has not agreed to abort agreement %s", agreement.Counterparty, agreementID)
+	}
+	// Invoke token contract to 'unlock' tokens from custom (chaincode) address.
+	if err = ccs.release(agreementID, agreement, agreement.Owner, agreement.Amount); err != nil {
+		return err
+	}
+	if err = ccs.putTimelineEvent(agreementID, stageSettled, eventCancelled); err != nil {
+		return err
+	}
+	return ccs.deleteAgreement(agreementID, agreement)
 }
 
-// newAgreementID creates a unique agreement ID.
-func newAgreementID() string {
-	// The transaction ID is unique per transaction, per client.
-	// This will serve as a good agreement ID.
-	return caller.stub.GetTxID()
+// LockedBetween returns the total amount of tokens locked in active
+// agreements between the given owner and counterparty in the given
+// token contract.
+func (ccs *CrossChainSwap) LockedBetween(owner string, counterparty string, tokenContract string) (uint64, error) {
+	iter, err := ccs.caller.stub.GetStateByPartialCompositeKey(ownerCounterpartyIndex, []string{owner, counterparty})
+	if err != nil {
+		return 0, err
+	}
+	defer iter.Close()
+	var total uint64
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return 0, err
+		}
+		_, keys, err := ccs.caller.stub.SplitCompositeKey(kv.Key)
+		if err != nil {
+			return 0, err
+		}
+		agreement, err := ccs.getAgreement(keys[2])
+		if err != nil {
+			return 0, err
+		}
+		if agreement != nil && agreement.TokenContract == tokenContract {
+			total += agreement.Amount
+		}
+	}
+	return total, nil
 }
 
-// imageOf returns the SHA256 hex representation of a given string.
-func imageOf(secret string) string {
-	h := sha256.Sum256([]byte(secret))
-	return hex.EncodeToString(h[:])
+// GetAgreement returns the agreement with the specified ID.
+func (ccs *CrossChainSwap) GetAgreement(agreementID string) (*Agreement, error) {
+	agreement, err := ccs.getAgreement(agreementID)
+	if err != nil {
+		return nil, err
+	}
+	if agreement == nil {
+		return nil, fmt.Errorf("Agreement %s not found", agreementID)
+	}
+	return agreement, nil
+}
+
+// Age returns the time in seconds elapsed since the agreement with the
+// specified ID was created, as of the current transaction.
+func (ccs *CrossChainSwap) Age(agreementID string) (int64, error) {
+	agreement, err := ccs.GetAgreement(agreementID)
+	if err != nil {
+		return 0, err
+	}
+	if agreement.CreatedAt == 0 {
+		return 0, fmt.Errorf("Creation time of agreement %s is unknown", agreementID)
+	}
+	return getTxTime(ccs.caller) - agreement.CreatedAt, nil
+}
+
+// GetAgreementsByOwner returns the active agreements of the given
+// owner, in order of counterparty and agreement ID. The agreements may
+// be narrowed down to those with a given counterparty.
+func (ccs *CrossChainSwap) GetAgreementsByOwner(owner string, counterparty string) ([]AgreementEntry, error) {
+	attributes := []string{owner}
+	if counterparty != "" {
+		attributes = append(attributes, counterparty)
+	}
+	iter, err := ccs.caller.stub.GetStateByPartialCompositeKey(ownerCounterpartyIndex, attributes)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+	entries := []AgreementEntry{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, keys, err := ccs.caller.stub.SplitCompositeKey(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		agreement, err := ccs.getAgreement(keys[2])
+		if err != nil {
+			return nil, err
+		}
+		if agreement != nil {
+			entries = append(entries, AgreementEntry{AgreementID: keys[2], Agreement: *agreement})
+		}
+	}
+	return entries, nil
+}
+
+// AgreementsExpiringWithin returns the active agreements expiring
+// within the given number of seconds from the time of the current
+// transaction, soonest first. Agreements that have already expired
+// are not included.
+func (ccs *CrossChainSwap) AgreementsExpiringWithin(seconds int64) ([]AgreementEntry, error) {
+	t, err := ccs.caller.stub.GetTxTimestamp()
+	if err != nil {
+		return nil, err
+	}
+	now := t.GetSeconds()
+	iter, err := ccs.caller.stub.GetStateByPartialCompositeKey(ownerCounterpartyIndex, []string{})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+	entries := []AgreementEntry{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, keys, err := ccs.caller.stub.SplitCompositeKey(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		agreement, err := ccs.getAgreement(keys[2])
+		if err != nil {
+			return nil, err
+		}
+		if agreement != nil && agreement.Expiry >= now && agreement.Expiry-now <= seconds {
+			entries = append(entries, AgreementEntry{AgreementID: keys[2], Agreement: *agreement})
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Expiry < entries[j].Expiry
+	})
+	return entries, nil
+}
+
+// RevealedSecrets returns up to maxRevealedSecrets secrets revealed by
+// claims made at or after the given time, in order of the time of the
+// claim, starting at the 'bookmark' if given. The bookmark for the
+// next page is returned along with the secrets, and is empty on the
+// last page.
+func (ccs *CrossChainSwap) RevealedSecrets(from int64, bookmark string) ([]RevealedSecret, string, error) {
+	if bookmark == "" {
+		if from < 0 {
+			from = 0
+		}
+		bookmark = fmt.Sprintf("%s%020d", revealedKeyPrefix, from)
+	}
+	if !strings.HasPrefix(bookmark, revealedKeyPrefix) {
+		return nil, "", fmt.Errorf("Malformed bookmark '%s'", bookmark)
+	}
+	iter, err := ccs.caller.stub.GetStateByRange(bookmark, lastRevealedKey)
+	if err != nil {
+		return nil, "", err
+	}
+	defer iter.Close()
+	secrets := []RevealedSecret{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, "", err
+		}
+		if len(secrets) == maxRevealedSecrets {
+			return secrets, kv.Key, nil
+		}
+		var revealed RevealedSecret
+		if err = json.Unmarshal(kv.Value, &revealed); err != nil {
+			return nil, "", err
+		}
+		secrets = append(secrets, revealed)
+	}
+	return secrets, "", nil
+}
+
+// AgreementByMirror returns the agreement referencing the given
+// mirror agreement on the given channel.
+func (ccs *CrossChainSwap) AgreementByMirror(mirrorChannel string, mirrorAgreementID string) (*AgreementEntry, error) {
+	iter, err := ccs.caller.stub.GetStateByPartialCompositeKey(mirrorIndex, []string{mirrorChannel, mirrorAgreementID})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+	if !iter.HasNext() {
+		return nil, fmt.Errorf("No agreement found mirroring %s on channel '%s'", mirrorAgreementID, mirrorChannel)
+	}
+	kv, err := iter.Next()
+	if err != nil {
+		return nil, err
+	}
+	_, keys, err := ccs.caller.stub.SplitCompositeKey(kv.Key)
+	if err != nil {
+		return nil, err
+	}
+	agreement, err := ccs.GetAgreement(keys[2])
+	if err != nil {
+		return nil, err
+	}
+	return &AgreementEntry{AgreementID: keys[2], Agreement: *agreement}, nil
+}
+
+// AgreementsCreatedBetween fetches the IDs of agreements created
+// between the given times (inclusive), in order of creation. The range
+// may span at most maxCreatedBuckets days. Agreements created before
+// the index was introduced are not included.
+func (ccs *CrossChainSwap) AgreementsCreatedBetween(start int64, end int64) ([]string, error) {
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("Invalid time range %d to %d", start, end)
+	}
+	if end/createdBucketSize-start/createdBucketSize >= maxCreatedBuckets {
+		return nil, fmt.Errorf("Time range must not span more than %d days", maxCreatedBuckets)
+	}
+	agreementIDs := []string{}
+	for bucket := start / createdBucketSize; bucket <= end/createdBucketSize; bucket++ {
+		iter, err := ccs.caller.stub.GetStateByPartialCompositeKey(createdIndex,
+			[]string{fmt.Sprintf("%010d", bucket)})
+		if err != nil {
+			return nil, err
+		}
+		for iter.HasNext() {
+			kv, err := iter.Next()
+			if err != nil {
+				iter.Close()
+				return nil, err
+			}
+			_, keys, err := ccs.caller.stub.SplitCompositeKey(kv.Key)
+			if err != nil {
+				iter.Close()
+				return nil, err
+			}
+			createdAt, _ := strconv.ParseInt(keys[1], 10, 64)
+			if createdAt >= start && createdAt <= end {
+				agreementIDs = append(agreementIDs, keys[2])
+			}
+		}
+		iter.Close()
+	}
+	return agreementIDs, nil
+}
+
+// Timeline returns the lifecycle events of an agreement in the order
+// they occurred, i.e. its creation followed by its settlement, if any.
+// Timelines remain available once agreements are settled.
+func (ccs *CrossChainSwap) Timeline(agreementID string) ([]TimelineEvent, error) {
+	iter, err := ccs.caller.stub.GetStateByPartialCompositeKey(timelineIndex, []string{agreementID})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+	events := []TimelineEvent{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		var event TimelineEvent
+		if err = json.Unmarshal(kv.Value, &event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	if len(events) == 0 {
+		return nil, fmt.Errorf("No timeline recorded for agreement %s", agreementID)
+	}
+	return events, nil
+}
+
+// Status returns whether the agreement with the specified ID may be
+// claimed or unlocked now, and why. Settled agreements are deleted, and
+// their status is read from their timeline instead.
+func (ccs *CrossChainSwap) Status(agreementID string) (*AgreementStatus, error) {
+	agreement, err := ccs.getAgreement(agreementID)
+	if err != nil {
+		return nil, err
+	}
+	active := false
+	if agreement != nil {
+		if active, err = ccs.isActive(agreementID, agreement); err != nil {
+			return nil, err
+		}
+	}
+	if !active {
+		key, err := ccs.caller.stub.CreateCompositeKey(timelineIndex, []string{agreementID, stageSettled})
+		if err != nil {
+			return nil, err
+		}
+		b, err := ccs.caller.stub.GetState(key)
+		if err != nil {
+			return nil, err
+		}
+		// Agreements settled before timelines were recorded
+		if b == nil && agreement != nil {
+			return &AgreementStatus{Status: reasonSettled, ReasonCode: reasonSettled,
+				ReasonText: fmt.Sprintf("Agreement %s is no longer active", agreementID)}, nil
+		}
+		if b == nil {
+			return nil, fmt.Errorf("Agreement %s not found", agreementID)
+		}
+		var event TimelineEvent
+		if err = json.Unmarshal(b, &event); err != nil {
+			return nil, err
+		}
+		return &AgreementStatus{Status: event.Event, ReasonCode: event.Event,
+			ReasonText: fmt.Sprintf("Agreement %s was %s on %s", agreementID, event.Event,
+				time.Unix(event.Timestamp, 0).Format(time.RFC850))}, nil
+	}
+	status := &AgreementStatus{Status: statusActive}
+	if remaining := agreement.Expiry - getTxTime(ccs.caller); remaining > 0 {
+		status.SecondsToExpiry = remaining
+	}
+	// Claims are permitted up to and including the expiry, and unlocks
+	// from the expiry on
+	if err := ccs.checkExpired(agreement); err != nil {
+		status.ReasonCode, status.ReasonText = reasonNotExpired, err.Error()
+	} else {
+		status.Unlockable = true
+	}
+	if err := ccs.checkUnexpired(agreement); err != nil {
+		status.ReasonCode, status.ReasonText = reasonExpired, err.Error()
+	} else {
+		status.Claimable = true
+	}
+	return status, nil
+}
+
+// SecretUsed reports whether the secret of a given image has been
+// revealed to claim any agreement. A secret once revealed is public,
+// and must not be used for new agreements.
+func (ccs *CrossChainSwap) SecretUsed(image string) (bool, error) {
+	iter, err := ccs.caller.stub.GetStateByPartialCompositeKey(claimedIndex, []string{image})
+	if err != nil {
+		return false, err
+	}
+	defer iter.Close()
+	return iter.HasNext(), nil
+}
+
+// HealthCheck verifies the invariants of the swap state across active
+// agreements: each agreement exists and locks tokens, no agreement
+// expires before it was created, and the custody balance held in each
+// token contract covers the amounts locked in custody. Violations are
+// reported rather than returned as errors, so that all are found in a
+// single check.
+func (ccs *CrossChainSwap) HealthCheck() (*HealthReport, error) {
+	iter, err := ccs.caller.stub.GetStateByPartialCompositeKey(ownerCounterpartyIndex, []string{})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+	report := &HealthReport{Violations: []string{}}
+	locked := make(map[string]uint64)
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, keys, err := ccs.caller.stub.SplitCompositeKey(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		agreementID := keys[2]
+		agreement, err := ccs.getAgreement(agreementID)
+		if err != nil {
+			return nil, err
+		}
+		report.Agreements++
+		if agreement == nil {
+			report.Violations = append(report.Violations,
+				fmt.Sprintf("Agreement %s is active but not found", agreementID))
+			continue
+		}
+		if agreement.Amount == 0 {
+			report.Violations = append(report.Violations,
+				fmt.Sprintf("Agreement %s locks no tokens", agreementID))
+		}
+		if agreement.CreatedAt != 0 && agreement.Expiry < agreement.CreatedAt {
+			report.Violations = append(report.Violations,
+				fmt.Sprintf("Agreement %s expires before it was created", agreementID))
+		}
+		if agreement.Escrow == htlc.EscrowHold {
+			continue
+		}
+		total, err := safemath.Add(locked[agreement.TokenContract], agreement.Amount)
+		if err != nil {
+			report.Violations = append(report.Violations,
+				fmt.Sprintf("Amount locked in contract %s overflows", agreement.TokenContract))
+			continue
+		}
+		locked[agreement.TokenContract] = total
+	}
+	tokenContracts := make([]string, 0, len(locked))
+	for tokenContract := range locked {
+		tokenContracts = append(tokenContracts, tokenContract)
+	}
+	sort.Strings(tokenContracts)
+	custody := getChaincodeAddress(ccs.caller)
+	for _, tokenContract := range tokenContracts {
+		result := ccs.caller.stub.InvokeChaincode(tokenContract, argArray("BalanceOf", custody), "")
+		if result.Status != shim.OK {
+			report.Violations = append(report.Violations,
+				fmt.Sprintf("Error querying custody balance in contract %s: %s", tokenContract, result.Message))
+			continue
+		}
+		balance, err := parseAmount(result.Payload)
+		if err != nil {
+			report.Violations = append(report.Violations,
+				fmt.Sprintf("Error reading custody balance in contract %s: %s", tokenContract, err))
+			continue
+		}
+		if balance < locked[tokenContract] {
+			report.Violations = append(report.Violations,
+				fmt.Sprintf("Custody balance of %d in contract %s is below the %d locked",
+					balance, tokenContract, locked[tokenContract]))
+		}
+	}
+	report.Healthy = len(report.Violations) == 0
+	return report, nil
+}
+
+// DebugImage computes the image of a secret the way claims do, given
+// the encoding, hash algorithm and rounds of an agreement, and returns
+// the intermediate bytes. Empty settings take the defaults applied by
+// Lock. Diagnostics are only available if enabled in the
+// configuration, and should only be queried, since the arguments of a
+// submitted transaction are recorded on the ledger.
+func (ccs *CrossChainSwap) DebugImage(secret string, encoding string, algorithm string, rounds int) (*ImageDiagnostics, error) {
+	if !ccs.config.Debug {
+		return nil, fmt.Errorf("Diagnostics are disabled")
+	}
+	options, err := ccs.readLockOptions(htlc.LockOptions{SecretEncoding: encoding,
+		HashAlgorithm: algorithm, HashRounds: rounds})
+	if err != nil {
+		return nil, err
+	}
+	b, err := decodeSecret(secret, options.SecretEncoding)
+	if err != nil {
+		return nil, err
+	}
+	diagnostics := &ImageDiagnostics{
+		SecretEncoding: options.SecretEncoding,
+		HashAlgorithm:  options.HashAlgorithm,
+		HashRounds:     options.HashRounds,
+		Secret:         hex.EncodeToString(b),
+	}
+	for _, digest := range hashRounds(b, options.HashAlgorithm, options.HashRounds) {
+		diagnostics.Rounds = append(diagnostics.Rounds, hex.EncodeToString(digest))
+	}
+	diagnostics.Image = diagnostics.Rounds[len(diagnostics.Rounds)-1]
+	return diagnostics, nil
+}
+
+// SetHashAlgorithm changes the algorithm used to hash the secrets of
+// new agreements that do not specify one. Agreements created earlier
+// keep the algorithm they were created with. Only the administrator
+// may change the algorithm.
+func (ccs *CrossChainSwap) SetHashAlgorithm(algorithm string) error {
+	if err := ccs.checkAdmin(); err != nil {
+		return err
+	}
+	if _, ok := hashFunctions[algorithm]; !ok {
+		return fmt.Errorf("Unsupported hash algorithm '%s'", algorithm)
+	}
+	ccs.config.HashAlgorithm = algorithm
+	return ccs.putConfig()
+}
+
+// DenyImage adds an image to the denylist, rejecting new agreements
+// using it, e.g. because its secret is known to have leaked. Existing
+// agreements are unaffected. Only the administrator may maintain the
+// denylist.
+func (ccs *CrossChainSwap) DenyImage(image string) error {
+	if err := ccs.checkAdmin(); err != nil {
+		return err
+	}
+	key, err := ccs.caller.stub.CreateCompositeKey(deniedIndex, []string{image})
+	if err != nil {
+		return err
+	}
+	return ccs.caller.stub.PutState(key, []byte{0x00})
+}
+
+// AllowImage removes an image from the denylist. Only the
+// administrator may maintain the denylist.
+func (ccs *CrossChainSwap) AllowImage(image string) error {
+	if err := ccs.checkAdmin(); err != nil {
+		return err
+	}
+	key, err := ccs.caller.stub.CreateCompositeKey(deniedIndex, []string{image})
+	if err != nil {
+		return err
+	}
+	return ccs.caller.stub.DelState(key)
+}
+
+// PauseContract rejects new agreements locking tokens of the given
+// token contract, e.g. during an incident affecting the token.
+// Existing agreements may still be claimed or unlocked. Only the
+// administrator may pause a contract.
+func (ccs *CrossChainSwap) PauseContract(tokenContract string) error {
+	if err := ccs.checkAdmin(); err != nil {
+		return err
+	}
+	if tokenContract == "" {
+		return fmt.Errorf("Token contract must not be empty")
+	}
+	key, err := ccs.caller.stub.CreateCompositeKey(pausedIndex, []string{tokenContract})
+	if err != nil {
+		return err
+	}
+	return ccs.caller.stub.PutState(key, []byte{0x00})
+}
+
+// ResumeContract accepts new agreements for a paused token contract
+// again. Only the administrator may resume a contract.
+func (ccs *CrossChainSwap) ResumeContract(tokenContract string) error {
+	if err := ccs.checkAdmin(); err != nil {
+		return err
+	}
+	key, err := ccs.caller.stub.CreateCompositeKey(pausedIndex, []string{tokenContract})
+	if err != nil {
+		return err
+	}
+	return ccs.caller.stub.DelState(key)
+}
+
+// ReindexAgreement migrates an agreement locked before agreements were
+// indexed by owner and counterparty, indexing it as active so that it
+// may be claimed, unlocked or cancelled. Agreements settled before
+// they were deleted on settlement are equally unindexed and cannot be
+// told apart, so the administrator names each agreement known to be
+// unsettled. Agreements with a recorded settlement or claim are
+// refused. Only the administrator may reindex agreements.
+func (ccs *CrossChainSwap) ReindexAgreement(agreementID string) error {
+	if err := ccs.checkAdmin(); err != nil {
+		return err
+	}
+	agreement, err := ccs.getAgreement(agreementID)
+	if err != nil {
+		return err
+	}
+	if agreement == nil {
+		return fmt.Errorf("Agreement %s not found", agreementID)
+	}
+	active, err := ccs.isActive(agreementID, agreement)
+	if err != nil {
+		return err
+	}
+	if active {
+		return fmt.Errorf("Agreement %s is already indexed", agreementID)
+	}
+	key, err := ccs.caller.stub.CreateCompositeKey(timelineIndex, []string{agreementID, stageSettled})
+	if err != nil {
+		return err
+	}
+	b, err := ccs.caller.stub.GetState(key)
+	if err != nil {
+		return err
+	}
+	if b != nil {
+		return fmt.Errorf("Agreement %s has been settled", agreementID)
+	}
+	for _, image := range agreementImages(agreement) {
+		claimed, err := ccs.hasClaimedIndex(agreementID, image)
+		if err != nil {
+			return err
+		}
+		if claimed {
+			return fmt.Errorf("Agreement %s has been claimed", agreementID)
+		}
+	}
+	return ccs.putIndex(agreementID, agreement)
+}
+
+// DeregisterContract stops recognizing the given token contract, e.g.
+// because it has been compromised. Unlike a paused contract, a
+// deregistered contract is not invoked to settle existing agreements
+// either, which remain locked until the contract is registered again.
+// Only the administrator may deregister a contract.
+func (ccs *CrossChainSwap) DeregisterContract(tokenContract string) error {
+	if err := ccs.checkAdmin(); err != nil {
+		return err
+	}
+	if tokenContract == "" {
+		return fmt.Errorf("Token contract must not be empty")
+	}
+	key, err := ccs.caller.stub.CreateCompositeKey(deregisteredIndex, []string{tokenContract})
+	if err != nil {
+		return err
+	}
+	return ccs.caller.stub.PutState(key, []byte{0x00})
+}
+
+// RegisterContract recognizes a deregistered token contract again.
+// Only the administrator may register a contract.
+func (ccs *CrossChainSwap) RegisterContract(tokenContract string) error {
+	if err := ccs.checkAdmin(); err != nil {
+		return err
+	}
+	key, err := ccs.caller.stub.CreateCompositeKey(deregisteredIndex, []string{tokenContract})
+	if err != nil {
+		return err
+	}
+	return ccs.caller.stub.DelState(key)
+}
+
+// AuthorizeLocker permits a locker to lock tokens on behalf of the
+// invoker (owner) by specifying the owner in the lock options. The
+// owner remains the only party able to unlock or cancel the resulting
+// agreements.
+func (ccs *CrossChainSwap) AuthorizeLocker(locker string) error {
+	if !security.IsAddress(locker) {
+		return fmt.Errorf("Malformed locker address '%s'", locker)
+	}
+	key, err := ccs.caller.stub.CreateCompositeKey(lockerIndex,
+		[]string{getInvokerAddress(ccs.caller), locker})
+	if err != nil {
+		return err
+	}
+	return ccs.caller.stub.PutState(key, []byte{0x00})
+}
+
+// RevokeLocker withdraws the permission of a locker to lock tokens on
+// behalf of the invoker (owner). Agreements created earlier are
+// unaffected.
+func (ccs *CrossChainSwap) RevokeLocker(locker string) error {
+	key, err := ccs.caller.stub.CreateCompositeKey(lockerIndex,
+		[]string{getInvokerAddress(ccs.caller), locker})
+	if err != nil {
+		return err
+	}
+	return ccs.caller.stub.DelState(key)
+}
+
+// checkAdmin returns an error if the invoker is not the administrator
+// of the chaincode.
+func (ccs *CrossChainSwap) checkAdmin() error {
+	if !sameAddress(getInvokerAddress(ccs.caller), ccs.config.Admin) {
+		return fmt.Errorf("Invoker is not authorized to administer the chaincode")
+	}
+	return nil
+}
+
+// checkDenied returns an error if any of the given images is on the
+// denylist.
+func (ccs *CrossChainSwap) checkDenied(images []string) error {
+	for _, image := range images {
+		key, err := ccs.caller.stub.CreateCompositeKey(deniedIndex, []string{image})
+		if err != nil {
+			return err
+		}
+		b, err := ccs.caller.stub.GetState(key)
+		if err != nil {
+			return err
+		}
+		if b != nil {
+			return fmt.Errorf("Image '%s' is on the denylist", image)
+		}
+	}
+	return nil
+}
+
+// checkPaused returns an error if new agreements for the given token
+// contract have been paused.
+func (ccs *CrossChainSwap) checkPaused(tokenContract string) error {
+	key, err := ccs.caller.stub.CreateCompositeKey(pausedIndex, []string{tokenContract})
+	if err != nil {
+		return err
+	}
+	b, err := ccs.caller.stub.GetState(key)
+	if err != nil {
+		return err
+	}
+	if b != nil {
+		return fmt.Errorf("New agreements for token contract %s are paused", tokenContract)
+	}
+	return nil
+}
+
+// checkRegistered returns an error if the given token contract has
+// been deregistered.
+func (ccs *CrossChainSwap) checkRegistered(tokenContract string) error {
+	key, err := ccs.caller.stub.CreateCompositeKey(deregisteredIndex, []string{tokenContract})
+	if err != nil {
+		return err
+	}
+	b, err := ccs.caller.stub.GetState(key)
+	if err != nil {
+		return err
+	}
+	if b != nil {
+		return fmt.Errorf("Token contract %s is not registered", tokenContract)
+	}
+	return nil
+}
+
+// lockOwner returns the owner of the tokens to be locked, which is the
+// invoker unless the options specify an owner who has authorized the
+// invoker as a locker.
+func (ccs *CrossChainSwap) lockOwner(options htlc.LockOptions) (string, error) {
+	invoker := getInvokerAddress(ccs.caller)
+	if options.Owner == "" || options.Owner == invoker {
+		return invoker, nil
+	}
+	key, err := ccs.caller.stub.CreateCompositeKey(lockerIndex, []string{options.Owner, invoker})
+	if err != nil {
+		return "", err
+	}
+	b, err := ccs.caller.stub.GetState(key)
+	if err != nil {
+		return "", err
+	}
+	if b == nil {
+		return "", fmt.Errorf("Invoker is not authorized to lock tokens on behalf of %s", options.Owner)
+	}
+	return options.Owner, nil
+}
+
+// getAgreement returns the agreement with the specified ID from the ledger.
+func (ccs *CrossChainSwap) getAgreement(agreementID string) (*Agreement, error) {
+	var b []byte
+	var err error
+	if b, err = ccs.caller.stub.GetState(agreementID); err != nil {
+		return nil, err
+	}
+	var agreement Agreement
+	if b == nil {
+		return nil, nil
+	}
+	if err = json.Unmarshal(b, &agreement); err != nil {
+		return nil, err
+	}
+	return &agreement, nil
+}
+
+// putAgreement writes the given agreement to the ledger.
+func (ccs *CrossChainSwap) putAgreement(agreementID string, agreement *Agreement) error {
+	b, err := json.Marshal(&agreement)
+	if err != nil {
+		return err
+	}
+	if err = ccs.caller.stub.PutState(agreementID, b); err != nil {
+		return err
+	}
+	return nil
+}
+
+// putConfig writes the configuration of the chaincode to the ledger.
+func (ccs *CrossChainSwap) putConfig() error {
+	b, err := json.Marshal(ccs.config)
+	if err != nil {
+		return fmt.Errorf("Error marshalling configuration")
+	}
+	if err = ccs.caller.stub.PutState(configKey, b); err != nil {
+		return fmt.Errorf("Error writing configuration to ledger")
+	}
+	return nil
+}
+
+// readLockOptions validates the options supplied to Lock and returns
+// them with defaults applied to options not supplied.
+func (ccs *CrossChainSwap) readLockOptions(options htlc.LockOptions) (htlc.LockOptions, error) {
+	if options.SecretEncoding == "" {
+		options.SecretEncoding = htlc.EncodingUTF8
+	}
+	if options.SecretEncoding != htlc.EncodingUTF8 && options.SecretEncoding != htlc.EncodingHex {
+		return options, fmt.Errorf("Unsupported secret encoding '%s'", options.SecretEncoding)
+	}
+	if options.HashAlgorithm == "" {
+		options.HashAlgorithm = ccs.config.HashAlgorithm
+	}
+	if options.HashAlgorithm == "" {
+		options.HashAlgorithm = htlc.HashSHA256
+	}
+	if _, ok := hashFunctions[options.HashAlgorithm]; !ok {
+		return options, fmt.Errorf("Unsupported hash algorithm '%s'", options.HashAlgorithm)
+	}
+	if options.HashRounds == 0 {
+		options.HashRounds = 1
+	}
+	if options.HashRounds < 1 || options.HashRounds > maxHashRounds {
+		return options, fmt.Errorf("Hash rounds must be between 1 and %d", maxHashRounds)
+	}
+	if len(options.Hint) > maxHintLength {
+		return options, fmt.Errorf("Hint must not exceed %d characters", maxHintLength)
+	}
+	if options.AllowDelegatedClaim != (options.Delegate != "") {
+		return options, fmt.Errorf("A delegate must be specified if and only if delegated claims are allowed")
+	}
+	if options.RefundAddress != "" && !security.IsAddress(options.RefundAddress) {
+		return options, fmt.Errorf("Malformed refund address '%s'", options.RefundAddress)
+	}
+	if options.Owner != "" && !security.IsAddress(options.Owner) {
+		return options, fmt.Errorf("Malformed owner address '%s'", options.Owner)
+	}
+	if options.Combinator == "" {
+		options.Combinator = htlc.CombinatorAnd
+	}
+	if options.Combinator != htlc.CombinatorAnd && options.Combinator != htlc.CombinatorOr {
+		return options, fmt.Errorf("Unsupported combinator '%s'", options.Combinator)
+	}
+	if len(options.Images) == 0 {
+		options.Combinator = ""
+	}
+	if options.Escrow == "" {
+		options.Escrow = htlc.EscrowCustody
+	}
+	if _, ok := requiredCapabilities[options.Escrow]; !ok {
+		return options, fmt.Errorf("Unsupported escrow mode '%s'", options.Escrow)
+	}
+	return options, nil
+}
+
+// release invokes the token contract of an agreement to transfer the
+// given amount of the locked tokens to the given address, either from
+// the current contract's address or by releasing the hold on them,
+// which releases all held tokens. The contract is only invoked while
+// it is registered.
+func (ccs *CrossChainSwap) release(agreementID string, agreement *Agreement, to string, amount uint64) error {
+	if err := ccs.checkRegistered(agreement.TokenContract); err != nil {
+		return err
+	}
+	var args [][]byte
+	if agreement.Escrow == htlc.EscrowHold {
+		args = argArray("Release", agreementID, to)
+	} else {
+		args = argArray("Transfer", to, strconv.FormatUint(amount, 10))
+	}
+	result := ccs.caller.stub.InvokeChaincode(agreement.TokenContract, args, "")
+	if result.Status != shim.OK {
+		return fmt.Errorf("Error transferring tokens in contract %s: %s", agreement.TokenContract, result.Message)
+	}
+	return nil
+}
+
+// checkImages verifies that the images of an agreement are distinct
+// and do not exceed the maximum number of images.
+func checkImages(image string, images []string) error {
+	if len(images)+1 > maxImages {
+		return fmt.Errorf("Agreements must not have more than %d images", maxImages)
+	}
+	seen := map[string]bool{image: true}
+	for _, i := range images {
+		if seen[i] {
+			return fmt.Errorf("Duplicate image '%s'", i)
+		}
+		seen[i] = true
+	}
+	return nil
+}
+
+// checkWeakImages returns an error if any of the given images is empty,
+// all zeros, or the image of a weak secret under the hash algorithm
+// and rounds of the options.
+func checkWeakImages(images []string, options htlc.LockOptions) error {
+	weak := map[string]bool{}
+	for _, secret := range weakSecrets {
+		weak[imageOfRounds(secret, options.HashAlgorithm, options.HashRounds)] = true
+	}
+	for _, image := range images {
+		if strings.Trim(image, "0") == "" || weak[strings.ToLower(image)] {
+			return fmt.Errorf("Image '%s' is the image of a weak secret", image)
+		}
+	}
+	return nil
+}
+
+// matchSecrets matches the supplied secrets against the images of an
+// agreement, returning the secrets revealed by image. An error is
+// returned if a secret matches none of the images, or the secrets do
+// not satisfy the combinator of the agreement.
+func matchSecrets(agreement *Agreement, secrets []string) (map[string]string, error) {
+	if len(secrets) == 0 {
+		return nil, fmt.Errorf("No secret supplied")
+	}
+	if len(agreement.Images) == 0 {
+		if len(secrets) > 1 {
+			return nil, fmt.Errorf("Agreement requires a single secret")
+		}
+		b, err := decodeSecret(secrets[0], agreement.SecretEncoding)
+		if err != nil {
+			return nil, err
+		}
+		if !matchesImage(b, agreement.HashAlgorithm, agreement.HashRounds, agreement.Image) {
+			return nil, fmt.Errorf("Hash of secret '%s' does not match image '%s'", secrets[0], agreement.Image)
+		}
+		return map[string]string{agreement.Image: secrets[0]}, nil
+	}
+	images := agreementImages(agreement)
+	revealed := make(map[string]string)
+	for _, secret := range secrets {
+		b, err := decodeSecret(secret, agreement.SecretEncoding)
+		if err != nil {
+			return nil, err
+		}
+		matched := false
+		for _, image := range images {
+			if matchesImage(b, agreement.HashAlgorithm, agreement.HashRounds, image) {
+				revealed[image] = secret
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("Hash of secret '%s' does not match any image", secret)
+		}
+	}
+	if agreement.Combinator == htlc.CombinatorAnd {
+		for _, image := range images {
+			if _, ok := revealed[image]; !ok {
+				return nil, fmt.Errorf("Secret of image '%s' is required", image)
+			}
+		}
+	}
+	return revealed, nil
+}
+
+// agreementImages returns all images of an agreement, beginning with
+// the image supplied to Lock.
+func agreementImages(agreement *Agreement) []string {
+	return append([]string{agreement.Image}, agreement.Images...)
+}
+
+// transferToCustody transfers tokens approved by the owner to the
+// chaincode address, verifying that the custody balance increased by
+// the full amount. A token contract charging a fee on transfers would
+// otherwise leave the agreement under-collateralized. The balance
+// following the transfer is reported by the token contract, since
+// writes are not visible to reads within a transaction.
+func (ccs *CrossChainSwap) transferToCustody(tokenContract string, owner string, amount uint64) error {
+	custody := getChaincodeAddress(ccs.caller)
+	result := ccs.caller.stub.InvokeChaincode(tokenContract, argArray("BalanceOf", custody), "")
+	if result.Status != shim.OK {
+		return fmt.Errorf("Error querying custody balance in contract %s: %s", tokenContract, result.Message)
+	}
+	before, err := parseAmount(result.Payload)
+	if err != nil {
+		return fmt.Errorf("Error reading custody balance in contract %s: %s", tokenContract, err)
+	}
+	args := argArray("TransferFrom", owner, custody, strconv.FormatUint(amount, 10))
+	result = ccs.caller.stub.InvokeChaincode(tokenContract, args, "")
+	if result.Status != shim.OK {
+		return fmt.Errorf("Error transferring tokens in contract %s: %s", tokenContract, result.Message)
+	}
+	after, err := parseAmount(result.Payload)
+	if err != nil {
+		return fmt.Errorf("Error reading custody balance in contract %s: %s", tokenContract, err)
+	}
+	if after < before || after-before != amount {
+		return fmt.Errorf("Custody balance in contract %s is %d following transfer, expected %d", tokenContract, after, before+amount)
+	}
+	return nil
+}
+
+// checkCapabilities queries the version of the given token contract
+// and verifies that it supports all required capabilities.
+func (ccs *CrossChainSwap) checkCapabilities(tokenContract string, required []string) error {
+	result := ccs.caller.stub.InvokeChaincode(tokenContract, argArray("Version"), "")
+	if result.Status != shim.OK {
+		return fmt.Errorf("Error querying version of token contract %s: %s", tokenContract, result.Message)
+	}
+	var version tokens.Version
+	if err := json.Unmarshal(result.Payload, &version); err != nil {
+		return fmt.Errorf("Error reading version of token contract %s: %s", tokenContract, err)
+	}
+	for _, r := range required {
+		supported := false
+		for _, c := range version.Capabilities {
+			if c == r {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return fmt.Errorf("Token contract %s does not support '%s'", tokenContract, r)
+		}
+	}
+	return nil
+}
+
+// checkAgreementCap queries the supply of the given token contract
+// and verifies that the amount does not exceed the configured fraction
+// of it.
+func (ccs *CrossChainSwap) checkAgreementCap(tokenContract string, amount uint64) error {
+	if ccs.config.MaxAgreementBps == 0 {
+		return nil
+	}
+	result := ccs.caller.stub.InvokeChaincode(tokenContract, argArray("TokenSupply"), "")
+	if result.Status != shim.OK {
+		return fmt.Errorf("Error querying supply of token contract %s: %s", tokenContract, result.Message)
+	}
+	supply, err := parseAmount(result.Payload)
+	if err != nil {
+		return fmt.Errorf("Error reading supply of token contract %s: %s", tokenContract, err)
+	}
+	max, err := safemath.MulDiv(supply, ccs.config.MaxAgreementBps, 10000)
+	if err != nil {
+		return err
+	}
+	if amount > max {
+		return fmt.Errorf("Amount exceeds the maximum of %d per agreement", max)
+	}
+	return nil
+}
+
+// putIndex writes the composite key indexing an active agreement by
+// its owner and counterparty.
+func (ccs *CrossChainSwap) putIndex(agreementID string, agreement *Agreement) error {
+	key, err := ccs.caller.stub.CreateCompositeKey(ownerCounterpartyIndex,
+		[]string{agreement.Owner, agreement.Counterparty, agreementID})
+	if err != nil {
+		return err
+	}
+	// The index carries no value, but an empty value would delete the key
+	return ccs.caller.stub.PutState(key, []byte{0x00})
+}
+
+// putRevealedSecret writes a secret revealed by a claim to the ledger,
+// keyed by the time of the claim so that secrets are listed in order,
+// followed by the agreement and image so that keys are unique.
+func (ccs *CrossChainSwap) putRevealedSecret(revealed *RevealedSecret) error {
+	key := fmt.Sprintf("%s%020d:%s:%s", revealedKeyPrefix, revealed.ClaimedAt, revealed.AgreementID, revealed.Image)
+	b, err := json.Marshal(revealed)
+	if err != nil {
+		return err
+	}
+	return ccs.caller.stub.PutState(key, b)
+}
+
+// putMirrorIndex writes the composite key indexing an agreement by
+// the reference to its mirror agreement, if any.
+func (ccs *CrossChainSwap) putMirrorIndex(agreementID string, agreement *Agreement) error {
+	if agreement.MirrorAgreementID == "" {
+		return nil
+	}
+	key, err := ccs.caller.stub.CreateCompositeKey(mirrorIndex,
+		[]string{agreement.MirrorChannel, agreement.MirrorAgreementID, agreementID})
+	if err != nil {
+		return err
+	}
+	return ccs.caller.stub.PutState(key, []byte{0x00})
+}
+
+// putCreatedIndex writes the composite key indexing an agreement by
+// the time of its creation.
+func (ccs *CrossChainSwap) putCreatedIndex(agreementID string, agreement *Agreement) error {
+	bucket := agreement.CreatedAt / createdBucketSize
+	key, err := ccs.caller.stub.CreateCompositeKey(createdIndex,
+		[]string{fmt.Sprintf("%010d", bucket), fmt.Sprintf("%020d", agreement.CreatedAt), agreementID})
+	if err != nil {
+		return err
+	}
+	return ccs.caller.stub.PutState(key, []byte{0x00})
+}
+
+// putClaimedIndex writes the composite key indexing a claimed
+// agreement by its image.
+func (ccs *CrossChainSwap) putClaimedIndex(agreementID string, image string) error {
+	key, err := ccs.caller.stub.CreateCompositeKey(claimedIndex, []string{image, agreementID})
+	if err != nil {
+		return err
+	}
+	return ccs.caller.stub.PutState(key, []byte{0x00})
+}
+
+// hasClaimedIndex reports whether the composite key indexing a claimed
+// agreement by its image has been written, i.e. the secret of the
+// image was revealed by an earlier partial claim.
+func (ccs *CrossChainSwap) hasClaimedIndex(agreementID string, image string) (bool, error) {
+	key, err := ccs.caller.stub.CreateCompositeKey(claimedIndex, []string{image, agreementID})
+	if err != nil {
+		return false, err
+	}
+	b, err := ccs.caller.stub.GetState(key)
+	if err != nil {
+		return false, err
+	}
+	return b != nil, nil
+}
+
+// putTimelineEvent records an event caused by the invoker at the
+// given stage of the lifecycle of an agreement.
+func (ccs *CrossChainSwap) putTimelineEvent(agreementID string, stage string, event string) error {
+	key, err := ccs.caller.stub.CreateCompositeKey(timelineIndex, []string{agreementID, stage})
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(TimelineEvent{
+		Event:     event,
+		Actor:     getInvokerAddress(ccs.caller),
+		Timestamp: getTxTime(ccs.caller),
+		TxID:      ccs.caller.stub.GetTxID()})
+	if err != nil {
+		return err
+	}
+	return ccs.caller.stub.PutState(key, b)
+}
+
+// isActive reports whether an agreement is still active, i.e. its
+// tokens have been neither claimed nor released. Agreements locked
+// before they were indexed are inactive until reindexed with
+// ReindexAgreement.
+func (ccs *CrossChainSwap) isActive(agreementID string, agreement *Agreement) (bool, error) {
+	key, err := ccs.caller.stub.CreateCompositeKey(ownerCounterpartyIndex,
+		[]string{agreement.Owner, agreement.Counterparty, agreementID})
+	if err != nil {
+		return false, err
+	}
+	b, err := ccs.caller.stub.GetState(key)
+	if err != nil {
+		return false, err
+	}
+	return b != nil, nil
+}
+
+// deleteIndex removes the composite key indexing an agreement once it
+// is no longer active.
+func (ccs *CrossChainSwap) deleteIndex(agreementID string, agreement *Agreement) error {
+	key, err := ccs.caller.stub.CreateCompositeKey(ownerCounterpartyIndex,
+		[]string{agreement.Owner, agreement.Counterparty, agreementID})
+	if err != nil {
+		return err
+	}
+	return ccs.caller.stub.DelState(key)
+}
+
+// deleteAgreement deletes a settled agreement from the ledger, along
+// with the keys indexing it as active and by its mirror agreement, so
+// that its tokens cannot be released a second time. The index by
+// creation time, the claimed index and revealed secrets are kept.
+func (ccs *CrossChainSwap) deleteAgreement(agreementID string, agreement *Agreement) error {
+	if err := ccs.deleteIndex(agreementID, agreement); err != nil {
+		return err
+	}
+	// Consent to abort, if any, lapses with the agreement
+	key, err := ccs.caller.stub.CreateCompositeKey(abortIndex, []string{agreementID})
+	if err != nil {
+		return err
+	}
+	if err = ccs.caller.stub.DelState(key); err != nil {
+		return err
+	}
+	if agreement.MirrorAgreementID != "" {
+		key, err := ccs.caller.stub.CreateCompositeKey(mirrorIndex,
+			[]string{agreement.MirrorChannel, agreement.MirrorAgreementID, agreementID})
+		if err != nil {
+			return err
+		}
+		if err = ccs.caller.stub.DelState(key); err != nil {
+			return err
+		}
+	}
+	return ccs.caller.stub.DelState(agreementID)
+}
+
+// newAgreementID creates a unique agreement ID.
+func (ccs *CrossChainSwap) newAgreementID() string {
+	// The transaction ID is unique per transaction, per client.
+	// This will serve as a good agreement ID.
+	return ccs.caller.stub.GetTxID()
+}
+
+// decodeSecret returns the bytes of a secret given its encoding.
+// Agreements without an encoding treat the secret as UTF-8.
+func decodeSecret(secret string, encoding string) ([]byte, error) {
+	if encoding != htlc.EncodingHex {
+		return []byte(secret), nil
+	}
+	b, err := hex.DecodeString(secret)
+	if err != nil {
+		return nil, fmt.Errorf("Secret '%s' is not hex encoded", secret)
+	}
+	return b, nil
+}
+
+// imageOf returns the SHA256 hex representation of a given secret.
+func imageOf(secret []byte) string {
+	h := sha256.Sum256(secret)
+	return hex.EncodeToString(h[:])
+}
+
+// imageOfRounds returns the hex representation of a given secret
+// hashed the given number of times using the given algorithm. Each
+// round hashes the raw digest of the previous round. An empty
+// algorithm denotes SHA-256.
+func imageOfRounds(secret []byte, algorithm string, rounds int) string {
+	digests := hashRounds(secret, algorithm, rounds)
+	if digests == nil {
+		return ""
+	}
+	return hex.EncodeToString(digests[len(digests)-1])
+}
+
+// hashRounds returns the raw digest of each round of hashing a given
+// secret the given number of times using the given algorithm, or nil
+// if the algorithm is not supported. At least one round is hashed. An
+// empty algorithm denotes SHA-256.
+func hashRounds(secret []byte, algorithm string, rounds int) [][]byte {
+	if algorithm == "" {
+		algorithm = htlc.HashSHA256
+	}
+	hash, ok := hashFunctions[algorithm]
+	if !ok {
+		return nil
+	}
+	digests := [][]byte{hash(secret)}
+	for i := 1; i < rounds; i++ {
+		digests = append(digests, hash(digests[i-1]))
+	}
+	return digests
+}
+
+// matchesImage reports whether the hex representation of a given
+// secret, hashed the given number of times using the given algorithm,
+// matches the image. The comparison takes constant time so as not to
+// reveal how much of the image was matched.
+func matchesImage(secret []byte, algorithm string, rounds int, image string) bool {
+	computed := imageOfRounds(secret, algorithm, rounds)
+	return computed != "" && subtle.ConstantTimeCompare([]byte(computed), []byte(image)) == 1
+}
+
+// parseAmount reads a balance or supply reported by a token contract.
+// Token contracts with decimals report amounts with exactly as many
+// fractional digits, e.g. "1.50" for 150 of the smallest unit, so
+// removing the decimal point yields the amount in the smallest unit.
+// A decimal point must have digits on both sides.
+func parseAmount(b []byte) (uint64, error) {
+	s := string(b)
+	if point := strings.IndexByte(s, '.'); point == 0 || point == len(s)-1 {
+		return 0, fmt.Errorf("Malformed amount '%s'", s)
+	}
+	return strconv.ParseUint(strings.Replace(s, ".", "", 1), 10, 64)
+}
+
+// sameAddress reports whether two addresses are equal. The comparison
+// takes constant time so as not to reveal how much of an address was
+// matched.
+func sameAddress(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
 }
 
 // argArray returns a slice over byte array, each element representing a
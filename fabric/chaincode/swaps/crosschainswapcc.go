@@ -4,8 +4,12 @@ import (
 	"crypto/x509"
 	"encoding/json"
 	"fmt"
+	"math"
+	"os"
 	"reflect"
 	"strconv"
+	"strings"
+	"sync/atomic"
 
 	"github.com/dileban/atomic-swaps/fabric/lib/asset/htlc"
 	"github.com/dileban/atomic-swaps/fabric/lib/security"
@@ -17,7 +21,11 @@ import (
 
 // CrossChainSwapChaincode is ...
 type CrossChainSwapChaincode struct {
-	swap htlc.HTLC
+	swap *CrossChainSwap
+	// failures counts the invocations that failed on this peer since
+	// the chaincode started, as a failed transaction commits no state.
+	// Handlers see a snapshot of the count.
+	failures uint64
 }
 
 // CallerProps is a container for meta data from the remote client as
@@ -29,12 +37,119 @@ type CallerProps struct {
 	stub shim.ChaincodeStubInterface
 }
 
-// For use within handlers and the token implementation.
-var caller *CallerProps
+// Simulation is the outcome of a simulated operation, along with the
+// reason the operation is expected to fail.
+type Simulation struct {
+	OK     bool   `json:"ok"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Parameters are the operational parameters of the chaincode, which
+// clients need to construct valid operations.
+type Parameters struct {
+	Config
+	HashAlgorithms  []string `json:"hashAlgorithms"`
+	SecretEncodings []string `json:"secretEncodings"`
+	MaxHashRounds   int      `json:"maxHashRounds"`
+	MinLockTime     int64    `json:"minLockTime"`
+	MaxLockTime     int64    `json:"maxLockTime"`
+	MaxHintLength   int      `json:"maxHintLength"`
+	MaxImages       int      `json:"maxImages"`
+	Combinators     []string `json:"combinators"`
+	EscrowModes     []string `json:"escrowModes"`
+}
+
+// Bounds and default of the lock time of an agreement, in seconds.
+const (
+	minLockTime     = 60
+	maxLockTime     = 365 * 24 * 60 * 60
+	defaultLockTime = 24 * 60 * 60
+)
+
+// defaultCancellationWindow is the time, in seconds, after creating
+// an agreement during which the owner may cancel it, unless
+// configured otherwise.
+const defaultCancellationWindow = 60
+
+// metricIndex is the name of the composite key index for the counters
+// maintained by the handlers.
+const metricIndex = "metric"
+
+// Names of the counters maintained by the handlers.
+const (
+	metricLocks         = "locks"
+	metricUnlocks       = "unlocks"
+	metricClaims        = "claims"
+	metricCancellations = "cancellations"
+)
+
+// metrics lists the counters returned by MetricsHandler.
+var metrics = []string{metricLocks, metricUnlocks, metricClaims, metricCancellations}
+
+// maxCompactedIncrements is the maximum number of increments of a
+// counter merged by a single invocation of CompactMetricsHandler.
+const maxCompactedIncrements = 1000
+
+// metricLockTime is the name of the counter summing the lock times, in
+// seconds, of all agreements created. It is only reported through
+// AnalyticsHandler.
+const metricLockTime = "lockTime"
 
-// Init is called during chaincode instantiation. No special
-// initialization required.
+// Analytics are aggregate statistics over all agreements created. The
+// average lock time is the mean of the lock times agreed on, in
+// seconds, and the claim ratio is the fraction of agreements settled
+// by claiming or unlocking that were claimed.
+type Analytics struct {
+	Agreements      uint64  `json:"agreements"`
+	AverageLockTime float64 `json:"averageLockTime"`
+	Claims          uint64  `json:"claims"`
+	Unlocks         uint64  `json:"unlocks"`
+	ClaimRatio      float64 `json:"claimRatio"`
+}
+
+// Init is called during chaincode instantiation. The arguments passed
+// to Init by the remote client includes:
+//
+//   0: Optional JSON encoded configuration, e.g.
+//      {"defaultLockTime": 3600, "cancellationWindow": 30,
+//       "maxAgreementBps": 500, "hashAlgorithm": "sha256"}
+//
+// The invoker becomes the administrator of the chaincode. Settings
+// not supplied take their default values.
 func (ccs *CrossChainSwapChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	args := stub.GetStringArgs()
+	config := Config{DefaultLockTime: defaultLockTime, CancellationWindow: defaultCancellationWindow,
+		HashAlgorithm: htlc.HashSHA256}
+	if len(args) > 0 && args[0] != "" {
+		if err := json.Unmarshal([]byte(args[0]), &config); err != nil {
+			return shim.Error(fmt.Sprintf("Error reading configuration: %s", err))
+		}
+	}
+	if config.DefaultLockTime < minLockTime || config.DefaultLockTime > maxLockTime {
+		return shim.Error(fmt.Sprintf("Default lock time must be between %d and %d seconds", minLockTime, maxLockTime))
+	}
+	if config.CancellationWindow < 0 || config.CancellationWindow > minLockTime {
+		return shim.Error(fmt.Sprintf("Cancellation window must be between 0 and %d seconds", minLockTime))
+	}
+	if config.MaxAgreementBps > 10000 {
+		return shim.Error("Maximum agreement amount must not exceed 10000 basis points")
+	}
+	if _, ok := hashFunctions[config.HashAlgorithm]; !ok {
+		return shim.Error(fmt.Sprintf("Unsupported hash algorithm '%s'", config.HashAlgorithm))
+	}
+	cert, err := cid.GetX509Certificate(stub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Error reading invoker's certificate: %s", err))
+	}
+	config.Admin = security.NewX509Certificate(cert).GetAddress()
+
+	b, err := json.Marshal(config)
+	if err != nil {
+		return shim.Error("Error marshalling configuration")
+	}
+	if err = stub.PutState(configKey, b); err != nil {
+		return shim.Error("Error writing configuration to ledger")
+	}
 	return shim.Success(nil)
 }
 
@@ -46,81 +161,853 @@ func (ccs *CrossChainSwapChaincode) Init(stub shim.ChaincodeStubInterface) pb.Re
 //   1..N: A list of arguments for the function defined in the
 //      'HTLC' interface.
 func (ccs *CrossChainSwapChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	response := ccs.dispatch(stub)
+	if response.Status >= shim.ERRORTHRESHOLD {
+		atomic.AddUint64(&ccs.failures, 1)
+	}
+	return response
+}
+
+// dispatch invokes the handler named by the function of the
+// transaction proposal.
+func (ccs *CrossChainSwapChaincode) dispatch(stub shim.ChaincodeStubInterface) pb.Response {
 	f, params := stub.GetFunctionAndParameters()
-	ccs.swap = &CrossChainSwap{}
+	if f == "" || f == "init" {
+		return shim.Error(fmt.Sprintf("Function name '%s' is reserved", f))
+	}
+
+	// Retrieve configuration from ledger, chaincodes instantiated
+	// before it was introduced use the defaults
+	config := &Config{DefaultLockTime: defaultLockTime, CancellationWindow: defaultCancellationWindow,
+		HashAlgorithm: htlc.HashSHA256}
+	b, err := stub.GetState(configKey)
+	if err != nil {
+		return shim.Error("Error reading configuration from ledger")
+	}
+	if b != nil {
+		if err = json.Unmarshal(b, config); err != nil {
+			return shim.Error("Error unmarshaling configuration json")
+		}
+	}
 
-	// Initialize caller props for use in handlers
+	// Initialize caller props for use in handlers and the swap
 	cert, _ := cid.GetX509Certificate(stub)
-	caller = &CallerProps{args: params, cert: cert, stub: stub}
+	caller := &CallerProps{args: params, cert: cert, stub: stub}
 
-	// Dispatch to appropriate handler based on supplied func name
+	// Dispatch to appropriate handler based on supplied func name. The
+	// handler operates on state scoped to this invocation, leaving the
+	// chaincode itself untouched.
 	// TODO: Handle potential panics
-	v := reflect.ValueOf(ccs).MethodByName(f + "Handler").Call([]reflect.Value{})
+	cc := &CrossChainSwapChaincode{swap: &CrossChainSwap{config: config, caller: caller},
+		failures: atomic.LoadUint64(&ccs.failures)}
+	handler := reflect.ValueOf(cc).MethodByName(f + "Handler")
+	if !handler.IsValid() {
+		return shim.Error(fmt.Sprintf("Unknown function: %s", f))
+	}
+	v := handler.Call([]reflect.Value{reflect.ValueOf(caller)})
 	return v[0].Interface().(pb.Response)
 }
 
 // LockHandler creates a new swap agreement between the invoker
-// (owner) and the counterparty. If the lock was successful, the
-// handler raises the 'Locked' event and returns the ID of the new
-// agreement.
-func (ccs *CrossChainSwapChaincode) LockHandler() pb.Response {
-	// TODO: validate args
+// (owner) and the counterparty. The lock time may be left empty or
+// omitted, in which case the configured default applies. Optional
+// terms of the agreement may be supplied as JSON encoded lock options
+// following the lock time, including the owner on whose behalf an
+// authorized locker locks tokens. If the lock was successful, the handler
+// raises the 'Locked' event and returns the ID of the new agreement.
+func (ccs *CrossChainSwapChaincode) LockHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "counterparty", "image", "amount", "tokenContract"); err != nil {
+		return shim.Error(err.Error())
+	}
 	counterparty := caller.args[0]
 	image := caller.args[1]
-	amount := stringToUint64(caller.args[2])
+	amount, err := stringToUint64(caller.args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 	tokenContract := caller.args[3]
-	lockTime := stringToInt64(caller.args[4])
+	lockTime, err := ccs.readLockTime(caller, 4)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	var options htlc.LockOptions
+	if len(caller.args) > 5 {
+		if err := json.Unmarshal([]byte(caller.args[5]), &options); err != nil {
+			return shim.Error(fmt.Sprintf("Error reading lock options: %s", err))
+		}
+	}
 
 	// Lock tokens by creating new swap agreement with counterparty
-	agreementID, err := ccs.swap.Lock(counterparty, image, amount, tokenContract, lockTime)
+	agreementID, err := ccs.swap.Lock(counterparty, image, amount, tokenContract, lockTime, options)
 	if err != nil {
-		return shim.Error(fmt.Sprintf("Error creating agreement for counterparty %s", counterparty))
+		return shim.Error(fmt.Sprintf("Error creating agreement for counterparty %s: %s", counterparty, err))
+	}
+	if err := incrementMetric(caller, metricLocks); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := addMetric(caller, metricLockTime, uint64(lockTime)); err != nil {
+		return shim.Error(err.Error())
+	}
+	owner := options.Owner
+	if owner == "" {
+		owner = getInvokerAddress(caller)
+	}
+	expiry, err := getExpiryTime(caller, lockTime)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
-	owner := getInvokerAddress()
-	expiry := getExpiryTime(lockTime)
 	_ = caller.stub.SetEvent("Locked", newLockedEvent(agreementID, owner, counterparty, image, amount, expiry))
 	return shim.Success([]byte(agreementID))
 }
 
+// SimulateLockHandler checks whether a lock with the given arguments
+// is expected to succeed, without creating an agreement or
+// transferring tokens. The arguments are the same as those of
+// LockHandler. The outcome is returned to the client as JSON, e.g.
+// {"ok": false, "reason": "..."}.
+func (ccs *CrossChainSwapChaincode) SimulateLockHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "counterparty", "image", "amount", "tokenContract"); err != nil {
+		return shim.Error(err.Error())
+	}
+	counterparty := caller.args[0]
+	image := caller.args[1]
+	amount, err := stringToUint64(caller.args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	tokenContract := caller.args[3]
+	lockTime, err := ccs.readLockTime(caller, 4)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	var options htlc.LockOptions
+	if len(caller.args) > 5 {
+		if err := json.Unmarshal([]byte(caller.args[5]), &options); err != nil {
+			return shim.Error(fmt.Sprintf("Error reading lock options: %s", err))
+		}
+	}
+
+	simulation := Simulation{OK: true}
+	if err := ccs.swap.SimulateLock(counterparty, image, amount, tokenContract, lockTime, options); err != nil {
+		simulation = Simulation{OK: false, Reason: err.Error()}
+	}
+	b, err := json.Marshal(simulation)
+	if err != nil {
+		return shim.Error("Error marshalling simulation")
+	}
+	return shim.Success(b)
+}
+
 // UnlockHandler releases tokens locked by the invoker (owner) under a
 // given agreement id if the lock time has elapsed. If the unlock was
 // successful the handler raises the 'Unlocked' event and returns an
 // empty payload.
-func (ccs *CrossChainSwapChaincode) UnlockHandler() pb.Response {
-	// TODO: Validate args
+func (ccs *CrossChainSwapChaincode) UnlockHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "agreementID"); err != nil {
+		return shim.Error(err.Error())
+	}
 	agreementID := caller.args[0]
 
 	// Unlock owner's tokens if lock time has elapsed
 	if err := ccs.swap.Unlock(agreementID); err != nil {
 		return shim.Error(fmt.Sprintf("Failed to unlock tokens for agreement %s: %s", agreementID, err))
 	}
+	if err := incrementMetric(caller, metricUnlocks); err != nil {
+		return shim.Error(err.Error())
+	}
 	_ = caller.stub.SetEvent("Unlocked", newUnlockedEvent(agreementID))
 	return shim.Success(nil)
 }
 
+// CanUnlockHandler checks whether the invoker can unlock the tokens of
+// a given agreement now, i.e. the invoker is the owner and the
+// agreement is active and has expired. The outcome is returned to the
+// client as JSON, e.g. {"ok": false, "reason": "..."}.
+func (ccs *CrossChainSwapChaincode) CanUnlockHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "agreementID"); err != nil {
+		return shim.Error(err.Error())
+	}
+	agreementID := caller.args[0]
+
+	simulation := Simulation{OK: true}
+	if err := ccs.swap.CanUnlock(agreementID); err != nil {
+		simulation = Simulation{OK: false, Reason: err.Error()}
+	}
+	b, err := json.Marshal(simulation)
+	if err != nil {
+		return shim.Error("Error marshalling simulation")
+	}
+	return shim.Success(b)
+}
+
+// StatusHandler fetches whether a given agreement may be claimed or
+// unlocked now, along with the reason, in a single call. The status
+// is returned to the client as JSON, e.g. {"status": "active",
+// "claimable": true, "unlockable": false, "secondsToExpiry": 3600,
+// "reasonCode": "notExpired", "reasonText": "..."}.
+func (ccs *CrossChainSwapChaincode) StatusHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "agreementID"); err != nil {
+		return shim.Error(err.Error())
+	}
+	agreementID := caller.args[0]
+
+	status, err := ccs.swap.Status(agreementID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	b, err := json.Marshal(status)
+	if err != nil {
+		return shim.Error("Error marshalling status")
+	}
+	return shim.Success(b)
+}
+
 // ClaimHandler allows the counterparty to claim tokens locked by the
-// creator of an agreement given the provided secret is correct. If
-// the claim was successful the handler raises the 'Claimed' event and
-// returns an empty payload.
-func (ccs *CrossChainSwapChaincode) ClaimHandler() pb.Response {
-	// TODO: Validate args
+// creator of an agreement given the provided secret is correct. The
+// secrets of agreements with several images follow the agreement id
+// as separate arguments. If the claim was successful the handler
+// raises the 'Claimed' event and returns an empty payload.
+func (ccs *CrossChainSwapChaincode) ClaimHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "agreementID", "secret"); err != nil {
+		return shim.Error(err.Error())
+	}
 	agreementID := caller.args[0]
-	secret := caller.args[1]
+	secrets := caller.args[1:]
 
-	// Claim locked tokens using secret
-	if err := ccs.swap.Claim(agreementID, secret); err != nil {
+	// Claim locked tokens using secrets
+	amount, _, err := ccs.swap.ClaimPartial(agreementID, 0, secrets...)
+	if err != nil {
 		return shim.Error(fmt.Sprintf("Failed to claim tokens form agreement %s: %s", agreementID, err))
 	}
-	_ = caller.stub.SetEvent("Claimed", newClaimedEvent(agreementID))
+	if err := incrementMetric(caller, metricClaims); err != nil {
+		return shim.Error(err.Error())
+	}
+	_ = caller.stub.SetEvent("Claimed", newClaimedEvent(agreementID, secrets, amount, 0))
+	return shim.Success(nil)
+}
+
+// ClaimPartialHandler allows the counterparty to claim part of the
+// tokens locked in an agreement, given the provided secret is
+// correct. The secrets follow the agreement id and amount as for
+// ClaimHandler. The agreement remains active until all tokens have
+// been claimed. If the claim was successful the handler raises the
+// 'Claimed' event and returns the amount remaining in the agreement.
+func (ccs *CrossChainSwapChaincode) ClaimPartialHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "agreementID", "amount", "secret"); err != nil {
+		return shim.Error(err.Error())
+	}
+	agreementID := caller.args[0]
+	amount, err := stringToUint64(caller.args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if amount == 0 {
+		return shim.Error("Attempting to claim zero amount")
+	}
+	secrets := caller.args[2:]
+
+	claimed, remaining, err := ccs.swap.ClaimPartial(agreementID, amount, secrets...)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Failed to claim tokens form agreement %s: %s", agreementID, err))
+	}
+	// Agreements are counted as claimed once settled
+	if remaining == 0 {
+		if err := incrementMetric(caller, metricClaims); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	_ = caller.stub.SetEvent("Claimed", newClaimedEvent(agreementID, secrets, claimed, remaining))
+	return shim.Success([]byte(strconv.FormatUint(remaining, 10)))
+}
+
+// CancelEarlyHandler cancels an agreement created by the invoker
+// (owner) by mistake, returning the locked tokens, provided the
+// cancellation window following its creation has not elapsed. If the
+// cancellation was successful the handler raises the 'CancelledEarly'
+// event and returns an empty payload.
+func (ccs *CrossChainSwapChaincode) CancelEarlyHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "agreementID"); err != nil {
+		return shim.Error(err.Error())
+	}
+	agreementID := caller.args[0]
+
+	if err := ccs.swap.CancelEarly(agreementID); err != nil {
+		return shim.Error(fmt.Sprintf("Failed to cancel agreement %s: %s", agreementID, err))
+	}
+	if err := incrementMetric(caller, metricCancellations); err != nil {
+		return shim.Error(err.Error())
+	}
+	_ = caller.stub.SetEvent("CancelledEarly", newCancelledEarlyEvent(agreementID))
+	return shim.Success(nil)
+}
+
+// AbortHandler records the consent of the invoker (counterparty) to
+// the owner cancelling an agreement before its expiry. If the consent
+// was recorded the handler raises the 'AbortRequested' event and
+// returns an empty payload.
+func (ccs *CrossChainSwapChaincode) AbortHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "agreementID"); err != nil {
+		return shim.Error(err.Error())
+	}
+	agreementID := caller.args[0]
+
+	if err := ccs.swap.Abort(agreementID); err != nil {
+		return shim.Error(fmt.Sprintf("Failed to abort agreement %s: %s", agreementID, err))
+	}
+	_ = caller.stub.SetEvent("AbortRequested", newAbortRequestedEvent(agreementID))
+	return shim.Success(nil)
+}
+
+// CancelHandler cancels an agreement created by the invoker (owner)
+// before its expiry, returning the locked tokens, provided the
+// counterparty has agreed to abort it. If the cancellation was
+// successful the handler raises the 'Cancelled' event and returns an
+// empty payload.
+func (ccs *CrossChainSwapChaincode) CancelHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "agreementID"); err != nil {
+		return shim.Error(err.Error())
+	}
+	agreementID := caller.args[0]
+
+	if err := ccs.swap.Cancel(agreementID); err != nil {
+		return shim.Error(fmt.Sprintf("Failed to cancel agreement %s: %s", agreementID, err))
+	}
+	if err := incrementMetric(caller, metricCancellations); err != nil {
+		return shim.Error(err.Error())
+	}
+	_ = caller.stub.SetEvent("Cancelled", newCancelledEvent(agreementID))
+	return shim.Success(nil)
+}
+
+// LockedBetweenHandler fetches the total amount of tokens locked in
+// active agreements between an owner and a counterparty for a given
+// token contract. The amount is returned to the client in string form.
+func (ccs *CrossChainSwapChaincode) LockedBetweenHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "owner", "counterparty", "tokenContract"); err != nil {
+		return shim.Error(err.Error())
+	}
+	owner := caller.args[0]
+	counterparty := caller.args[1]
+	tokenContract := caller.args[2]
+
+	total, err := ccs.swap.LockedBetween(owner, counterparty, tokenContract)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(strconv.FormatUint(total, 10)))
+}
+
+// GetAgreementHandler fetches the agreement with a given ID. The
+// agreement is returned to the client as JSON.
+func (ccs *CrossChainSwapChaincode) GetAgreementHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "agreementID"); err != nil {
+		return shim.Error(err.Error())
+	}
+	agreementID := caller.args[0]
+
+	agreement, err := ccs.swap.GetAgreement(agreementID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	b, err := json.Marshal(agreement)
+	if err != nil {
+		return shim.Error("Error marshalling agreement")
+	}
+	return shim.Success(b)
+}
+
+// AgeHandler fetches the time in seconds elapsed since an agreement
+// was created. The age is returned to the client in string form.
+func (ccs *CrossChainSwapChaincode) AgeHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "agreementID"); err != nil {
+		return shim.Error(err.Error())
+	}
+	agreementID := caller.args[0]
+
+	age, err := ccs.swap.Age(agreementID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(strconv.FormatInt(age, 10)))
+}
+
+// GetAgreementsByOwnerHandler fetches the active agreements of a
+// given owner, or of the invoker if no owner is given. The agreements
+// may be narrowed down to those with a given counterparty. The
+// agreements are returned to the client as a JSON encoded list.
+func (ccs *CrossChainSwapChaincode) GetAgreementsByOwnerHandler(caller *CallerProps) pb.Response {
+	owner := getInvokerAddress(caller)
+	if len(caller.args) > 0 && caller.args[0] != "" {
+		owner = caller.args[0]
+	}
+	var counterparty string
+	if len(caller.args) > 1 {
+		counterparty = caller.args[1]
+	}
+
+	entries, err := ccs.swap.GetAgreementsByOwner(owner, counterparty)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return shim.Error("Error marshalling agreements")
+	}
+	return shim.Success(b)
+}
+
+// AgreementsExpiringWithinHandler fetches the active agreements
+// expiring within a given number of seconds from the time of the
+// current transaction. The agreements are returned to the client as a
+// JSON encoded list, soonest expiry first.
+func (ccs *CrossChainSwapChaincode) AgreementsExpiringWithinHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "seconds"); err != nil {
+		return shim.Error(err.Error())
+	}
+	seconds, err := stringToInt64(caller.args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if seconds < 0 {
+		return shim.Error("Time window must not be negative")
+	}
+
+	entries, err := ccs.swap.AgreementsExpiringWithin(seconds)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return shim.Error("Error marshalling agreements")
+	}
+	return shim.Success(b)
+}
+
+// RevealedSecretsHandler fetches a page of the secrets revealed by
+// claims made at or after a given time (in seconds since the epoch),
+// in order of the time of the claim. The arguments include an optional
+// bookmark returned with the previous page. The page is returned to
+// the client as JSON.
+func (ccs *CrossChainSwapChaincode) RevealedSecretsHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "from"); err != nil {
+		return shim.Error(err.Error())
+	}
+	from, err := stringToInt64(caller.args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	bookmark := ""
+	if len(caller.args) > 1 {
+		bookmark = caller.args[1]
+	}
+
+	secrets, bookmark, err := ccs.swap.RevealedSecrets(from, bookmark)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	b, err := json.Marshal(RevealedSecretsPage{Secrets: secrets, Bookmark: bookmark})
+	if err != nil {
+		return shim.Error("Error marshalling secrets")
+	}
+	return shim.Success(b)
+}
+
+// AgreementByMirrorHandler fetches the agreement referencing a given
+// mirror agreement, identified by its channel and ID. The agreement is
+// returned to the client as JSON, along with its ID.
+func (ccs *CrossChainSwapChaincode) AgreementByMirrorHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "mirrorChannel", "mirrorAgreementID"); err != nil {
+		return shim.Error(err.Error())
+	}
+	mirrorChannel := caller.args[0]
+	mirrorAgreementID := caller.args[1]
+
+	entry, err := ccs.swap.AgreementByMirror(mirrorChannel, mirrorAgreementID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return shim.Error("Error marshalling agreement")
+	}
+	return shim.Success(b)
+}
+
+// AgreementsCreatedBetweenHandler fetches the IDs of agreements
+// created between two times (inclusive), given in seconds since the
+// epoch. The IDs are returned to the client as a JSON array.
+func (ccs *CrossChainSwapChaincode) AgreementsCreatedBetweenHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "start", "end"); err != nil {
+		return shim.Error(err.Error())
+	}
+	start, err := stringToInt64(caller.args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	end, err := stringToInt64(caller.args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	agreementIDs, err := ccs.swap.AgreementsCreatedBetween(start, end)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	b, err := json.Marshal(agreementIDs)
+	if err != nil {
+		return shim.Error("Error marshalling agreement IDs")
+	}
+	return shim.Success(b)
+}
+
+// TimelineHandler fetches the lifecycle events of a given agreement,
+// in the order they occurred, along with the invokers causing them and
+// the times of the transactions. The timeline is returned to the
+// client as JSON.
+func (ccs *CrossChainSwapChaincode) TimelineHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "agreementID"); err != nil {
+		return shim.Error(err.Error())
+	}
+	agreementID := caller.args[0]
+
+	events, err := ccs.swap.Timeline(agreementID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	b, err := json.Marshal(events)
+	if err != nil {
+		return shim.Error("Error marshalling timeline")
+	}
+	return shim.Success(b)
+}
+
+// SecretUsedHandler fetches whether the secret of a given image has
+// been revealed to claim any agreement. The result is returned to the
+// client as "true" or "false".
+func (ccs *CrossChainSwapChaincode) SecretUsedHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "image"); err != nil {
+		return shim.Error(err.Error())
+	}
+	image := caller.args[0]
+
+	used, err := ccs.swap.SecretUsed(image)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(strconv.FormatBool(used)))
+}
+
+// HealthCheckHandler verifies the invariants of the swap state, such
+// as the custody balance covering the amounts locked in active
+// agreements. The report, listing any violations found, is returned
+// to the client as JSON.
+func (ccs *CrossChainSwapChaincode) HealthCheckHandler(caller *CallerProps) pb.Response {
+	report, err := ccs.swap.HealthCheck()
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Error checking health: %s", err))
+	}
+	b, err := json.Marshal(report)
+	if err != nil {
+		return shim.Error("Error marshalling health report")
+	}
+	return shim.Success(b)
+}
+
+// SetHashAlgorithmHandler changes the hash algorithm applied to new
+// agreements that do not specify one. Only the administrator may
+// change the algorithm. Existing agreements are unaffected.
+func (ccs *CrossChainSwapChaincode) SetHashAlgorithmHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "algorithm"); err != nil {
+		return shim.Error(err.Error())
+	}
+	algorithm := caller.args[0]
+
+	if err := ccs.swap.SetHashAlgorithm(algorithm); err != nil {
+		return shim.Error(fmt.Sprintf("Failed to set hash algorithm: %s", err))
+	}
 	return shim.Success(nil)
 }
 
+// DenyImageHandler adds an image to the denylist, rejecting new
+// agreements using it. Only the administrator may maintain the
+// denylist.
+func (ccs *CrossChainSwapChaincode) DenyImageHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "image"); err != nil {
+		return shim.Error(err.Error())
+	}
+	image := caller.args[0]
+
+	if err := ccs.swap.DenyImage(image); err != nil {
+		return shim.Error(fmt.Sprintf("Failed to deny image %s: %s", image, err))
+	}
+	return shim.Success(nil)
+}
+
+// AllowImageHandler removes an image from the denylist. Only the
+// administrator may maintain the denylist.
+func (ccs *CrossChainSwapChaincode) AllowImageHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "image"); err != nil {
+		return shim.Error(err.Error())
+	}
+	image := caller.args[0]
+
+	if err := ccs.swap.AllowImage(image); err != nil {
+		return shim.Error(fmt.Sprintf("Failed to allow image %s: %s", image, err))
+	}
+	return shim.Success(nil)
+}
+
+// ReindexAgreementHandler indexes each of the specified agreements,
+// locked before agreements were indexed, as active so that they may
+// be settled. Only the administrator may reindex agreements.
+func (ccs *CrossChainSwapChaincode) ReindexAgreementHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "agreementID"); err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, agreementID := range caller.args {
+		if err := ccs.swap.ReindexAgreement(agreementID); err != nil {
+			return shim.Error(fmt.Sprintf("Failed to reindex agreement %s: %s", agreementID, err))
+		}
+	}
+	return shim.Success(nil)
+}
+
+// PauseContractHandler rejects new agreements for the specified token
+// contract while allowing existing ones to be claimed or unlocked.
+// Only the administrator may pause a contract.
+func (ccs *CrossChainSwapChaincode) PauseContractHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "tokenContract"); err != nil {
+		return shim.Error(err.Error())
+	}
+	tokenContract := caller.args[0]
+
+	if err := ccs.swap.PauseContract(tokenContract); err != nil {
+		return shim.Error(fmt.Sprintf("Failed to pause token contract %s: %s", tokenContract, err))
+	}
+	return shim.Success(nil)
+}
+
+// ResumeContractHandler accepts new agreements for the specified token
+// contract again. Only the administrator may resume a contract.
+func (ccs *CrossChainSwapChaincode) ResumeContractHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "tokenContract"); err != nil {
+		return shim.Error(err.Error())
+	}
+	tokenContract := caller.args[0]
+
+	if err := ccs.swap.ResumeContract(tokenContract); err != nil {
+		return shim.Error(fmt.Sprintf("Failed to resume token contract %s: %s", tokenContract, err))
+	}
+	return shim.Success(nil)
+}
+
+// DeregisterContractHandler stops recognizing the specified token
+// contract, for new and existing agreements alike. Only the
+// administrator may deregister a contract.
+func (ccs *CrossChainSwapChaincode) DeregisterContractHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "tokenContract"); err != nil {
+		return shim.Error(err.Error())
+	}
+	tokenContract := caller.args[0]
+
+	if err := ccs.swap.DeregisterContract(tokenContract); err != nil {
+		return shim.Error(fmt.Sprintf("Failed to deregister token contract %s: %s", tokenContract, err))
+	}
+	return shim.Success(nil)
+}
+
+// RegisterContractHandler recognizes a deregistered token contract
+// again. Only the administrator may register a contract.
+func (ccs *CrossChainSwapChaincode) RegisterContractHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "tokenContract"); err != nil {
+		return shim.Error(err.Error())
+	}
+	tokenContract := caller.args[0]
+
+	if err := ccs.swap.RegisterContract(tokenContract); err != nil {
+		return shim.Error(fmt.Sprintf("Failed to register token contract %s: %s", tokenContract, err))
+	}
+	return shim.Success(nil)
+}
+
+// AuthorizeLockerHandler permits the specified locker to lock tokens
+// on behalf of the invoker (owner).
+func (ccs *CrossChainSwapChaincode) AuthorizeLockerHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "locker"); err != nil {
+		return shim.Error(err.Error())
+	}
+	locker := caller.args[0]
+
+	if err := ccs.swap.AuthorizeLocker(locker); err != nil {
+		return shim.Error(fmt.Sprintf("Failed to authorize locker %s: %s", locker, err))
+	}
+	return shim.Success(nil)
+}
+
+// RevokeLockerHandler withdraws the permission of the specified locker
+// to lock tokens on behalf of the invoker (owner).
+func (ccs *CrossChainSwapChaincode) RevokeLockerHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "locker"); err != nil {
+		return shim.Error(err.Error())
+	}
+	locker := caller.args[0]
+
+	if err := ccs.swap.RevokeLocker(locker); err != nil {
+		return shim.Error(fmt.Sprintf("Failed to revoke locker %s: %s", locker, err))
+	}
+	return shim.Success(nil)
+}
+
+// ConfigHandler fetches the operational parameters of the chaincode,
+// including its configuration, in a single call. The parameters are
+// returned to the client as JSON.
+func (ccs *CrossChainSwapChaincode) ConfigHandler(caller *CallerProps) pb.Response {
+	parameters := Parameters{
+		Config:          *ccs.swap.config,
+		HashAlgorithms:  []string{htlc.HashSHA256, htlc.HashSHA512, htlc.HashSHA256d, htlc.HashRIPEMD160},
+		SecretEncodings: []string{htlc.EncodingUTF8, htlc.EncodingHex},
+		MaxHashRounds:   maxHashRounds,
+		MinLockTime:     minLockTime,
+		MaxLockTime:     maxLockTime,
+		MaxHintLength:   maxHintLength,
+		MaxImages:       maxImages,
+		Combinators:     []string{htlc.CombinatorAnd, htlc.CombinatorOr},
+		EscrowModes:     []string{htlc.EscrowCustody, htlc.EscrowHold}}
+	b, err := json.Marshal(parameters)
+	if err != nil {
+		return shim.Error("Error marshalling configuration")
+	}
+	return shim.Success(b)
+}
+
+// DebugImageHandler traces the computation of the image of a secret
+// given its encoding, hash algorithm and rounds, any of which may be
+// empty to apply the defaults. The intermediate bytes are returned to
+// the client as JSON. Only available if diagnostics are enabled in the
+// configuration.
+func (ccs *CrossChainSwapChaincode) DebugImageHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "secret", "encoding", "hashAlgorithm", "rounds"); err != nil {
+		return shim.Error(err.Error())
+	}
+	var rounds uint64
+	if caller.args[3] != "" {
+		var err error
+		if rounds, err = stringToUint64(caller.args[3]); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	if rounds > maxHashRounds {
+		return shim.Error(fmt.Sprintf("Hash rounds must be between 1 and %d", maxHashRounds))
+	}
+
+	diagnostics, err := ccs.swap.DebugImage(caller.args[0], caller.args[1], caller.args[2], int(rounds))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Failed to compute image: %s", err))
+	}
+	b, err := json.Marshal(diagnostics)
+	if err != nil {
+		return shim.Error("Error marshalling image diagnostics")
+	}
+	return shim.Success(b)
+}
+
+// MetricsHandler fetches the counters maintained by the handlers as a
+// JSON object, e.g. {"locks": 10, "claims": 8, ...}. Each
+// counter is recorded under a key per increment rather than a single
+// key per counter, so that concurrent operations do not conflict with
+// one another when validated, until merged by CompactMetricsHandler.
+// Failed operations are not counted, since state written by a failed
+// transaction is never committed; see FailuresHandler.
+func (ccs *CrossChainSwapChaincode) MetricsHandler(caller *CallerProps) pb.Response {
+	counters := make(map[string]uint64)
+	for _, name := range metrics {
+		count, err := getMetric(caller, name)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		counters[name] = count
+	}
+	b, err := json.Marshal(counters)
+	if err != nil {
+		return shim.Error("Error marshalling metrics")
+	}
+	return shim.Success(b)
+}
+
+// FailuresHandler fetches the number of invocations that failed on
+// the peer answering the query since the chaincode started, in decimal
+// string form. The count is kept in memory rather than on the ledger,
+// so it differs from peer to peer and is reset by restarts. It is a
+// diagnostic for querying individual peers, and must not be invoked
+// by transactions requiring endorsement by several peers.
+func (ccs *CrossChainSwapChaincode) FailuresHandler(caller *CallerProps) pb.Response {
+	return shim.Success([]byte(strconv.FormatUint(ccs.failures, 10)))
+}
+
+// CompactMetricsHandler merges the increments recorded for each
+// counter, up to maxCompactedIncrements per counter, into a single
+// increment holding their sum, bounding the keys read when fetching
+// the counters. Increments committed while compacting invalidate the
+// compaction, as its range reads are validated at commit, rather than
+// being lost. The handler returns the number of increments merged,
+// which is 0 once the counters are compact. Only the administrator
+// may compact the counters.
+func (ccs *CrossChainSwapChaincode) CompactMetricsHandler(caller *CallerProps) pb.Response {
+	if err := ccs.swap.checkAdmin(); err != nil {
+		return shim.Error(err.Error())
+	}
+	var merged int
+	for _, name := range append([]string{metricLockTime}, metrics...) {
+		n, err := compactMetric(caller, name)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		merged += n
+	}
+	return shim.Success([]byte(strconv.Itoa(merged)))
+}
+
+// AnalyticsHandler fetches aggregate statistics over all agreements,
+// computed from the counters maintained by the handlers rather than by
+// reading agreements. The statistics are returned to the client as
+// JSON. Only the administrator may fetch the statistics.
+func (ccs *CrossChainSwapChaincode) AnalyticsHandler(caller *CallerProps) pb.Response {
+	if err := ccs.swap.checkAdmin(); err != nil {
+		return shim.Error(err.Error())
+	}
+	counters := make(map[string]uint64)
+	for _, name := range []string{metricLocks, metricLockTime, metricClaims, metricUnlocks} {
+		count, err := getMetric(caller, name)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		counters[name] = count
+	}
+	analytics := Analytics{
+		Agreements: counters[metricLocks],
+		Claims:     counters[metricClaims],
+		Unlocks:    counters[metricUnlocks],
+	}
+	if analytics.Agreements > 0 {
+		analytics.AverageLockTime = float64(counters[metricLockTime]) / float64(analytics.Agreements)
+	}
+	if settled := analytics.Claims + analytics.Unlocks; settled > 0 {
+		analytics.ClaimRatio = float64(analytics.Claims) / float64(settled)
+	}
+	b, err := json.Marshal(analytics)
+	if err != nil {
+		return shim.Error("Error marshalling analytics")
+	}
+	return shim.Success(b)
+}
+
 // newLockedEvent returns a byte array representing a chaincode
 // event when tokens have been unlocked under an agreement.
 func newLockedEvent(agreementID string, owner string, counterparty string,
 	image string, amount uint64, expiry int64) []byte {
-	t := htlc.Locked{AgreementID: agreementID, Owner: owner, CounterParty: counterparty,
-		Image: image, Amount: amount, Expiry: expiry}
+	t := htlc.Locked{SchemaVersion: htlc.EventSchemaVersion, AgreementID: agreementID, Owner: owner,
+		CounterParty: counterparty, Image: image, Amount: amount, Expiry: expiry}
 	b, _ := json.Marshal(t)
 	return b
 }
@@ -128,22 +1015,132 @@ func newLockedEvent(agreementID string, owner string, counterparty string,
 // newUnlockedEvent returns a byte array representing a chaincode
 // event when tokens from an agreement have been unlocked.
 func newUnlockedEvent(agreementID string) []byte {
-	t := htlc.Unlocked{AgreementID: agreementID}
+	t := htlc.Unlocked{SchemaVersion: htlc.EventSchemaVersion, AgreementID: agreementID}
 	b, _ := json.Marshal(t)
 	return b
 }
 
 // newClaimedEvent returns a byte array representing a chaincode
 // event when tokens from an agreement have been claimed.
-func newClaimedEvent(agreementID string) []byte {
-	t := htlc.Claimed{AgreementID: agreementID}
+func newClaimedEvent(agreementID string, secrets []string, amount uint64, remaining uint64) []byte {
+	t := htlc.Claimed{SchemaVersion: htlc.EventSchemaVersion, AgreementID: agreementID, Secret: secrets[0],
+		Amount: amount, Remaining: remaining}
+	if len(secrets) > 1 {
+		t.Secrets = secrets
+	}
+	b, _ := json.Marshal(t)
+	return b
+}
+
+// newCancelledEarlyEvent returns a byte array representing a
+// chaincode event when an agreement has been cancelled early.
+func newCancelledEarlyEvent(agreementID string) []byte {
+	t := htlc.CancelledEarly{SchemaVersion: htlc.EventSchemaVersion, AgreementID: agreementID}
+	b, _ := json.Marshal(t)
+	return b
+}
+
+// newAbortRequestedEvent returns a byte array representing a chaincode
+// event when the counterparty has agreed to abort an agreement.
+func newAbortRequestedEvent(agreementID string) []byte {
+	t := htlc.AbortRequested{SchemaVersion: htlc.EventSchemaVersion, AgreementID: agreementID}
+	b, _ := json.Marshal(t)
+	return b
+}
+
+// newCancelledEvent returns a byte array representing a chaincode
+// event when an agreement has been cancelled.
+func newCancelledEvent(agreementID string) []byte {
+	t := htlc.Cancelled{SchemaVersion: htlc.EventSchemaVersion, AgreementID: agreementID}
 	b, _ := json.Marshal(t)
 	return b
 }
 
+// getMetric returns the named counter maintained by the handlers,
+// summing the increments recorded for it.
+func getMetric(caller *CallerProps, name string) (uint64, error) {
+	iter, err := caller.stub.GetStateByPartialCompositeKey(metricIndex, []string{name})
+	if err != nil {
+		return 0, fmt.Errorf("Error reading metric %s from ledger", name)
+	}
+	defer iter.Close()
+	var count uint64
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return 0, fmt.Errorf("Error reading metric %s from ledger", name)
+		}
+		value, err := stringToUint64(string(kv.Value))
+		if err != nil {
+			return 0, fmt.Errorf("Malformed value for metric %s", name)
+		}
+		count += value
+	}
+	return count, nil
+}
+
+// incrementMetric increments the named counter maintained by the
+// handlers. Each increment is written under a key of its own, keyed by
+// transaction ID, and is never read back within a transaction, so
+// concurrent increments of a counter do not conflict.
+func incrementMetric(caller *CallerProps, name string) error {
+	return addMetric(caller, name, 1)
+}
+
+// addMetric adds 'n' to the named counter maintained by the handlers,
+// e.g. the lock time of an agreement, under a single key. Values are
+// encoded as decimal strings.
+func addMetric(caller *CallerProps, name string, n uint64) error {
+	key, err := caller.stub.CreateCompositeKey(metricIndex, []string{name, caller.stub.GetTxID()})
+	if err != nil {
+		return fmt.Errorf("Error creating key for metric %s", name)
+	}
+	if err := caller.stub.PutState(key, []byte(strconv.FormatUint(n, 10))); err != nil {
+		return fmt.Errorf("Error writing metric %s to ledger", name)
+	}
+	return nil
+}
+
+// compactMetric replaces up to maxCompactedIncrements of the
+// increments recorded for the named counter by one holding their sum,
+// returning the number of increments replaced.
+func compactMetric(caller *CallerProps, name string) (int, error) {
+	iter, err := caller.stub.GetStateByPartialCompositeKey(metricIndex, []string{name})
+	if err != nil {
+		return 0, fmt.Errorf("Error reading metric %s from ledger", name)
+	}
+	defer iter.Close()
+	var keys []string
+	var sum uint64
+	for iter.HasNext() && len(keys) < maxCompactedIncrements {
+		kv, err := iter.Next()
+		if err != nil {
+			return 0, fmt.Errorf("Error reading metric %s from ledger", name)
+		}
+		value, err := stringToUint64(string(kv.Value))
+		if err != nil {
+			return 0, fmt.Errorf("Malformed value for metric %s", name)
+		}
+		keys = append(keys, kv.Key)
+		sum += value
+	}
+	if len(keys) < 2 {
+		return 0, nil
+	}
+	for _, key := range keys {
+		if err := caller.stub.DelState(key); err != nil {
+			return 0, fmt.Errorf("Error deleting metric %s from ledger", name)
+		}
+	}
+	if err := addMetric(caller, name, sum); err != nil {
+		return 0, err
+	}
+	return len(keys), nil
+}
+
 // getInvokerAddress returns a hex-based address representing the
 // invoker's public key.
-func getInvokerAddress() string {
+func getInvokerAddress(caller *CallerProps) string {
 	cert := security.NewX509Certificate(caller.cert)
 	return cert.GetAddress()
 }
@@ -151,14 +1148,14 @@ func getInvokerAddress() string {
 // getChaincodeAddress returns an address that represents the current
 // chaincode. The format of this address is currently based on the
 // chaincode ID.
-func getChaincodeAddress() string {
-	chaincodeID, _ := getChaincodeID()
+func getChaincodeAddress(caller *CallerProps) string {
+	chaincodeID, _ := getChaincodeID(caller)
 	return "cc:" + chaincodeID
 }
 
 // getChaincodeID returns the name (hash) of the chaincode specified
 // in the signed proposal request.
-func getChaincodeID() (string, error) {
+func getChaincodeID(caller *CallerProps) (string, error) {
 	var signedProposal *pb.SignedProposal
 	var err error
 	if signedProposal, err = caller.stub.GetSignedProposal(); err != nil {
@@ -181,27 +1178,81 @@ func getChaincodeID() (string, error) {
 // agreement can be unlocked by the initiator. The expiry time is
 // calculated using the client's transaction timestamp. This is
 // deterministic and safe (as a counterparty can always inspect the
-// expiry before proceeding with a swap).
-func getExpiryTime(lockTime int64) int64 {
+// expiry before proceeding with a swap). An error is returned if the
+// expiry time overflows.
+func getExpiryTime(caller *CallerProps, lockTime int64) (int64, error) {
+	t := getTxTime(caller)
+	if (lockTime > 0 && t > math.MaxInt64-lockTime) || (lockTime < 0 && t < math.MinInt64-lockTime) {
+		return 0, fmt.Errorf("Lock time of %d seconds overflows the expiry time", lockTime)
+	}
+	return t + lockTime, nil
+}
+
+// getTxTime returns the (wall clock) time of the current transaction
+// in seconds, as specified by the client.
+func getTxTime(caller *CallerProps) int64 {
 	t, _ := caller.stub.GetTxTimestamp()
-	return t.GetSeconds() + lockTime
+	return t.GetSeconds()
+}
+
+// requireArgs returns an error if fewer arguments were supplied than
+// the named arguments a handler requires, naming those expected.
+func requireArgs(caller *CallerProps, names ...string) error {
+	if len(caller.args) < len(names) {
+		return fmt.Errorf("Expected %d arguments (%s), got %d", len(names), strings.Join(names, ", "), len(caller.args))
+	}
+	return nil
+}
+
+// stringToUint64 converts a string to an unsigned integer, reporting
+// values that are not numeric or do not fit in 64 bits.
+func stringToUint64(s string) (uint64, error) {
+	i, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Malformed number '%s'", s)
+	}
+	return i, nil
 }
 
-// uint64ToBytes converts a string to an unsigned integer.
-func stringToUint64(s string) uint64 {
-	i, _ := strconv.ParseUint(s, 10, 64)
-	return i
+// readLockTime returns the lock time supplied as the argument at the
+// given index, or the configured default if the argument is omitted or
+// empty.
+func (ccs *CrossChainSwapChaincode) readLockTime(caller *CallerProps, index int) (int64, error) {
+	if len(caller.args) <= index || caller.args[index] == "" {
+		return ccs.swap.config.DefaultLockTime, nil
+	}
+	lockTime, err := strconv.ParseInt(caller.args[index], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Malformed lock time '%s'", caller.args[index])
+	}
+	return lockTime, nil
 }
 
-// int64ToBytes converts a string to an integer.
-func stringToInt64(s string) int64 {
-	i, _ := strconv.ParseInt(s, 10, 64)
-	return i
+// stringToInt64 converts a string to an integer, reporting values that
+// are not numeric or do not fit in 64 bits.
+func stringToInt64(s string) (int64, error) {
+	i, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Malformed number '%s'", s)
+	}
+	return i, nil
+}
+
+// startChaincode starts a chaincode, replaced when testing.
+var startChaincode = shim.Start
+
+// run starts the CrossChainSwapChaincode, returning an error if it
+// could not be started or stopped unexpectedly.
+func run() error {
+	if err := startChaincode(new(CrossChainSwapChaincode)); err != nil {
+		return fmt.Errorf("Error starting CrossChainSwap: %s", err)
+	}
+	return nil
 }
 
 func main() {
-	ccs := new(CrossChainSwapChaincode)
-	if err := shim.Start(ccs); err != nil {
-		fmt.Printf("Error starting CrossChainSwap: %s", err)
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,2393 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"testing"
+
+	tokens "github.com/dileban/atomic-swaps/fabric/lib/asset/fungible"
+	"github.com/dileban/atomic-swaps/fabric/lib/asset/htlc"
+	"github.com/dileban/atomic-swaps/fabric/lib/security"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/msp"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/stretchr/testify/assert"
+)
+
+const ccName = "swapChaincode"
+
+const tokenName = "tokenChaincode"
+
+// The identities of the two parties to a swap. The owner is used for
+// mock invocations unless stated otherwise.
+var ownerIdentity, owner = newIdentity()
+var counterpartyIdentity, counterparty = newIdentity()
+
+// compatible lists the capabilities of a token contract the swap
+// chaincode is able to work with.
+var compatible = []string{tokens.CapTransfer, tokens.CapTransferFrom, tokens.CapChaincodeAddresses,
+	tokens.CapTransferFromBalance}
+
+// txID is incremented for every mock transaction, since transaction
+// IDs double as agreement IDs.
+var txID int
+
+func TestInit(t *testing.T) {
+	stub := newMockStub(&mockToken{capabilities: compatible})
+	config, err := readConfig(stub)
+	assert.NoError(t, err)
+	assert.Equal(t, Config{Admin: owner, DefaultLockTime: defaultLockTime, CancellationWindow: 60,
+		HashAlgorithm: "sha256"}, *config)
+
+	r := stub.MockInit("init", byteArray(`{"defaultLockTime": 7200}`))
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	config, err = readConfig(stub)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(7200), config.DefaultLockTime)
+
+	// The default lock time must lie within bounds
+	stub = shim.NewMockStub(ccName, new(CrossChainSwapChaincode))
+	stub.Creator = ownerIdentity
+	r = stub.MockInit("init", byteArray(`{"defaultLockTime": 59}`))
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "Default lock time must be between")
+	r = stub.MockInit("init", byteArray(fmt.Sprintf(`{"defaultLockTime": %d}`, maxLockTime+1)))
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Empty(t, stub.State)
+}
+
+func TestConfig(t *testing.T) {
+	stub := shim.NewMockStub(ccName, new(CrossChainSwapChaincode))
+	stub.Creator = ownerIdentity
+	r := stub.MockInit("init", byteArray(`{"defaultLockTime": 3600, "cancellationWindow": 30, "maxAgreementBps": 500}`))
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	r = invokeMock(stub, "Config")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	var parameters Parameters
+	assert.NoError(t, json.Unmarshal(r.Payload, &parameters))
+	assert.Equal(t, Parameters{
+		Config: Config{Admin: owner, DefaultLockTime: 3600, CancellationWindow: 30, MaxAgreementBps: 500,
+			HashAlgorithm: "sha256"},
+		HashAlgorithms:  []string{"sha256", "sha512", "sha256d", "ripemd160"},
+		SecretEncodings: []string{"utf8", "hex"},
+		MaxHashRounds:   16,
+		MinLockTime:     60,
+		MaxLockTime:     365 * 24 * 60 * 60,
+		MaxHintLength:   256,
+		MaxImages:       8,
+		Combinators:     []string{"and", "or"},
+		EscrowModes:     []string{"custody", "hold"}}, parameters)
+}
+
+func TestInvokeReservedNames(t *testing.T) {
+	stub := newMockStub(&mockToken{capabilities: compatible})
+	for _, f := range []string{"init", ""} {
+		r := invokeMock(stub, f)
+		assert.Equal(t, shim.ERROR, int(r.Status))
+		assert.Contains(t, r.Message, "is reserved")
+	}
+}
+
+func TestInvokeUnknownFunction(t *testing.T) {
+	stub := newMockStub(&mockToken{capabilities: compatible})
+	for _, f := range []string{"Bogus", "lock", "LockHandler"} {
+		r := invokeMock(stub, f)
+		assert.Equal(t, shim.ERROR, int(r.Status))
+		assert.Equal(t, "Unknown function: "+f, r.Message)
+	}
+}
+
+func TestLockDefaultLockTime(t *testing.T) {
+	stub := newMockStub(&mockToken{capabilities: compatible})
+	r := stub.MockInit("init", byteArray(`{"defaultLockTime": 7200}`))
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	// An explicit lock time takes precedence
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret1")), "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assertExpiry(t, stub, string(r.Payload), 3600)
+
+	// An omitted or empty lock time falls back to the default
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret2")), "100", tokenName)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assertExpiry(t, stub, string(r.Payload), 7200)
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret3")), "100", tokenName, "", `{"secretEncoding": "utf8"}`)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assertExpiry(t, stub, string(r.Payload), 7200)
+}
+
+func TestLockCapabilities(t *testing.T) {
+	token := &mockToken{capabilities: compatible}
+	stub := newMockStub(token)
+
+	r := invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreement, err := readAgreement(stub, string(r.Payload))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(100), agreement.Amount)
+	assert.Contains(t, token.calls, []string{"TransferFrom", owner, "cc:" + ccName, "100"})
+
+	// Token contracts unable to hold tokens in custody are rejected
+	token = &mockToken{capabilities: []string{tokens.CapTransfer, tokens.CapTransferFrom}}
+	stub = newMockStub(token)
+
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "does not support 'chaincodeAddresses'")
+	assert.Len(t, stub.State, 1)
+	assert.Contains(t, stub.State, configKey)
+	assert.Equal(t, [][]string{{"Version"}}, token.calls)
+}
+
+func TestLockedBetween(t *testing.T) {
+	stub := newMockStub(&mockToken{capabilities: compatible})
+	otherStub := shim.NewMockStub("otherToken", &mockToken{capabilities: compatible})
+	stub.MockPeerChaincode("otherToken", otherStub)
+	_, other := newIdentity()
+
+	r := invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret1")), "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID := string(r.Payload)
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret2")), "250", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret3")), "400", "otherToken", "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "Lock", other, imageOf([]byte("secret4")), "800", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	r = invokeMock(stub, "LockedBetween", owner, counterparty, tokenName)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, "350", string(r.Payload))
+	r = invokeMock(stub, "LockedBetween", owner, counterparty, "otherToken")
+	assert.Equal(t, "400", string(r.Payload))
+	r = invokeMock(stub, "LockedBetween", counterparty, owner, tokenName)
+	assert.Equal(t, "0", string(r.Payload))
+
+	// Claimed agreements are no longer active
+	stub.Creator = counterpartyIdentity
+	r = invokeMock(stub, "Claim", agreementID, "secret1")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "LockedBetween", owner, counterparty, tokenName)
+	assert.Equal(t, "250", string(r.Payload))
+}
+
+func TestClaimSecretEncoding(t *testing.T) {
+	stub := newMockStub(&mockToken{capabilities: compatible})
+	secret := []byte{0xde, 0xad, 0xbe, 0xef}
+
+	// Secrets held as raw bytes are claimed using their hex encoding
+	r := invokeMock(stub, "Lock", counterparty, imageOf(secret), "100", tokenName, "3600", `{"secretEncoding": "hex"}`)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID := string(r.Payload)
+	stub.Creator = counterpartyIdentity
+	r = invokeMock(stub, "Claim", agreementID, "deadbeee")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "does not match")
+	r = invokeMock(stub, "Claim", agreementID, "not hex")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "not hex encoded")
+	r = invokeMock(stub, "Claim", agreementID, "deadbeef")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	// Secrets are hashed as is by default
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("deadbeef")), "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID = string(r.Payload)
+	agreement, err := readAgreement(stub, agreementID)
+	assert.NoError(t, err)
+	assert.Equal(t, "utf8", agreement.SecretEncoding)
+	stub.Creator = counterpartyIdentity
+	r = invokeMock(stub, "Claim", agreementID, "DEADBEEF")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	r = invokeMock(stub, "Claim", agreementID, "deadbeef")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	// Unknown encodings are rejected
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "Lock", counterparty, imageOf(secret), "100", tokenName, "3600", `{"secretEncoding": "base64"}`)
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "Unsupported secret encoding")
+}
+
+func TestMatchesImage(t *testing.T) {
+	image := imageOf([]byte("secret"))
+	assert.True(t, matchesImage([]byte("secret"), "sha256", 1, image))
+	assert.False(t, matchesImage([]byte("secreT"), "sha256", 1, image))
+	assert.False(t, matchesImage([]byte("secret"), "sha256", 1, image[:32]))
+	assert.False(t, matchesImage([]byte("secret"), "sha256", 1, ""))
+
+	// Claims behave as before
+	stub := newMockStub(&mockToken{capabilities: compatible})
+	r := invokeMock(stub, "Lock", counterparty, image, "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID := string(r.Payload)
+	stub.Creator = counterpartyIdentity
+	r = invokeMock(stub, "Claim", agreementID, "secreT")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "does not match")
+	r = invokeMock(stub, "Claim", agreementID, "secret")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+}
+
+func TestClaimHashRounds(t *testing.T) {
+	stub := newMockStub(&mockToken{capabilities: compatible})
+	once := sha256.Sum256([]byte("secret"))
+	twice := sha256.Sum256(once[:])
+
+	// A single round is applied by default
+	r := invokeMock(stub, "Lock", counterparty, hex.EncodeToString(once[:]), "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID := string(r.Payload)
+	agreement, err := readAgreement(stub, agreementID)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, agreement.HashRounds)
+	stub.Creator = counterpartyIdentity
+	r = invokeMock(stub, "Claim", agreementID, "secreT")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	r = invokeMock(stub, "Claim", agreementID, "secret")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	// The hash of the hash of the secret
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "Lock", counterparty, hex.EncodeToString(twice[:]), "100", tokenName, "3600", `{"hashRounds": 2}`)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID = string(r.Payload)
+	stub.Creator = counterpartyIdentity
+	r = invokeMock(stub, "Claim", agreementID, hex.EncodeToString(once[:]))
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "does not match")
+	r = invokeMock(stub, "Claim", agreementID, "secret")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "Lock", counterparty, hex.EncodeToString(twice[:]), "100", tokenName, "3600", `{"hashRounds": -1}`)
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "Hash rounds must be between")
+}
+
+func TestWeakImages(t *testing.T) {
+	stub := newMockStub(&mockToken{capabilities: compatible})
+
+	weak := []string{
+		"",
+		strings.Repeat("0", 64),
+		imageOf(nil),
+		strings.ToUpper(imageOf([]byte{0x00})),
+		imageOf(make([]byte, 32)),
+	}
+	for _, image := range weak {
+		r := invokeMock(stub, "Lock", counterparty, image, "100", tokenName, "3600")
+		assert.Equal(t, shim.ERROR, int(r.Status), image)
+		assert.Contains(t, r.Message, "image of a weak secret", image)
+	}
+
+	// Weak secrets are recognised under the hash options of the lock
+	options := `{"hashAlgorithm": "sha512", "hashRounds": 2}`
+	r := invokeMock(stub, "Lock", counterparty, imageOfRounds(nil, htlc.HashSHA512, 2), "100", tokenName, "3600", options)
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "image of a weak secret")
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600",
+		fmt.Sprintf(`{"images": ["%s"]}`, imageOf(nil)))
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "image of a weak secret")
+
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "Lock", counterparty, imageOfRounds([]byte("secret"), htlc.HashSHA512, 2), "100", tokenName, "3600", options)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+}
+
+func TestDeniedImages(t *testing.T) {
+	stub := newMockStub(&mockToken{capabilities: compatible})
+	leaked := imageOf([]byte("leaked"))
+
+	// Only the administrator may maintain the denylist
+	stub.Creator = counterpartyIdentity
+	r := invokeMock(stub, "DenyImage", leaked)
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "not authorized")
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "DenyImage", leaked)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	// Denied images are rejected, including among further images
+	r = invokeMock(stub, "Lock", counterparty, leaked, "100", tokenName, "3600")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "is on the denylist")
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600",
+		fmt.Sprintf(`{"images": ["%s"]}`, leaked))
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "is on the denylist")
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	// Allowed images may be used again
+	r = invokeMock(stub, "AllowImage", leaked)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "Lock", counterparty, leaked, "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+}
+
+func TestDebugImage(t *testing.T) {
+	stub := newMockStub(&mockToken{capabilities: compatible})
+	secret := []byte{0xde, 0xad, 0xbe, 0xef}
+	first := sha512.Sum512(secret)
+	second := sha512.Sum512(first[:])
+	third := sha512.Sum512(second[:])
+	image := hex.EncodeToString(third[:])
+
+	// Diagnostics are disabled unless configured
+	r := invokeMock(stub, "DebugImage", "deadbeef", "hex", "sha512", "3")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "Diagnostics are disabled")
+	r = stub.MockInit("init", byteArray(`{"debug": true}`))
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	r = invokeMock(stub, "DebugImage", "deadbeef", "hex", "sha512", "3")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	var diagnostics ImageDiagnostics
+	assert.NoError(t, json.Unmarshal(r.Payload, &diagnostics))
+	assert.Equal(t, ImageDiagnostics{
+		SecretEncoding: "hex",
+		HashAlgorithm:  "sha512",
+		HashRounds:     3,
+		Secret:         "deadbeef",
+		Rounds:         []string{hex.EncodeToString(first[:]), hex.EncodeToString(second[:]), image},
+		Image:          image}, diagnostics)
+
+	// The diagnostics match the image computed by claims
+	r = invokeMock(stub, "Lock", counterparty, diagnostics.Image, "100", tokenName, "3600",
+		`{"secretEncoding": "hex", "hashAlgorithm": "sha512", "hashRounds": 3}`)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID := string(r.Payload)
+	stub.Creator = counterpartyIdentity
+	r = invokeMock(stub, "Claim", agreementID, "deadbeef")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	// Empty settings take the defaults, and the secret is decoded as
+	// the agreement would decode it
+	r = invokeMock(stub, "DebugImage", "secret", "", "", "")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.NoError(t, json.Unmarshal(r.Payload, &diagnostics))
+	assert.Equal(t, "utf8", diagnostics.SecretEncoding)
+	assert.Equal(t, hex.EncodeToString([]byte("secret")), diagnostics.Secret)
+	assert.Equal(t, imageOf([]byte("secret")), diagnostics.Image)
+	for _, args := range [][]string{
+		{"not hex", "hex", "", ""},
+		{"secret", "base64", "", ""},
+		{"secret", "", "md5", ""},
+		{"secret", "", "", "17"},
+		{"secret", "", "", "x"},
+	} {
+		r = invokeMock(stub, append([]string{"DebugImage"}, args...)...)
+		assert.Equal(t, shim.ERROR, int(r.Status), args)
+	}
+}
+
+func TestPausedContracts(t *testing.T) {
+	stub := newMockStub(&mockToken{capabilities: compatible})
+	stub.MockPeerChaincode("otherToken", shim.NewMockStub("otherToken", &mockToken{capabilities: compatible}))
+	r := invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID := string(r.Payload)
+
+	// Only the administrator may pause a contract
+	stub.Creator = counterpartyIdentity
+	r = invokeMock(stub, "PauseContract", tokenName)
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "not authorized")
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "PauseContract", tokenName)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	// New agreements are rejected for the paused contract only
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("other")), "100", tokenName, "3600")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "are paused")
+	r = invokeMock(stub, "SimulateLock", counterparty, imageOf([]byte("other")), "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Contains(t, string(r.Payload), "are paused")
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("other")), "100", "otherToken", "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	// Existing agreements may still be claimed
+	stub.Creator = counterpartyIdentity
+	r = invokeMock(stub, "Claim", agreementID, "secret")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	// Resumed contracts accept new agreements again
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "ResumeContract", tokenName)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("other")), "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+}
+
+func TestDeregisteredContracts(t *testing.T) {
+	stub := newMockStub(&mockToken{capabilities: compatible})
+	stub.MockPeerChaincode("otherToken", shim.NewMockStub("otherToken", &mockToken{capabilities: compatible}))
+	lock := func(secret string, tokenContract string) string {
+		stub.Creator = ownerIdentity
+		r := invokeMock(stub, "Lock", counterparty, imageOf([]byte(secret)), "100", tokenContract, "3600")
+		assert.Equal(t, shim.OK, int(r.Status), r.Message)
+		return string(r.Payload)
+	}
+	deregistered := lock("secret1", tokenName)
+	registered := lock("secret2", "otherToken")
+
+	// Only the administrator may deregister a contract
+	stub.Creator = counterpartyIdentity
+	r := invokeMock(stub, "DeregisterContract", tokenName)
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "not authorized")
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "DeregisterContract", tokenName)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	// Deregistered contracts are neither locked with nor settled
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret3")), "100", tokenName, "3600")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "is not registered")
+	stub.Creator = counterpartyIdentity
+	r = invokeMock(stub, "Claim", deregistered, "secret1")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "is not registered")
+	agreement, err := readAgreement(stub, deregistered)
+	assert.NoError(t, err)
+	assert.NotNil(t, agreement)
+
+	// Registered contracts settle as usual
+	r = invokeMock(stub, "Claim", registered, "secret2")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	// Registering the contract again allows settlement
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "RegisterContract", tokenName)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	stub.Creator = counterpartyIdentity
+	r = invokeMock(stub, "Claim", deregistered, "secret1")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+}
+
+func TestSetHashAlgorithm(t *testing.T) {
+	token := &mockToken{capabilities: compatible}
+	stub := newMockStub(token)
+	sha512Image := func(secret string) string {
+		h := sha512.Sum512([]byte(secret))
+		return hex.EncodeToString(h[:])
+	}
+
+	r := invokeMock(stub, "Lock", counterparty, imageOf([]byte("old")), "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	oldID := string(r.Payload)
+
+	// Only the administrator may change the default algorithm
+	stub.Creator = counterpartyIdentity
+	r = invokeMock(stub, "SetHashAlgorithm", "sha512")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "not authorized")
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "SetHashAlgorithm", "md5")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "Unsupported hash algorithm")
+	r = invokeMock(stub, "SetHashAlgorithm", "sha512")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	config, err := readConfig(stub)
+	assert.NoError(t, err)
+	assert.Equal(t, "sha512", config.HashAlgorithm)
+
+	// New agreements use the new default, unless they specify one
+	r = invokeMock(stub, "Lock", counterparty, sha512Image("new"), "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	newID := string(r.Payload)
+	agreement, err := readAgreement(stub, newID)
+	assert.NoError(t, err)
+	assert.Equal(t, "sha512", agreement.HashAlgorithm)
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("explicit")), "100", tokenName, "3600",
+		`{"hashAlgorithm": "sha256"}`)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	explicitID := string(r.Payload)
+
+	// Existing agreements still claim under their original algorithm
+	stub.Creator = counterpartyIdentity
+	for id, secret := range map[string]string{oldID: "old", newID: "new", explicitID: "explicit"} {
+		r = invokeMock(stub, "Claim", id, secret)
+		assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	}
+}
+
+func TestLockHashAlgorithms(t *testing.T) {
+	stub := newMockStub(&mockToken{capabilities: compatible})
+
+	// Images of "secret" under each algorithm
+	images := map[string]string{
+		htlc.HashSHA256:    "2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b",
+		htlc.HashSHA256d:   "3881219d087dd9c634373fd33dfa33a2cb6bfc6c520b64b8bb60ef2ceb534ae7",
+		htlc.HashRIPEMD160: "cd98bf0202ef07e38e87f6bd9445e5e7331e2c78",
+	}
+	for algorithm, image := range images {
+		stub.Creator = ownerIdentity
+		r := invokeMock(stub, "Lock", counterparty, image, "100", tokenName, "3600",
+			fmt.Sprintf(`{"hashAlgorithm": "%s"}`, algorithm))
+		assert.Equal(t, shim.OK, int(r.Status), r.Message)
+		agreementID := string(r.Payload)
+		agreement, err := readAgreement(stub, agreementID)
+		assert.NoError(t, err)
+		assert.Equal(t, algorithm, agreement.HashAlgorithm)
+
+		stub.Creator = counterpartyIdentity
+		r = invokeMock(stub, "Claim", agreementID, "wrong")
+		assert.Equal(t, shim.ERROR, int(r.Status), algorithm)
+		r = invokeMock(stub, "Claim", agreementID, "secret")
+		assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	}
+
+	stub.Creator = ownerIdentity
+	r := invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600",
+		`{"hashAlgorithm": "md5"}`)
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "Unsupported hash algorithm 'md5'")
+}
+
+func TestCancelEarly(t *testing.T) {
+	token := &mockToken{capabilities: compatible}
+	stub := newMockStub(token)
+
+	// Within the cancellation window
+	r := invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID := string(r.Payload)
+	stub.Creator = counterpartyIdentity
+	r = invokeMock(stub, "CancelEarly", agreementID)
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "Attempting to cancel")
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "CancelEarly", agreementID)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Contains(t, token.calls, []string{"Transfer", owner, "100"})
+	assert.Equal(t, "CancelledEarly", lastEvent(stub).EventName)
+
+	// Cancelled agreements are deleted
+	r = invokeMock(stub, "CancelEarly", agreementID)
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "not found")
+
+	// Outside the cancellation window, which closes once the window
+	// has elapsed
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID = string(r.Payload)
+	agreement, err := readAgreement(stub, agreementID)
+	assert.NoError(t, err)
+	agreement.CreatedAt -= 60
+	b, _ := json.Marshal(agreement)
+	stub.State[agreementID] = b
+	r = invokeMock(stub, "CancelEarly", agreementID)
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "Cancellation window of 60 seconds has elapsed")
+
+	// A window of zero disables early cancellation
+	stub = newMockStub(token)
+	r = stub.MockInit("init", byteArray(`{"cancellationWindow": 0}`))
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "CancelEarly", string(r.Payload))
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "Early cancellation is disabled")
+}
+
+func TestCancelWithConsent(t *testing.T) {
+	token := &mockToken{capabilities: compatible}
+	stub := newMockStub(token)
+	r := invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID := string(r.Payload)
+	abortKey, _ := stub.CreateCompositeKey(abortIndex, []string{agreementID})
+
+	// Owners may not cancel unilaterally, nor consent on behalf of the
+	// counterparty
+	r = invokeMock(stub, "Cancel", agreementID)
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "has not agreed to abort")
+	r = invokeMock(stub, "Abort", agreementID)
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "Attempting to abort")
+
+	stub.Creator = counterpartyIdentity
+	r = invokeMock(stub, "Abort", agreementID)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, "AbortRequested", lastEvent(stub).EventName)
+	r = invokeMock(stub, "Cancel", agreementID)
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "Attempting to cancel")
+
+	// With consent, owners cancel before the expiry
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "Cancel", agreementID)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Contains(t, token.calls, []string{"Transfer", owner, "100"})
+	event := lastEvent(stub)
+	assert.Equal(t, "Cancelled", event.EventName)
+	var cancelled htlc.Cancelled
+	assert.NoError(t, json.Unmarshal(event.Payload, &cancelled))
+	assert.Equal(t, agreementID, cancelled.AgreementID)
+	r = invokeMock(stub, "GetAgreement", agreementID)
+	assert.Contains(t, r.Message, "not found")
+	assert.Nil(t, stub.State[abortKey])
+
+	// Consent lapses once agreements are otherwise settled
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID = string(r.Payload)
+	abortKey, _ = stub.CreateCompositeKey(abortIndex, []string{agreementID})
+	stub.Creator = counterpartyIdentity
+	r = invokeMock(stub, "Abort", agreementID)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.NotNil(t, stub.State[abortKey])
+	r = invokeMock(stub, "Claim", agreementID, "secret")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Nil(t, stub.State[abortKey])
+}
+
+func TestSimulateLock(t *testing.T) {
+	token := &mockToken{capabilities: compatible, allowance: 100}
+	stub := newMockStub(token)
+	incompatible := shim.NewMockStub("otherToken", &mockToken{capabilities: []string{tokens.CapTransferFrom}})
+	stub.MockPeerChaincode("otherToken", incompatible)
+	r := invokeMock(stub, "DenyImage", imageOf([]byte("leaked")))
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	stateSize := len(stub.State)
+
+	for _, test := range lockTests() {
+		r := invokeMock(stub, append([]string{"SimulateLock"}, test.args...)...)
+		assert.Equal(t, shim.OK, int(r.Status), r.Message)
+		var simulation Simulation
+		assert.NoError(t, json.Unmarshal(r.Payload, &simulation))
+		assert.Equal(t, test.reason == "", simulation.OK, test.args)
+		assert.Contains(t, simulation.Reason, test.reason)
+	}
+	// Nothing is written or transferred
+	assert.Len(t, stub.State, stateSize)
+	for _, call := range token.calls {
+		assert.NotEqual(t, "TransferFrom", call[0])
+	}
+	assert.Contains(t, token.calls, []string{"Allowance", owner, "cc:" + ccName})
+}
+
+func TestSimulateLockMatchesLock(t *testing.T) {
+	stub := newMockStub(&mockToken{capabilities: compatible, allowance: 100})
+	incompatible := shim.NewMockStub("otherToken", &mockToken{capabilities: []string{tokens.CapTransferFrom}})
+	stub.MockPeerChaincode("otherToken", incompatible)
+	r := invokeMock(stub, "DenyImage", imageOf([]byte("leaked")))
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	// A simulation gives the same verdict as the lock itself
+	for _, test := range lockTests() {
+		r := invokeMock(stub, append([]string{"SimulateLock"}, test.args...)...)
+		assert.Equal(t, shim.OK, int(r.Status), r.Message)
+		var simulation Simulation
+		assert.NoError(t, json.Unmarshal(r.Payload, &simulation))
+		r = invokeMock(stub, append([]string{"Lock"}, test.args...)...)
+		assert.Equal(t, simulation.OK, int(r.Status) == shim.OK, test.args)
+		assert.Contains(t, r.Message, test.reason, test.args)
+	}
+}
+
+// lockTests returns the arguments of locks along with the reason they
+// are expected to fail, if any, for a token with an allowance of 100
+// and the image of "leaked" denied.
+func lockTests() []struct {
+	args   []string
+	reason string
+} {
+	image := imageOf([]byte("secret"))
+	return []struct {
+		args   []string
+		reason string
+	}{
+		{[]string{counterparty, image, "100", tokenName, "3600"}, ""},
+		{[]string{counterparty, image, "100", tokenName}, ""},
+		{[]string{"", image, "100", tokenName, "3600"}, "Invalid counterparty"},
+		{[]string{owner, image, "100", tokenName, "3600"}, "Invalid counterparty"},
+		{[]string{counterparty, image, "0", tokenName, "3600"}, "zero amount"},
+		{[]string{counterparty, image, "100", tokenName, "59"}, "Lock time must be between"},
+		{[]string{counterparty, image, "100", tokenName, strconv.Itoa(maxLockTime + 1)}, "Lock time must be between"},
+		{[]string{counterparty, image, "100", tokenName, "3600", `{"secretEncoding": "base64"}`}, "Unsupported secret encoding"},
+		{[]string{counterparty, imageOf([]byte("")), "100", tokenName, "3600"}, "weak secret"},
+		{[]string{counterparty, imageOf([]byte("leaked")), "100", tokenName, "3600"}, "denylist"},
+		{[]string{counterparty, image, "100", tokenName, "3600", fmt.Sprintf(`{"images": ["%s"]}`, image)}, "Duplicate image"},
+		{[]string{counterparty, image, "100", "otherToken", "3600"}, "does not support"},
+		{[]string{counterparty, image, "101", tokenName, "3600"}, "Insufficient allowance"},
+	}
+}
+
+func TestLockMaxAgreementAmount(t *testing.T) {
+	token := &mockToken{capabilities: compatible, supply: 10000}
+	stub := newMockStub(token)
+	r := stub.MockInit("init", byteArray(`{"maxAgreementBps": 1000}`))
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret1")), "1000", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret2")), "1001", tokenName, "3600")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "exceeds the maximum of 1000")
+
+	// Uncapped by default
+	token = &mockToken{capabilities: compatible, supply: 10000}
+	stub = newMockStub(token)
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret2")), "10000", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.NotContains(t, token.calls, []string{"TokenSupply"})
+
+	r = stub.MockInit("init", byteArray(`{"maxAgreementBps": 10001}`))
+	assert.Equal(t, shim.ERROR, int(r.Status))
+}
+
+func TestLockCustodyShortfall(t *testing.T) {
+	token := &mockToken{capabilities: compatible, balance: 1000}
+	stub := newMockStub(token)
+	r := invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	// A token contract charging a fee credits custody with less than
+	// the amount locked
+	token.fee = 1
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "is 1099 following transfer, expected 1100")
+
+	// Token contracts not reporting the balance are rejected
+	token.capabilities = []string{tokens.CapTransfer, tokens.CapTransferFrom, tokens.CapChaincodeAddresses}
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "does not support 'transferFromBalance'")
+}
+
+func TestLockTokenDecimals(t *testing.T) {
+	token := &mockToken{capabilities: compatible, balance: 1000, decimals: 2}
+	stub := newMockStub(token)
+	r := invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "150", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Contains(t, token.calls, []string{"TransferFrom", owner, "cc:" + ccName, "150"})
+
+	// Shortfalls are detected in the smallest unit
+	token.fee = 1
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "150", tokenName, "3600")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "is 1149 following transfer, expected 1150")
+}
+
+func TestGetAgreement(t *testing.T) {
+	stub := newMockStub(&mockToken{capabilities: compatible})
+	image := imageOf([]byte("secret"))
+	r := invokeMock(stub, "Lock", counterparty, image, "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID := string(r.Payload)
+
+	r = invokeMock(stub, "GetAgreement", agreementID)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	var agreement Agreement
+	assert.NoError(t, json.Unmarshal(r.Payload, &agreement))
+	assert.Equal(t, owner, agreement.Owner)
+	assert.Equal(t, counterparty, agreement.Counterparty)
+	assert.Equal(t, image, agreement.Image)
+	assert.Equal(t, uint64(100), agreement.Amount)
+	assert.Equal(t, tokenName, agreement.TokenContract)
+	assert.Equal(t, agreement.CreatedAt+3600, agreement.Expiry)
+
+	// The payload matches the agreement as stored
+	stored, err := readAgreement(stub, agreementID)
+	assert.NoError(t, err)
+	assert.Equal(t, stored, &agreement)
+
+	r = invokeMock(stub, "GetAgreement", "missing")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Equal(t, "Agreement missing not found", r.Message)
+	r = invokeMock(stub, "GetAgreement")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Equal(t, "Expected 1 arguments (agreementID), got 0", r.Message)
+}
+
+func TestLockHint(t *testing.T) {
+	stub := newMockStub(&mockToken{capabilities: compatible})
+	r := invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600", `{"hint": "The usual place"}`)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID := string(r.Payload)
+
+	r = invokeMock(stub, "GetAgreement", agreementID)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	var agreement Agreement
+	assert.NoError(t, json.Unmarshal(r.Payload, &agreement))
+	assert.Equal(t, "The usual place", agreement.Hint)
+
+	// The hint plays no part in claiming tokens
+	stub.Creator = counterpartyIdentity
+	r = invokeMock(stub, "Claim", agreementID, "The usual place")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	r = invokeMock(stub, "Claim", agreementID, "secret")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	stub.Creator = ownerIdentity
+	hint := strings.Repeat("x", maxHintLength+1)
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600", fmt.Sprintf(`{"hint": %q}`, hint))
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "Hint must not exceed")
+
+	r = invokeMock(stub, "GetAgreement", "missing")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+}
+
+func TestLockOnBehalf(t *testing.T) {
+	token := &mockToken{capabilities: compatible}
+	stub := newMockStub(token)
+	lockerIdentity, locker := newIdentity()
+	options := fmt.Sprintf(`{"owner": "%s"}`, owner)
+
+	// Lockers must be authorized by the owner
+	stub.Creator = lockerIdentity
+	r := invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600", options)
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "not authorized to lock tokens on behalf of")
+
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "AuthorizeLocker", locker)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	stub.Creator = lockerIdentity
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600", options)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID := string(r.Payload)
+	assert.Contains(t, token.calls, []string{"TransferFrom", owner, "cc:" + ccName, "100"})
+
+	// The agreement records the submitter separately from the owner
+	r = invokeMock(stub, "GetAgreement", agreementID)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	var agreement Agreement
+	assert.NoError(t, json.Unmarshal(r.Payload, &agreement))
+	assert.Equal(t, owner, agreement.Owner)
+	assert.Equal(t, locker, agreement.CreatedBy)
+	assert.Equal(t, owner, agreement.RefundAddress)
+
+	// Only the owner may cancel the agreement
+	r = invokeMock(stub, "CancelEarly", agreementID)
+	assert.Equal(t, shim.ERROR, int(r.Status))
+
+	// Owners locking their own tokens are the creator
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	created, err := readAgreement(stub, string(r.Payload))
+	assert.NoError(t, err)
+	assert.Equal(t, owner, created.CreatedBy)
+
+	// Revoked lockers may no longer lock tokens
+	r = invokeMock(stub, "RevokeLocker", locker)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	stub.Creator = lockerIdentity
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600", options)
+	assert.Equal(t, shim.ERROR, int(r.Status))
+}
+
+func TestAge(t *testing.T) {
+	stub := newMockStub(&mockToken{capabilities: compatible})
+	for _, age := range []int64{0, 90, 3600} {
+		r := invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600")
+		assert.Equal(t, shim.OK, int(r.Status), r.Message)
+		agreementID := string(r.Payload)
+		agreement, err := readAgreement(stub, agreementID)
+		assert.NoError(t, err)
+		agreement.CreatedAt -= age
+		b, _ := json.Marshal(agreement)
+		stub.State[agreementID] = b
+
+		r = invokeMock(stub, "Age", agreementID)
+		assert.Equal(t, shim.OK, int(r.Status), r.Message)
+		ts, _ := stub.GetTxTimestamp()
+		assert.Equal(t, strconv.FormatInt(ts.GetSeconds()-agreement.CreatedAt, 10), string(r.Payload))
+	}
+
+	r := invokeMock(stub, "Age", "missing")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+}
+
+func TestUnlockRefundAddress(t *testing.T) {
+	token := &mockToken{capabilities: compatible}
+	stub := newMockStub(token)
+	_, refund := newIdentity()
+	expire := func(agreementID string) {
+		agreement, err := readAgreement(stub, agreementID)
+		assert.NoError(t, err)
+		agreement.Expiry -= 3600
+		b, _ := json.Marshal(agreement)
+		stub.State[agreementID] = b
+	}
+
+	// Tokens are returned to the owner by default
+	r := invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID := string(r.Payload)
+	expire(agreementID)
+	r = invokeMock(stub, "Unlock", agreementID)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Contains(t, token.calls, []string{"Transfer", owner, "100"})
+
+	// Tokens are returned to the refund address, though only the
+	// owner may unlock them
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "200", tokenName, "3600",
+		fmt.Sprintf(`{"refundAddress": "%s"}`, refund))
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID = string(r.Payload)
+	expire(agreementID)
+	stub.Creator = counterpartyIdentity
+	r = invokeMock(stub, "Unlock", agreementID)
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "Unlock", agreementID)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Contains(t, token.calls, []string{"Transfer", refund, "200"})
+
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "200", tokenName, "3600",
+		`{"refundAddress": "cold"}`)
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "Malformed refund address")
+}
+
+func TestUnlockNotAuthorized(t *testing.T) {
+	stub := newMockStub(&mockToken{capabilities: compatible})
+	r := invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID := string(r.Payload)
+
+	stub.Creator = counterpartyIdentity
+	r = invokeMock(stub, "Unlock", agreementID)
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "not authorized")
+	assert.NotContains(t, r.Message, owner)
+}
+
+func TestRevealedSecrets(t *testing.T) {
+	stub := newMockStub(&mockToken{capabilities: compatible})
+	var ids []string
+	for _, secret := range []string{"secret1", "secret2", "secret3"} {
+		stub.Creator = ownerIdentity
+		r := invokeMock(stub, "Lock", counterparty, imageOf([]byte(secret)), "100", tokenName, "3600")
+		assert.Equal(t, shim.OK, int(r.Status), r.Message)
+		ids = append(ids, string(r.Payload))
+	}
+	// Only secrets revealed by successful claims are listed
+	stub.Creator = counterpartyIdentity
+	r := invokeMock(stub, "Claim", ids[0], "secret1")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "Claim", ids[1], "wrong")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	r = invokeMock(stub, "Claim", ids[2], "secret3")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	ts, _ := stub.GetTxTimestamp()
+
+	r = invokeMock(stub, "RevealedSecrets", "0")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	var page RevealedSecretsPage
+	assert.NoError(t, json.Unmarshal(r.Payload, &page))
+	assert.Len(t, page.Secrets, 2)
+	assert.Empty(t, page.Bookmark)
+	var revealed []string
+	for _, s := range page.Secrets {
+		revealed = append(revealed, s.Secret)
+		assert.Equal(t, imageOf([]byte(s.Secret)), s.Image)
+	}
+	assert.ElementsMatch(t, []string{"secret1", "secret3"}, revealed)
+
+	r = invokeMock(stub, "RevealedSecrets", strconv.FormatInt(ts.GetSeconds()+1, 10))
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, `{"secrets":[],"bookmark":""}`, string(r.Payload))
+
+	// Secrets revealed within the same second are paged through
+	// using the bookmark
+	stub.MockTransactionStart("reveal")
+	for i := 0; i < maxRevealedSecrets+50; i++ {
+		b, _ := json.Marshal(RevealedSecret{AgreementID: fmt.Sprintf("agreement%03d", i), Secret: "s",
+			Image: imageOf([]byte("s")), ClaimedAt: ts.GetSeconds() + 10})
+		stub.PutState(fmt.Sprintf("%s%020d:agreement%03d:%s", revealedKeyPrefix, ts.GetSeconds()+10, i,
+			imageOf([]byte("s"))), b)
+	}
+	stub.MockTransactionEnd("reveal")
+	seen := map[string]bool{}
+	bookmark := ""
+	for pages := 0; pages == 0 || bookmark != ""; pages++ {
+		r = invokeMock(stub, "RevealedSecrets", strconv.FormatInt(ts.GetSeconds()+10, 10), bookmark)
+		assert.Equal(t, shim.OK, int(r.Status), r.Message)
+		assert.NoError(t, json.Unmarshal(r.Payload, &page))
+		assert.True(t, len(page.Secrets) <= maxRevealedSecrets)
+		for _, s := range page.Secrets {
+			assert.False(t, seen[s.AgreementID], s.AgreementID)
+			seen[s.AgreementID] = true
+		}
+		bookmark = page.Bookmark
+	}
+	assert.Len(t, seen, maxRevealedSecrets+50)
+	r = invokeMock(stub, "RevealedSecrets", "0", "token")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "Malformed bookmark")
+}
+
+func TestLockEscrowHold(t *testing.T) {
+	token := &mockToken{capabilities: []string{tokens.CapTransfer, tokens.CapHold}}
+	stub := newMockStub(token)
+
+	// Tokens are held in place rather than transferred into custody
+	r := invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600", `{"escrow": "hold"}`)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID := string(r.Payload)
+	assert.Contains(t, token.calls, []string{"Hold", owner, agreementID, "100"})
+	stub.Creator = counterpartyIdentity
+	r = invokeMock(stub, "Claim", agreementID, "secret")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Contains(t, token.calls, []string{"Release", agreementID, counterparty})
+
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600", `{"escrow": "hold"}`)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID = string(r.Payload)
+	r = invokeMock(stub, "CancelEarly", agreementID)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Contains(t, token.calls, []string{"Release", agreementID, owner})
+	for _, call := range token.calls {
+		assert.NotEqual(t, "TransferFrom", call[0])
+		assert.NotEqual(t, "Transfer", call[0])
+	}
+
+	// Token contracts without holds only support custody
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	token = &mockToken{capabilities: compatible}
+	stub = newMockStub(token)
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600", `{"escrow": "hold"}`)
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "does not support 'hold'")
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600", `{"escrow": "vault"}`)
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "Unsupported escrow mode")
+}
+
+func TestSecretUsed(t *testing.T) {
+	stub := newMockStub(&mockToken{capabilities: compatible})
+	used, unused := imageOf([]byte("secret1")), imageOf([]byte("secret2"))
+	r := invokeMock(stub, "Lock", counterparty, used, "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID := string(r.Payload)
+	r = invokeMock(stub, "Lock", counterparty, unused, "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	// Locking alone does not reveal the secret
+	r = invokeMock(stub, "SecretUsed", used)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, "false", string(r.Payload))
+
+	stub.Creator = counterpartyIdentity
+	r = invokeMock(stub, "Claim", agreementID, "secret1")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "SecretUsed", used)
+	assert.Equal(t, "true", string(r.Payload))
+	r = invokeMock(stub, "SecretUsed", unused)
+	assert.Equal(t, "false", string(r.Payload))
+}
+
+func TestAgreementByMirror(t *testing.T) {
+	stub := newMockStub(&mockToken{capabilities: compatible})
+	r := invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600",
+		`{"mirrorChannel": "otherchannel", "mirrorAgreementId": "abc123"}`)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID := string(r.Payload)
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	r = invokeMock(stub, "GetAgreement", agreementID)
+	var agreement Agreement
+	assert.NoError(t, json.Unmarshal(r.Payload, &agreement))
+	assert.Equal(t, "otherchannel", agreement.MirrorChannel)
+	assert.Equal(t, "abc123", agreement.MirrorAgreementID)
+
+	r = invokeMock(stub, "AgreementByMirror", "otherchannel", "abc123")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	var entry AgreementEntry
+	assert.NoError(t, json.Unmarshal(r.Payload, &entry))
+	assert.Equal(t, agreementID, entry.AgreementID)
+	assert.Equal(t, "abc123", entry.MirrorAgreementID)
+
+	r = invokeMock(stub, "AgreementByMirror", "otherchannel", "abc")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "No agreement found")
+	r = invokeMock(stub, "AgreementByMirror", "thirdchannel", "abc123")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+}
+
+func TestClaimedEventRevealsSecret(t *testing.T) {
+	stub := newMockStub(&mockToken{capabilities: compatible})
+	claimed := func() htlc.Claimed {
+		event := lastEvent(stub)
+		assert.Equal(t, "Claimed", event.EventName)
+		var claimed htlc.Claimed
+		assert.NoError(t, json.Unmarshal(event.Payload, &claimed))
+		return claimed
+	}
+
+	r := invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID := string(r.Payload)
+	stub.Creator = counterpartyIdentity
+	r = invokeMock(stub, "Claim", agreementID, "secret")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, htlc.Claimed{SchemaVersion: 2, AgreementID: agreementID, Secret: "secret", Amount: 100}, claimed())
+
+	// Each secret supplied is revealed for agreements with several
+	// images
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("first")), "100", tokenName, "3600",
+		fmt.Sprintf(`{"images": ["%s"]}`, imageOf([]byte("second"))))
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID = string(r.Payload)
+	stub.Creator = counterpartyIdentity
+	r = invokeMock(stub, "Claim", agreementID, "second", "first")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, htlc.Claimed{SchemaVersion: 2, AgreementID: agreementID, Secret: "second", Amount: 100,
+		Secrets: []string{"second", "first"}}, claimed())
+}
+
+func TestLockTimeBounds(t *testing.T) {
+	stub := newMockStub(&mockToken{capabilities: compatible})
+
+	tests := []struct {
+		lockTime string
+		message  string
+	}{
+		{"0", "Lock time must be between 60 and 31536000 seconds"},
+		{"-3600", "Lock time must be between 60 and 31536000 seconds"},
+		{"59", "Lock time must be between 60 and 31536000 seconds"},
+		{strconv.Itoa(maxLockTime + 1), "Lock time must be between 60 and 31536000 seconds"},
+		{"1h", "Malformed lock time '1h'"},
+		{"3600.5", "Malformed lock time '3600.5'"},
+	}
+	for _, test := range tests {
+		r := invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, test.lockTime)
+		assert.Equal(t, shim.ERROR, int(r.Status), test.lockTime)
+		assert.Contains(t, r.Message, test.message, test.lockTime)
+	}
+	r := invokeMock(stub, "SimulateLock", counterparty, imageOf([]byte("secret")), "100", tokenName, "1h")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "Malformed lock time")
+
+	// Lock times at the bounds are accepted
+	for _, lockTime := range []string{strconv.Itoa(minLockTime), strconv.Itoa(maxLockTime)} {
+		r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, lockTime)
+		assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	}
+}
+
+func TestExpiryOverflow(t *testing.T) {
+	stub := newMockStub(&mockToken{capabilities: compatible})
+
+	// Near-maximum lock times are rejected rather than wrapping to an
+	// expiry in the past
+	r := invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName,
+		strconv.FormatInt(math.MaxInt64-10, 10))
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "Lock time must be between")
+
+	txID++
+	stub.MockTransactionStart(strconv.Itoa(txID))
+	defer stub.MockTransactionEnd(strconv.Itoa(txID))
+	stub.TxTimestamp = &timestamp.Timestamp{Seconds: 1700000000}
+	caller := &CallerProps{stub: stub}
+	_, err := getExpiryTime(caller, math.MaxInt64-10)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "overflows the expiry time")
+	expiry, err := getExpiryTime(caller, math.MaxInt64-1700000000)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(math.MaxInt64), expiry)
+}
+
+func TestTooFewArgs(t *testing.T) {
+	stub := newMockStub(&mockToken{capabilities: compatible})
+
+	tests := []struct {
+		args    []string
+		message string
+	}{
+		{[]string{"Lock"}, "Expected 4 arguments (counterparty, image, amount, tokenContract), got 0"},
+		{[]string{"Lock", counterparty, imageOf([]byte("secret")), "100"},
+			"Expected 4 arguments (counterparty, image, amount, tokenContract), got 3"},
+		{[]string{"Unlock"}, "Expected 1 arguments (agreementID), got 0"},
+		{[]string{"Claim"}, "Expected 2 arguments (agreementID, secret), got 0"},
+		{[]string{"Claim", "agreement"}, "Expected 2 arguments (agreementID, secret), got 1"},
+	}
+	for _, test := range tests {
+		r := invokeMock(stub, test.args...)
+		assert.Equal(t, shim.ERROR, int(r.Status), test.args)
+		assert.Equal(t, test.message, r.Message, test.args)
+	}
+}
+
+func TestMalformedNumbers(t *testing.T) {
+	stub := newMockStub(&mockToken{capabilities: compatible})
+
+	for _, value := range []string{"abc", "-1", "1e3", "18446744073709551616"} {
+		r := invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), value, tokenName)
+		assert.Equal(t, shim.ERROR, int(r.Status), value)
+		assert.Equal(t, fmt.Sprintf("Malformed number '%s'", value), r.Message, value)
+	}
+	for _, value := range []string{"abc", "9223372036854775808"} {
+		for _, args := range [][]string{
+			{"AgreementsExpiringWithin", value},
+			{"RevealedSecrets", value},
+			{"AgreementsCreatedBetween", "0", value},
+		} {
+			r := invokeMock(stub, args...)
+			assert.Equal(t, shim.ERROR, int(r.Status), args)
+			assert.Equal(t, fmt.Sprintf("Malformed number '%s'", value), r.Message, args)
+		}
+	}
+}
+
+func TestEventSchemaVersion(t *testing.T) {
+	stub := newMockStub(&mockToken{capabilities: compatible})
+	assertVersion := func(name string) {
+		event := lastEvent(stub)
+		assert.Equal(t, name, event.EventName)
+		var fields map[string]interface{}
+		assert.NoError(t, json.Unmarshal(event.Payload, &fields))
+		assert.Equal(t, float64(htlc.EventSchemaVersion), fields["schemaVersion"], name)
+	}
+	lock := func() string {
+		stub.Creator = ownerIdentity
+		r := invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600")
+		assert.Equal(t, shim.OK, int(r.Status), r.Message)
+		assertVersion("Locked")
+		return string(r.Payload)
+	}
+
+	agreementID := lock()
+	invokeMock(stub, "CancelEarly", agreementID)
+	assertVersion("CancelledEarly")
+
+	agreementID = lock()
+	stub.Creator = counterpartyIdentity
+	invokeMock(stub, "Claim", agreementID, "secret")
+	assertVersion("Claimed")
+
+	agreementID = lock()
+	stub.Creator = counterpartyIdentity
+	invokeMock(stub, "Abort", agreementID)
+	assertVersion("AbortRequested")
+	stub.Creator = ownerIdentity
+	invokeMock(stub, "Cancel", agreementID)
+	assertVersion("Cancelled")
+
+	agreementID = lock()
+	agreement, err := readAgreement(stub, agreementID)
+	assert.NoError(t, err)
+	agreement.Expiry -= 3600
+	b, _ := json.Marshal(agreement)
+	stub.State[agreementID] = b
+	invokeMock(stub, "Unlock", agreementID)
+	assertVersion("Unlocked")
+}
+
+func TestClaimMultipleSecrets(t *testing.T) {
+	token := &mockToken{capabilities: compatible}
+	stub := newMockStub(token)
+	images := fmt.Sprintf(`"images": ["%s", "%s"]`, imageOf([]byte("second")), imageOf([]byte("third")))
+
+	// All secrets are required by default
+	r := invokeMock(stub, "Lock", counterparty, imageOf([]byte("first")), "100", tokenName, "3600", "{"+images+"}")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID := string(r.Payload)
+	agreement, err := readAgreement(stub, agreementID)
+	assert.NoError(t, err)
+	assert.Equal(t, htlc.CombinatorAnd, agreement.Combinator)
+	stub.Creator = counterpartyIdentity
+	r = invokeMock(stub, "Claim", agreementID, "first", "third")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "Secret of image '"+imageOf([]byte("second"))+"' is required")
+	r = invokeMock(stub, "Claim", agreementID, "first", "second", "other")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "does not match any image")
+	r = invokeMock(stub, "Claim", agreementID, "third", "first", "second")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	for _, secret := range []string{"first", "second", "third"} {
+		r = invokeMock(stub, "SecretUsed", imageOf([]byte(secret)))
+		assert.Equal(t, "true", string(r.Payload))
+	}
+
+	// Any one secret is sufficient
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("first")), "100", tokenName, "3600",
+		`{"combinator": "or", `+images+"}")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID = string(r.Payload)
+	stub.Creator = counterpartyIdentity
+	r = invokeMock(stub, "Claim", agreementID, "other")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	r = invokeMock(stub, "Claim", agreementID, "third")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	// Single image agreements require a single secret
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("first")), "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID = string(r.Payload)
+	stub.Creator = counterpartyIdentity
+	r = invokeMock(stub, "Claim", agreementID, "first", "first")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+
+	// Images must be distinct and combinators known
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("second")), "100", tokenName, "3600", "{"+images+"}")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "Duplicate image")
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("first")), "100", tokenName, "3600",
+		`{"combinator": "xor", `+images+"}")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "Unsupported combinator")
+}
+
+func TestClaimDelegated(t *testing.T) {
+	token := &mockToken{capabilities: compatible}
+	stub := newMockStub(token)
+	delegateIdentity, delegate := newIdentity()
+	otherIdentity, _ := newIdentity()
+	options := fmt.Sprintf(`{"allowDelegatedClaim": true, "delegate": "%s"}`, delegate)
+
+	// Direct claims by the counterparty are still allowed
+	r := invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600", options)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID := string(r.Payload)
+	stub.Creator = counterpartyIdentity
+	r = invokeMock(stub, "Claim", agreementID, "secret")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	// Delegated claims credit the counterparty
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "200", tokenName, "3600", options)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID = string(r.Payload)
+	stub.Creator = otherIdentity
+	r = invokeMock(stub, "Claim", agreementID, "secret")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "Attempting to claim")
+	stub.Creator = delegateIdentity
+	r = invokeMock(stub, "Claim", agreementID, "secret")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Contains(t, token.calls, []string{"Transfer", counterparty, "200"})
+
+	// Delegates may only claim if allowed
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID = string(r.Payload)
+	stub.Creator = delegateIdentity
+	r = invokeMock(stub, "Claim", agreementID, "secret")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600", `{"allowDelegatedClaim": true}`)
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "A delegate must be specified")
+}
+
+func TestHealthCheck(t *testing.T) {
+	token := &mockToken{capabilities: compatible}
+	stub := newMockStub(token)
+	r := invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID := string(r.Payload)
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "50", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	token.balance = 150
+
+	var report HealthReport
+	r = invokeMock(stub, "HealthCheck")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.NoError(t, json.Unmarshal(r.Payload, &report))
+	assert.Equal(t, HealthReport{Healthy: true, Agreements: 2, Violations: []string{}}, report)
+
+	// Inject an agreement expiring before its creation, and a shortfall
+	// in the custody balance
+	agreement, err := readAgreement(stub, agreementID)
+	assert.NoError(t, err)
+	agreement.Expiry = agreement.CreatedAt - 1
+	b, _ := json.Marshal(agreement)
+	stub.State[agreementID] = b
+	token.balance = 120
+
+	r = invokeMock(stub, "HealthCheck")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.NoError(t, json.Unmarshal(r.Payload, &report))
+	assert.False(t, report.Healthy)
+	assert.Equal(t, []string{
+		fmt.Sprintf("Agreement %s expires before it was created", agreementID),
+		fmt.Sprintf("Custody balance of 120 in contract %s is below the 150 locked", tokenName)}, report.Violations)
+}
+
+func TestAgreementsCreatedBetween(t *testing.T) {
+	token := &mockToken{capabilities: []string{tokens.CapTransfer, tokens.CapHold}}
+	stub := newMockStub(token)
+	cert, err := cid.GetX509Certificate(stub)
+	assert.NoError(t, err)
+	swap := &CrossChainSwap{config: &Config{}, caller: &CallerProps{cert: cert, stub: stub}}
+
+	// Lock at different times, a day apart
+	day := int64(createdBucketSize)
+	start := int64(1700000000)
+	ids := make([]string, 4)
+	for i := range ids {
+		txID++
+		stub.MockTransactionStart(strconv.Itoa(txID))
+		stub.TxTimestamp = &timestamp.Timestamp{Seconds: start + int64(i)*day}
+		ids[i], err = swap.Lock(counterparty, imageOf([]byte("secret")), 100, tokenName, 3600,
+			htlc.LockOptions{Escrow: htlc.EscrowHold})
+		assert.NoError(t, err)
+		stub.MockTransactionEnd(strconv.Itoa(txID))
+	}
+
+	var agreementIDs []string
+	r := invokeMock(stub, "AgreementsCreatedBetween", strconv.FormatInt(start, 10), strconv.FormatInt(start+2*day, 10))
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.NoError(t, json.Unmarshal(r.Payload, &agreementIDs))
+	assert.Equal(t, ids[:3], agreementIDs)
+
+	r = invokeMock(stub, "AgreementsCreatedBetween", strconv.FormatInt(start+1, 10), strconv.FormatInt(start+3*day-1, 10))
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.NoError(t, json.Unmarshal(r.Payload, &agreementIDs))
+	assert.Equal(t, ids[1:3], agreementIDs)
+
+	r = invokeMock(stub, "AgreementsCreatedBetween", "0", "100")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, "[]", string(r.Payload))
+
+	r = invokeMock(stub, "AgreementsCreatedBetween", strconv.FormatInt(start, 10), strconv.FormatInt(start+31*day, 10))
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "must not span more than 31 days")
+	r = invokeMock(stub, "AgreementsCreatedBetween", "100", "0")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+}
+
+func TestExpiryUsesTxTimestamp(t *testing.T) {
+	token := &mockToken{capabilities: []string{tokens.CapTransfer, tokens.CapHold}}
+	stub := newMockStub(token)
+	ownerCert, err := cid.GetX509Certificate(stub)
+	assert.NoError(t, err)
+	stub.Creator = counterpartyIdentity
+	counterpartyCert, err := cid.GetX509Certificate(stub)
+	assert.NoError(t, err)
+	stub.Creator = ownerIdentity
+
+	// Run each call in a transaction timestamped at the given time,
+	// long before the wall clock of the peer
+	at := func(ts int64, cert *x509.Certificate, call func(swap *CrossChainSwap) error) error {
+		txID++
+		stub.MockTransactionStart(strconv.Itoa(txID))
+		defer stub.MockTransactionEnd(strconv.Itoa(txID))
+		stub.TxTimestamp = &timestamp.Timestamp{Seconds: ts}
+		return call(&CrossChainSwap{config: &Config{}, caller: &CallerProps{cert: cert, stub: stub}})
+	}
+	start := int64(1700000000)
+	lock := func() string {
+		var id string
+		err := at(start, ownerCert, func(swap *CrossChainSwap) (err error) {
+			id, err = swap.Lock(counterparty, imageOf([]byte("secret")), 100, tokenName, 3600,
+				htlc.LockOptions{Escrow: htlc.EscrowHold})
+			return err
+		})
+		assert.NoError(t, err)
+		return id
+	}
+	unlock := func(id string) func(swap *CrossChainSwap) error {
+		return func(swap *CrossChainSwap) error { return swap.Unlock(id) }
+	}
+	claim := func(id string) func(swap *CrossChainSwap) error {
+		return func(swap *CrossChainSwap) error { return swap.Claim(id, "secret") }
+	}
+
+	// Owners may not unlock before the expiry, however far behind the
+	// transaction timestamp the wall clock is
+	agreementID := lock()
+	err = at(start+3599, ownerCert, unlock(agreementID))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "set to expire")
+	assert.NoError(t, at(start+3600, ownerCert, unlock(agreementID)))
+
+	// Counterparties may claim up to the expiry, and not after
+	agreementID = lock()
+	err = at(start+3601, counterpartyCert, claim(agreementID))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "expired")
+	assert.NoError(t, at(start+3600, counterpartyCert, claim(agreementID)))
+}
+
+func TestSettledAgreementsDeleted(t *testing.T) {
+	token := &mockToken{capabilities: compatible}
+	stub := newMockStub(token)
+	expire := func(agreementID string) {
+		agreement, err := readAgreement(stub, agreementID)
+		assert.NoError(t, err)
+		agreement.Expiry -= 3600
+		b, _ := json.Marshal(agreement)
+		stub.State[agreementID] = b
+	}
+
+	// Claimed agreements cannot be unlocked
+	r := invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID := string(r.Payload)
+	stub.Creator = counterpartyIdentity
+	r = invokeMock(stub, "Claim", agreementID, "secret")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.NotContains(t, stub.State, agreementID)
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "Unlock", agreementID)
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "not found")
+
+	// Unlocked agreements cannot be claimed
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID = string(r.Payload)
+	expire(agreementID)
+	r = invokeMock(stub, "Unlock", agreementID)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.NotContains(t, stub.State, agreementID)
+	r = invokeMock(stub, "Unlock", agreementID)
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	stub.Creator = counterpartyIdentity
+	r = invokeMock(stub, "Claim", agreementID, "secret")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "not found")
+
+	// Agreements settled before they were deleted are inactive
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID = string(r.Payload)
+	key, _ := stub.CreateCompositeKey(ownerCounterpartyIndex, []string{owner, counterparty, agreementID})
+	delete(stub.State, key)
+	expire(agreementID)
+	r = invokeMock(stub, "Unlock", agreementID)
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "no longer active")
+}
+
+func TestReindexAgreement(t *testing.T) {
+	token := &mockToken{capabilities: compatible}
+	stub := newMockStub(token)
+	r := invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	settledID := string(r.Payload)
+	agreement, err := readAgreement(stub, settledID)
+	assert.NoError(t, err)
+	expiry := agreement.Expiry
+
+	// Agreements locked before they were indexed carry only the
+	// original fields
+	preIndex := func(agreementID string, secret string) {
+		stub.State[agreementID] = []byte(fmt.Sprintf(
+			`{"owner": "%s", "counterparty": "%s", "image": "%s", "amount": 100, "tokenContract": "%s", "expiry": %d}`,
+			owner, counterparty, imageOf([]byte(secret)), tokenName, expiry))
+	}
+	preIndex("claimable", "secret")
+	preIndex("unlockable", "other")
+	stub.Creator = counterpartyIdentity
+	r = invokeMock(stub, "Claim", "claimable", "secret")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "no longer active")
+
+	// Only the administrator may reindex agreements
+	r = invokeMock(stub, "ReindexAgreement", "claimable")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "not authorized")
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "ReindexAgreement", "claimable", "unlockable")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "ReindexAgreement", "claimable")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "already indexed")
+	r = invokeMock(stub, "ReindexAgreement", "unknown")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "not found")
+
+	stub.Creator = counterpartyIdentity
+	r = invokeMock(stub, "Claim", "claimable", "secret")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Contains(t, token.calls, []string{"Transfer", counterparty, "100"})
+	assert.NotContains(t, stub.State, "claimable")
+
+	stub.Creator = ownerIdentity
+	agreement, err = readAgreement(stub, "unlockable")
+	assert.NoError(t, err)
+	agreement.Expiry -= 3600
+	b, _ := json.Marshal(agreement)
+	stub.State["unlockable"] = b
+	r = invokeMock(stub, "Unlock", "unlockable")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Contains(t, token.calls, []string{"Transfer", owner, "100"})
+	assert.NotContains(t, stub.State, "unlockable")
+
+	// Agreements with a recorded settlement are not reindexed
+	settled := stub.State[settledID]
+	stub.Creator = counterpartyIdentity
+	r = invokeMock(stub, "Claim", settledID, "secret")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	stub.State[settledID] = settled
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "ReindexAgreement", settledID)
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "has been settled")
+}
+
+func TestGetAgreementsByOwner(t *testing.T) {
+	stub := newMockStub(&mockToken{capabilities: compatible})
+	_, other := newIdentity()
+	otherOwnerIdentity, otherOwner := newIdentity()
+	list := func(args ...string) []AgreementEntry {
+		r := invokeMock(stub, append([]string{"GetAgreementsByOwner"}, args...)...)
+		assert.Equal(t, shim.OK, int(r.Status), r.Message)
+		var entries []AgreementEntry
+		assert.NoError(t, json.Unmarshal(r.Payload, &entries))
+		return entries
+	}
+	lock := func(counterparty string, amount string) string {
+		r := invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), amount, tokenName, "3600")
+		assert.Equal(t, shim.OK, int(r.Status), r.Message)
+		return string(r.Payload)
+	}
+	first := lock(counterparty, "100")
+	second := lock(counterparty, "200")
+	third := lock(other, "300")
+	stub.Creator = otherOwnerIdentity
+	lock(counterparty, "400")
+	stub.Creator = ownerIdentity
+
+	// Agreements of the invoker, by default
+	entries := list()
+	assert.Len(t, entries, 3)
+	ids := map[string]uint64{}
+	for _, e := range entries {
+		assert.Equal(t, owner, e.Owner)
+		ids[e.AgreementID] = e.Amount
+	}
+	assert.Equal(t, map[string]uint64{first: 100, second: 200, third: 300}, ids)
+
+	// Filtered by owner and counterparty
+	assert.Len(t, list(otherOwner), 1)
+	entries = list(owner, other)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, third, entries[0].AgreementID)
+	assert.Len(t, list(owner, counterparty), 2)
+	assert.Len(t, list(counterparty), 0)
+
+	// Settled agreements are no longer listed
+	stub.Creator = counterpartyIdentity
+	r := invokeMock(stub, "Claim", first, "secret")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Len(t, list(owner), 2)
+}
+
+func TestCanUnlock(t *testing.T) {
+	stub := newMockStub(&mockToken{capabilities: compatible})
+	canUnlock := func(agreementID string) Simulation {
+		r := invokeMock(stub, "CanUnlock", agreementID)
+		assert.Equal(t, shim.OK, int(r.Status), r.Message)
+		var simulation Simulation
+		assert.NoError(t, json.Unmarshal(r.Payload, &simulation))
+		return simulation
+	}
+	r := invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID := string(r.Payload)
+
+	// Before expiry
+	simulation := canUnlock(agreementID)
+	assert.False(t, simulation.OK)
+	assert.Contains(t, simulation.Reason, "is set to expire")
+
+	// After expiry, for the owner only
+	agreement, err := readAgreement(stub, agreementID)
+	assert.NoError(t, err)
+	agreement.Expiry -= 3600
+	b, _ := json.Marshal(agreement)
+	stub.State[agreementID] = b
+	assert.Equal(t, Simulation{OK: true}, canUnlock(agreementID))
+	stub.Creator = counterpartyIdentity
+	simulation = canUnlock(agreementID)
+	assert.False(t, simulation.OK)
+	assert.Contains(t, simulation.Reason, "not authorized")
+
+	// Settled agreements
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "Unlock", agreementID)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	simulation = canUnlock(agreementID)
+	assert.False(t, simulation.OK)
+	assert.Contains(t, simulation.Reason, "not found")
+}
+
+func TestStatus(t *testing.T) {
+	stub := newMockStub(&mockToken{capabilities: compatible})
+	status := func(agreementID string) AgreementStatus {
+		r := invokeMock(stub, "Status", agreementID)
+		assert.Equal(t, shim.OK, int(r.Status), r.Message)
+		var status AgreementStatus
+		assert.NoError(t, json.Unmarshal(r.Payload, &status))
+		return status
+	}
+	r := invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID := string(r.Payload)
+
+	// Active, before expiry
+	s := status(agreementID)
+	assert.Equal(t, statusActive, s.Status)
+	assert.True(t, s.Claimable)
+	assert.False(t, s.Unlockable)
+	assert.True(t, s.SecondsToExpiry > 3590 && s.SecondsToExpiry <= 3600)
+	assert.Equal(t, reasonNotExpired, s.ReasonCode)
+	assert.Contains(t, s.ReasonText, "is set to expire")
+
+	// Active, after expiry
+	agreement, err := readAgreement(stub, agreementID)
+	assert.NoError(t, err)
+	agreement.Expiry -= 3610
+	b, _ := json.Marshal(agreement)
+	stub.State[agreementID] = b
+	s = status(agreementID)
+	assert.Equal(t, statusActive, s.Status)
+	assert.False(t, s.Claimable)
+	assert.True(t, s.Unlockable)
+	assert.Equal(t, int64(0), s.SecondsToExpiry)
+	assert.Equal(t, reasonExpired, s.ReasonCode)
+	assert.Contains(t, s.ReasonText, "expired on")
+
+	// Unlocked
+	r = invokeMock(stub, "Unlock", agreementID)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	s = status(agreementID)
+	assert.Equal(t, eventUnlocked, s.Status)
+	assert.False(t, s.Claimable)
+	assert.False(t, s.Unlockable)
+	assert.Equal(t, eventUnlocked, s.ReasonCode)
+	assert.Contains(t, s.ReasonText, "was unlocked on")
+
+	// Claimed
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID = string(r.Payload)
+	stub.Creator = counterpartyIdentity
+	r = invokeMock(stub, "Claim", agreementID, "secret")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	s = status(agreementID)
+	assert.Equal(t, eventClaimed, s.Status)
+	assert.False(t, s.Claimable)
+	assert.False(t, s.Unlockable)
+	assert.Equal(t, eventClaimed, s.ReasonCode)
+
+	r = invokeMock(stub, "Status", "missing")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Equal(t, "Agreement missing not found", r.Message)
+}
+
+func TestTimeline(t *testing.T) {
+	token := &mockToken{capabilities: compatible}
+	stub := newMockStub(token)
+	timeline := func(agreementID string) []TimelineEvent {
+		r := invokeMock(stub, "Timeline", agreementID)
+		assert.Equal(t, shim.OK, int(r.Status), r.Message)
+		var events []TimelineEvent
+		assert.NoError(t, json.Unmarshal(r.Payload, &events))
+		return events
+	}
+	lock := func() string {
+		stub.Creator = ownerIdentity
+		r := invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600")
+		assert.Equal(t, shim.OK, int(r.Status), r.Message)
+		return string(r.Payload)
+	}
+
+	// Locked and claimed
+	agreementID := lock()
+	lockTx := strconv.Itoa(txID)
+	events := timeline(agreementID)
+	assert.Len(t, events, 1)
+	assert.Equal(t, TimelineEvent{Event: eventLocked, Actor: owner,
+		Timestamp: events[0].Timestamp, TxID: lockTx}, events[0])
+	stub.Creator = counterpartyIdentity
+	r := invokeMock(stub, "Claim", agreementID, "secret")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	events = timeline(agreementID)
+	assert.Len(t, events, 2)
+	assert.Equal(t, eventLocked, events[0].Event)
+	assert.Equal(t, TimelineEvent{Event: eventClaimed, Actor: counterparty,
+		Timestamp: events[1].Timestamp, TxID: strconv.Itoa(txID - 1)}, events[1])
+	assert.True(t, events[0].Timestamp <= events[1].Timestamp)
+
+	// Failed operations are not recorded
+	stub.Creator = ownerIdentity
+	invokeMock(stub, "Unlock", agreementID)
+	assert.Len(t, timeline(agreementID), 2)
+
+	// Locked and cancelled
+	agreementID = lock()
+	r = invokeMock(stub, "CancelEarly", agreementID)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	events = timeline(agreementID)
+	assert.Equal(t, []string{eventLocked, eventCancelled}, []string{events[0].Event, events[1].Event})
+	assert.Equal(t, owner, events[1].Actor)
+
+	// Locked and unlocked
+	agreementID = lock()
+	agreement, err := readAgreement(stub, agreementID)
+	assert.NoError(t, err)
+	agreement.Expiry -= 3600
+	b, _ := json.Marshal(agreement)
+	stub.State[agreementID] = b
+	r = invokeMock(stub, "Unlock", agreementID)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	events = timeline(agreementID)
+	assert.Equal(t, []string{eventLocked, eventUnlocked}, []string{events[0].Event, events[1].Event})
+
+	r = invokeMock(stub, "Timeline", "missing")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "No timeline recorded")
+}
+
+func TestAgreementNotFound(t *testing.T) {
+	stub := newMockStub(&mockToken{capabilities: compatible})
+
+	r := invokeMock(stub, "Unlock", "missing")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "Agreement missing not found")
+
+	stub.Creator = counterpartyIdentity
+	r = invokeMock(stub, "Claim", "missing", "secret")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "Agreement missing not found")
+}
+
+func TestAgreementsExpiringWithin(t *testing.T) {
+	stub := newMockStub(&mockToken{capabilities: compatible})
+	var ids []string
+	for i, lockTime := range []string{"3600", "60", "600", "300"} {
+		r := invokeMock(stub, "Lock", counterparty, imageOf([]byte(fmt.Sprint("secret", i))), "100", tokenName, lockTime)
+		assert.Equal(t, shim.OK, int(r.Status), r.Message)
+		ids = append(ids, string(r.Payload))
+	}
+	// Claimed agreements are no longer active
+	stub.Creator = counterpartyIdentity
+	r := invokeMock(stub, "Claim", ids[3], "secret3")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	r = invokeMock(stub, "AgreementsExpiringWithin", "1800")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	var entries []AgreementEntry
+	assert.NoError(t, json.Unmarshal(r.Payload, &entries))
+	assert.Len(t, entries, 2)
+	assert.Equal(t, ids[1], entries[0].AgreementID)
+	assert.Equal(t, ids[2], entries[1].AgreementID)
+	assert.Equal(t, owner, entries[0].Owner)
+
+	r = invokeMock(stub, "AgreementsExpiringWithin", "10")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, "[]", string(r.Payload))
+}
+
+func TestMetrics(t *testing.T) {
+	token := &mockToken{capabilities: compatible}
+	stub := newMockStub(token)
+
+	var counters map[string]uint64
+	r := invokeMock(stub, "Metrics")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.NoError(t, json.Unmarshal(r.Payload, &counters))
+	assert.Equal(t, map[string]uint64{"locks": 0, "unlocks": 0, "claims": 0, "cancellations": 0}, counters)
+
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID := string(r.Payload)
+	stub.Creator = counterpartyIdentity
+	r = invokeMock(stub, "Claim", agreementID, "secret")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "CancelEarly", string(r.Payload))
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	// Failed operations are only counted by the peer
+	r = invokeMock(stub, "Unlock", agreementID)
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	r = invokeMock(stub, "Unknown")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+
+	r = invokeMock(stub, "Metrics")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.NoError(t, json.Unmarshal(r.Payload, &counters))
+	assert.Equal(t, map[string]uint64{"locks": 2, "unlocks": 0, "claims": 1, "cancellations": 1}, counters)
+	r = invokeMock(stub, "Failures")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, "2", string(r.Payload))
+}
+
+func TestCompactMetrics(t *testing.T) {
+	stub := newMockStub(&mockToken{capabilities: compatible})
+	for i := 0; i < 3; i++ {
+		r := invokeMock(stub, "Lock", counterparty, imageOf([]byte(fmt.Sprintf("secret%d", i))), "100", tokenName, "3600")
+		assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	}
+	increments := func(name string) []string {
+		iter, err := stub.GetStateByPartialCompositeKey(metricIndex, []string{name})
+		assert.NoError(t, err)
+		defer iter.Close()
+		var values []string
+		for iter.HasNext() {
+			kv, _ := iter.Next()
+			values = append(values, string(kv.Value))
+		}
+		return values
+	}
+	assert.Equal(t, []string{"1", "1", "1"}, increments(metricLocks))
+
+	// Only the administrator may compact the counters
+	stub.Creator = counterpartyIdentity
+	r := invokeMock(stub, "CompactMetrics")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "not authorized")
+
+	// Lock counts and lock times are merged into a single key each
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "CompactMetrics")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, "6", string(r.Payload))
+	assert.Equal(t, []string{"3"}, increments(metricLocks))
+	assert.Equal(t, []string{"10800"}, increments(metricLockTime))
+
+	r = invokeMock(stub, "Analytics")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	var analytics Analytics
+	assert.NoError(t, json.Unmarshal(r.Payload, &analytics))
+	assert.Equal(t, uint64(3), analytics.Agreements)
+	assert.Equal(t, float64(3600), analytics.AverageLockTime)
+
+	r = invokeMock(stub, "CompactMetrics")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, "0", string(r.Payload))
+}
+
+func TestAnalytics(t *testing.T) {
+	stub := newMockStub(&mockToken{capabilities: compatible})
+	analytics := func() Analytics {
+		stub.Creator = ownerIdentity
+		r := invokeMock(stub, "Analytics")
+		assert.Equal(t, shim.OK, int(r.Status), r.Message)
+		var a Analytics
+		assert.NoError(t, json.Unmarshal(r.Payload, &a))
+		return a
+	}
+	lock := func(secret string, lockTime string) string {
+		stub.Creator = ownerIdentity
+		r := invokeMock(stub, "Lock", counterparty, imageOf([]byte(secret)), "100", tokenName, lockTime)
+		assert.Equal(t, shim.OK, int(r.Status), r.Message)
+		return string(r.Payload)
+	}
+	assert.Equal(t, Analytics{}, analytics())
+
+	// Only the administrator may fetch analytics
+	stub.Creator = counterpartyIdentity
+	r := invokeMock(stub, "Analytics")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "not authorized")
+
+	// Three agreements, two claimed and one unlocked
+	for _, secret := range []string{"secret1", "secret2"} {
+		agreementID := lock(secret, "3600")
+		stub.Creator = counterpartyIdentity
+		r = invokeMock(stub, "Claim", agreementID, secret)
+		assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	}
+	agreementID := lock("secret3", "7200")
+	agreement, err := readAgreement(stub, agreementID)
+	assert.NoError(t, err)
+	agreement.Expiry -= 7200
+	b, _ := json.Marshal(agreement)
+	stub.State[agreementID] = b
+	r = invokeMock(stub, "Unlock", agreementID)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, Analytics{Agreements: 3, AverageLockTime: 4800, Claims: 2, Unlocks: 1, ClaimRatio: 2.0 / 3},
+		analytics())
+
+	// Active agreements count towards the lock time only, and failed
+	// locks are not counted at all
+	lock("secret4", "")
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret5")), "100", tokenName, "30")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	a := analytics()
+	assert.Equal(t, uint64(4), a.Agreements)
+	assert.Equal(t, float64(2*3600+7200+defaultLockTime)/4, a.AverageLockTime)
+	assert.Equal(t, 2.0/3, a.ClaimRatio)
+}
+
+func TestPartialClaims(t *testing.T) {
+	token := &mockToken{capabilities: compatible}
+	stub := newMockStub(token)
+	claimed := func() htlc.Claimed {
+		event := lastEvent(stub)
+		assert.Equal(t, "Claimed", event.EventName)
+		var claimed htlc.Claimed
+		assert.NoError(t, json.Unmarshal(event.Payload, &claimed))
+		return claimed
+	}
+
+	r := invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID := string(r.Payload)
+	stub.Creator = counterpartyIdentity
+	r = invokeMock(stub, "ClaimPartial", agreementID, "0", "secret")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "zero amount")
+
+	// The agreement remains active until all tokens are claimed
+	r = invokeMock(stub, "ClaimPartial", agreementID, "40", "secret")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, "60", string(r.Payload))
+	assert.Contains(t, token.calls, []string{"Transfer", counterparty, "40"})
+	assert.Equal(t, htlc.Claimed{SchemaVersion: 2, AgreementID: agreementID, Secret: "secret", Amount: 40,
+		Remaining: 60}, claimed())
+	agreement, err := readAgreement(stub, agreementID)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(60), agreement.Amount)
+	assert.Equal(t, uint64(40), agreement.Claimed)
+
+	// The secret must match on every claim, and claims may not exceed
+	// the remaining amount
+	r = invokeMock(stub, "ClaimPartial", agreementID, "10", "secreT")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	r = invokeMock(stub, "ClaimPartial", agreementID, "61", "secret")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "exceeds the remaining amount of 60")
+
+	r = invokeMock(stub, "ClaimPartial", agreementID, "60", "secret")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, "0", string(r.Payload))
+	assert.Contains(t, token.calls, []string{"Transfer", counterparty, "60"})
+	assert.Equal(t, htlc.Claimed{SchemaVersion: 2, AgreementID: agreementID, Secret: "secret", Amount: 60}, claimed())
+	_, err = readAgreement(stub, agreementID)
+	assert.Error(t, err)
+	r = invokeMock(stub, "ClaimPartial", agreementID, "1", "secret")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+
+	// The secret is revealed once, and the agreement claimed once
+	r = invokeMock(stub, "RevealedSecrets", "0")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	var page RevealedSecretsPage
+	assert.NoError(t, json.Unmarshal(r.Payload, &page))
+	assert.Len(t, page.Secrets, 1)
+	var counters map[string]uint64
+	r = invokeMock(stub, "Metrics")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.NoError(t, json.Unmarshal(r.Payload, &counters))
+	assert.Equal(t, uint64(1), counters["claims"])
+
+	// Held tokens are released as a whole
+	token.capabilities = []string{tokens.CapTransfer, tokens.CapHold}
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600", `{"escrow": "hold"}`)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID = string(r.Payload)
+	stub.Creator = counterpartyIdentity
+	r = invokeMock(stub, "ClaimPartial", agreementID, "40", "secret")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "claimed in full")
+	r = invokeMock(stub, "ClaimPartial", agreementID, "100", "secret")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+}
+
+func TestHandlerCallerProps(t *testing.T) {
+	stub := newMockStub(&mockToken{capabilities: compatible})
+	r := invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	// Handlers may be called directly with constructed caller props
+	ccs := &CrossChainSwapChaincode{swap: &CrossChainSwap{config: &Config{DefaultLockTime: defaultLockTime}}}
+	props := &CallerProps{stub: stub}
+	r = ccs.ConfigHandler(props)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	var parameters Parameters
+	assert.NoError(t, json.Unmarshal(r.Payload, &parameters))
+	assert.Equal(t, int64(defaultLockTime), parameters.DefaultLockTime)
+	r = ccs.MetricsHandler(props)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, `{"cancellations":0,"claims":0,"locks":1,"unlocks":0}`, string(r.Payload))
+}
+
+func TestInvokeNoStateBleed(t *testing.T) {
+	cc := new(CrossChainSwapChaincode)
+	stub := shim.NewMockStub(ccName, cc)
+	stub.Creator = ownerIdentity
+	stub.MockPeerChaincode(tokenName, shim.NewMockStub(tokenName, &mockToken{capabilities: compatible}))
+	stub.MockInit("init", nil)
+	r := invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID := string(r.Payload)
+	assert.Nil(t, cc.swap)
+
+	// Each invocation reads the configuration afresh and resolves its
+	// own invoker
+	r = invokeMock(stub, "SetHashAlgorithm", htlc.HashSHA512)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreement, err := readAgreement(stub, string(r.Payload))
+	assert.NoError(t, err)
+	assert.Equal(t, htlc.HashSHA512, agreement.HashAlgorithm)
+	stub.Creator = counterpartyIdentity
+	r = invokeMock(stub, "Claim", agreementID, "secret")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "SetHashAlgorithm", htlc.HashSHA256)
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Nil(t, cc.swap)
+}
+
+func TestSwapCallerProps(t *testing.T) {
+	stub := newMockStub(&mockToken{capabilities: compatible})
+	r := invokeMock(stub, "Lock", counterparty, imageOf([]byte("secret")), "100", tokenName, "3600")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	agreementID := string(r.Payload)
+
+	// Swap methods operate on the caller props the swap is constructed
+	// with
+	cert, err := cid.GetX509Certificate(stub)
+	assert.NoError(t, err)
+	swap := &CrossChainSwap{config: &Config{}, caller: &CallerProps{cert: cert, stub: stub}}
+	agreement, err := swap.GetAgreement(agreementID)
+	assert.NoError(t, err)
+	assert.Equal(t, owner, agreement.Owner)
+	locked, err := swap.LockedBetween(owner, counterparty, tokenName)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(100), locked)
+}
+
+func TestRun(t *testing.T) {
+	defer func(start func(shim.Chaincode) error) { startChaincode = start }(startChaincode)
+
+	var started shim.Chaincode
+	startChaincode = func(cc shim.Chaincode) error {
+		started = cc
+		return fmt.Errorf("peer unreachable")
+	}
+	err := run()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Error starting CrossChainSwap: peer unreachable")
+	assert.IsType(t, new(CrossChainSwapChaincode), started)
+
+	startChaincode = func(cc shim.Chaincode) error { return nil }
+	assert.NoError(t, run())
+}
+
+// mockToken is a minimal token contract standing in for the token
+// chaincode invoked by the swap chaincode. It records all calls made
+// to it.
+type mockToken struct {
+	capabilities []string
+	allowance    uint64
+	supply       uint64
+	balance      uint64
+	fee          uint64
+	decimals     int
+	calls        [][]string
+}
+
+// format reports an amount with the decimals of the mock token.
+func (m *mockToken) format(amount uint64) []byte {
+	s := fmt.Sprintf("%0*d", m.decimals+1, amount)
+	if m.decimals == 0 {
+		return []byte(s)
+	}
+	return []byte(s[:len(s)-m.decimals] + "." + s[len(s)-m.decimals:])
+}
+
+func (m *mockToken) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	return shim.Success(nil)
+}
+
+func (m *mockToken) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	f, args := stub.GetFunctionAndParameters()
+	m.calls = append(m.calls, append([]string{f}, args...))
+	switch f {
+	case "Version":
+		b, _ := json.Marshal(tokens.Version{Version: "1.0.0", Capabilities: m.capabilities})
+		return shim.Success(b)
+	case "Transfer", "Hold", "Release":
+		return shim.Success(nil)
+	case "TransferFrom":
+		amount, err := stringToUint64(args[2])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if m.allowance > 0 && amount > m.allowance {
+			return shim.Error(fmt.Sprintf("Insufficient allowance of %d approved", m.allowance))
+		}
+		balance := m.balance + amount - m.fee
+		return shim.Success(m.format(balance))
+	case "BalanceOf":
+		return shim.Success(m.format(m.balance))
+	case "TokenSupply":
+		return shim.Success(m.format(m.supply))
+	case "Allowance":
+		return shim.Success([]byte(strconv.FormatUint(m.allowance, 10)))
+	}
+	return shim.Error(fmt.Sprintf("Unknown function %s", f))
+}
+
+func newMockStub(token *mockToken) *shim.MockStub {
+	stub := shim.NewMockStub(ccName, new(CrossChainSwapChaincode))
+	stub.Creator = ownerIdentity
+	tokenStub := shim.NewMockStub(tokenName, token)
+	tokenStub.Creator = ownerIdentity
+	stub.MockPeerChaincode(tokenName, tokenStub)
+	stub.MockInit("init", nil)
+	return stub
+}
+
+func invokeMock(stub *shim.MockStub, args ...string) pb.Response {
+	txID++
+	return stub.MockInvokeWithSignedProposal(strconv.Itoa(txID), byteArray(args...), newSignedProposal())
+}
+
+// newSignedProposal returns a signed proposal addressed to the swap
+// chaincode.
+func newSignedProposal() *pb.SignedProposal {
+	ext, _ := proto.Marshal(&pb.ChaincodeHeaderExtension{ChaincodeId: &pb.ChaincodeID{Name: ccName}})
+	b, _ := proto.Marshal(&pb.Proposal{Header: ext})
+	return &pb.SignedProposal{ProposalBytes: b}
+}
+
+// newIdentity returns a serialized identity backed by a freshly
+// generated certificate, along with the address derived from it.
+func newIdentity() ([]byte, string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1)}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	cert, _ := x509.ParseCertificate(der)
+	id := &msp.SerializedIdentity{
+		Mspid:   "Org1MSP",
+		IdBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+	b, _ := proto.Marshal(id)
+	return b, security.NewX509Certificate(cert).GetAddress()
+}
+
+// lastEvent returns the most recent event raised through the stub,
+// discarding any earlier events.
+func lastEvent(stub *shim.MockStub) *pb.ChaincodeEvent {
+	var event *pb.ChaincodeEvent
+	for {
+		select {
+		case event = <-stub.ChaincodeEventsChannel:
+		default:
+			return event
+		}
+	}
+}
+
+// assertExpiry asserts that an agreement expires after the given lock
+// time, measured from the timestamp of the last transaction.
+func assertExpiry(t *testing.T, stub *shim.MockStub, agreementID string, lockTime int64) {
+	agreement, err := readAgreement(stub, agreementID)
+	assert.NoError(t, err)
+	ts, _ := stub.GetTxTimestamp()
+	assert.Equal(t, ts.GetSeconds()+lockTime, agreement.Expiry)
+}
+
+func readConfig(stub *shim.MockStub) (*Config, error) {
+	var config Config
+	var b []byte
+	var ok bool
+	if b, ok = stub.State[configKey]; !ok {
+		return nil, fmt.Errorf("Error reading configuration")
+	}
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("Error unmarshaling configuration")
+	}
+	return &config, nil
+}
+
+func readAgreement(stub *shim.MockStub, agreementID string) (*Agreement, error) {
+	var agreement Agreement
+	var b []byte
+	var ok bool
+	if b, ok = stub.State[agreementID]; !ok {
+		return nil, fmt.Errorf("Error reading agreement")
+	}
+	if err := json.Unmarshal(b, &agreement); err != nil {
+		return nil, fmt.Errorf("Error unmarshaling agreement")
+	}
+	return &agreement, nil
+}
+
+func byteArray(s ...string) [][]byte {
+	args := make([][]byte, len(s))
+	for i, v := range s {
+		args[i] = []byte(v)
+	}
+	return args
+}
+
+func FuzzParseAmount(f *testing.F) {
+	for _, seed := range []string{
+		"0", "150", "1.50", "0.05", "007", "18446744073709551615", "18446744073709551616",
+		"", ".", "1.", ".5", "1.2.3", "-1", "+1", " 1", "1_000", "0x10", "١٢٣", "１２", "1e3",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		amount, err := parseAmount([]byte(s))
+		if err != nil {
+			return
+		}
+		// Valid amounts are ASCII digits with at most one decimal
+		// point between digits
+		point := strings.IndexByte(s, '.')
+		if point == 0 || point == len(s)-1 {
+			t.Fatalf("Accepted amount %q with a bare decimal point", s)
+		}
+		digits := strings.Replace(s, ".", "", 1)
+		for _, c := range digits {
+			if c < '0' || c > '9' {
+				t.Fatalf("Accepted amount %q with non-digit %q", s, c)
+			}
+		}
+		// and round-trip to the same amount in the smallest unit
+		trimmed := strings.TrimLeft(digits, "0")
+		if trimmed == "" {
+			trimmed = "0"
+		}
+		if formatted := strconv.FormatUint(amount, 10); formatted != trimmed {
+			t.Fatalf("Amount %q parsed as %s", s, formatted)
+		}
+	})
+}
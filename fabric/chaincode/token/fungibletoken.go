@@ -3,6 +3,8 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+
+	"github.com/dileban/atomic-swaps/fabric/lib/merkle"
 )
 
 // Token implements SimpleToken interface and represents basic
@@ -16,32 +18,203 @@ type Token struct {
 	// Name of the token being represented, e.g. "Fabric USD".
 	Name string `json:"name"`
 
-	// Decimals allows for fractional tranfers.
-	// [NOTE]: Currently not implemented.
+	// Decimals allows for fractional tranfers. Amounts are kept in the
+	// smallest unit and only formatted with decimals for display.
 	Decimals uint64 `json:"decimals"`
 
-	// Supply is the total token supply, fixed at the time of creation.
+	// Supply is the total token supply, fixed at the time of creation
+	// unless the token is mintable, and reduced as tokens are burned.
+	// The supply, like all amounts, is in the smallest unit of the
+	// token, i.e. 10^-Decimals of a token.
 	Supply uint64 `json:"supply"`
+
+	// Admin is the address permitted to administer the token. This is
+	// the initial owner of the token supply, and the minter of
+	// mintable tokens.
+	Admin string `json:"admin"`
+
+	// Mintable indicates whether the supply may be increased after
+	// creation.
+	Mintable bool `json:"mintable"`
+
+	// Whitelist restricts transfers to recipients on the allowlist
+	// maintained by the administrator.
+	Whitelist bool `json:"whitelist"`
+
+	// TransfersEnabledAt is the time (wall clock) before which tokens
+	// may only be transferred or approved by the administrator.
+	TransfersEnabledAt int64 `json:"transfersEnabledAt,omitempty"`
+
+	// MaxAllowance caps the amount any single spender may be approved
+	// to transfer from an owner. Zero means allowances are not capped.
+	MaxAllowance uint64 `json:"maxAllowance,omitempty"`
+
+	// MaxBatchRecipients caps the number of recipients of a single
+	// batch transfer. Zero means the default of maxBatchRecipients.
+	MaxBatchRecipients int `json:"maxBatchRecipients,omitempty"`
+
+	// Paused halts all transfers, burns and approvals, including those
+	// of the administrator, e.g. during an incident.
+	Paused bool `json:"paused,omitempty"`
+
+	// caller is the context of the invocation operating on the token.
+	caller *CallerProps
 }
 
-// Balance represents the tokens available for spending by an 'owner'
-// as well as a list of approved transfers by other 'spenders' from
-// the 'owners' account.
+// Balance represents the tokens available for spending by an
+// 'owner'.
+//
+// Amounts approved for transferring by other 'spenders' from the
+// 'owners' account are kept under separate keys (see
+// allowanceIndex). Approvals therefore never read or write the
+// balance, and do not conflict with concurrent transfers.
 type Balance struct {
-	// Approved is the amount approved for transferring by a 'spender'
-	// if sufficient balance is available.
-	Approved map[string]uint64 `json:"approved"`
-
 	// Available is the current token balance avaiable for spending by
 	// the 'owner'.
 	Available uint64 `json:"available"`
 }
 
+// Holder represents the balance available to a token holder.
+type Holder struct {
+	Address   string `json:"address"`
+	Available uint64 `json:"available"`
+}
+
+// BalanceChange represents a write to the balance of an address, as
+// recorded by the ledger's history. Deleted balances have no amount.
+type BalanceChange struct {
+	TxID      string `json:"txId"`
+	Timestamp int64  `json:"timestamp"`
+	Available uint64 `json:"available"`
+	Deleted   bool   `json:"deleted,omitempty"`
+}
+
+// SupplyBreakdown divides the token supply, in the smallest unit, into
+// the tokens in circulation, the tokens held in custody by chaincodes
+// (locked) and the tokens transferred to the burn address (burned).
+type SupplyBreakdown struct {
+	Total       uint64 `json:"total"`
+	Circulating uint64 `json:"circulating"`
+	Locked      uint64 `json:"locked"`
+	Burned      uint64 `json:"burned"`
+}
+
+// BalanceProof proves the balance of an address against the Merkle
+// root of all balances. Hashes are base64 encoded in JSON.
+type BalanceProof struct {
+	Address   string        `json:"address"`
+	Available uint64        `json:"available"`
+	Root      []byte        `json:"root"`
+	Proof     []merkle.Step `json:"proof"`
+}
+
+// tokenKey is the key under which the token is stored on the ledger.
+// All other simple keys hold balances.
+const tokenKey = "token"
+
+// firstSimpleKey and lastSimpleKey bound the range of simple keys.
+// Composite keys begin with 0x00 and sort before the range.
+const (
+	firstSimpleKey = "\x01"
+	lastSimpleKey  = "\U0010FFFF"
+)
+
+// burnAddress is the address to which tokens are transferred to take
+// them out of circulation. No identity holds its key.
+const burnAddress = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// chaincodeAddressPrefix is the prefix of the addresses of chaincodes
+// holding tokens in custody, and firstChaincodeKey and lastChaincodeKey
+// bound the range of their balances.
+const (
+	chaincodeAddressPrefix = "cc:"
+	firstChaincodeKey      = chaincodeAddressPrefix
+	lastChaincodeKey       = "cc;"
+)
+
+// allowanceIndex is the object type of composite keys holding the
+// amount approved for transferring by a 'spender' from an 'owner'.
+const allowanceIndex = "allowance"
+
+// spentIndex is the object type of composite keys holding the
+// cumulative amount transferred by a 'spender' from an 'owner' using
+// TransferFrom.
+const spentIndex = "spent"
+
+// allowlistIndex is the object type of composite keys marking
+// addresses permitted to receive tokens when the token is in
+// whitelist mode.
+const allowlistIndex = "allowlist"
+
+// aliasIndex is the object type of composite keys holding the
+// human-readable names registered for addresses by the administrator.
+const aliasIndex = "alias"
+
+// genesisIndex is the object type of composite keys holding the
+// amounts allocated to the initial owners when the token was
+// initialized, as decimal strings.
+const genesisIndex = "genesis"
+
+// frozenIndex is the object type of composite keys marking addresses
+// frozen by the administrator, which may neither send nor receive
+// tokens.
+const frozenIndex = "frozen"
+
+// maxAliasLength is the maximum length of the name registered for an
+// address.
+const maxAliasLength = 64
+
 // TokenSupply returns the total token supply.
 func (t *Token) TokenSupply() (uint64, error) {
 	return t.Supply, nil
 }
 
+// CirculatingSupply returns the token supply, in the smallest unit,
+// less the tokens taken out of circulation: tokens transferred to the
+// burn address and tokens held in custody by chaincodes, such as the
+// swap chaincode.
+func (t *Token) CirculatingSupply() (uint64, error) {
+	breakdown, err := t.SupplyBreakdown()
+	if err != nil {
+		return 0, err
+	}
+	return breakdown.Circulating, nil
+}
+
+// SupplyBreakdown returns the token supply divided into the tokens in
+// circulation, locked and burned. Tokens locked by the swap chaincode
+// are held at its chaincode address on this ledger, so the breakdown
+// is read without invoking other chaincodes.
+func (t *Token) SupplyBreakdown() (*SupplyBreakdown, error) {
+	burned, err := t.getBalance(burnAddress)
+	if err != nil {
+		return nil, err
+	}
+	breakdown := &SupplyBreakdown{Total: t.Supply, Burned: burned.Available}
+	iter, err := t.caller.stub.GetStateByRange(firstChaincodeKey, lastChaincodeKey)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		var bal Balance
+		if err = json.Unmarshal(kv.Value, &bal); err != nil {
+			return nil, err
+		}
+		breakdown.Locked += bal.Available
+	}
+	held := breakdown.Burned + breakdown.Locked
+	if held > t.Supply {
+		return nil, fmt.Errorf("Tokens out of circulation exceed the supply")
+	}
+	breakdown.Circulating = t.Supply - held
+	return breakdown, nil
+}
+
 // BalanceOf returns the token balance of the specified owner.
 func (t *Token) BalanceOf(owner string) (uint64, error) {
 	var bal *Balance
@@ -52,15 +225,298 @@ func (t *Token) BalanceOf(owner string) (uint64, error) {
 	return bal.Available, nil
 }
 
+// SumBalances returns the combined token balance of the specified
+// owners.
+func (t *Token) SumBalances(owners []string) (uint64, error) {
+	var total uint64
+	for _, owner := range owners {
+		bal, err := t.getBalance(owner)
+		if err != nil {
+			return 0, err
+		}
+		total += bal.Available
+	}
+	return total, nil
+}
+
+// GetHistoryForAddress returns the changes to the balance of an
+// address in the order they were committed, oldest first. The history
+// is only available on peers with the history database enabled, and
+// excludes writes made by the current transaction.
+func (t *Token) GetHistoryForAddress(address string) ([]BalanceChange, error) {
+	if err := checkAddress(address); err != nil {
+		return nil, err
+	}
+	iter, err := t.caller.stub.GetHistoryForKey(address)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+	changes := []BalanceChange{}
+	for iter.HasNext() {
+		km, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		change := BalanceChange{TxID: km.TxId, Deleted: km.IsDelete}
+		if km.Timestamp != nil {
+			change.Timestamp = km.Timestamp.Seconds
+		}
+		if !km.IsDelete {
+			var bal Balance
+			if err = json.Unmarshal(km.Value, &bal); err != nil {
+				return nil, err
+			}
+			change.Available = bal.Available
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// ListHolders returns up to 'pageSize' token holders with a nonzero
+// balance, in order of their addresses, starting at the 'bookmark'
+// address. The bookmark for the next page is returned along with the
+// holders, and is empty once all holders have been listed.
+func (t *Token) ListHolders(bookmark string, pageSize int) ([]Holder, string, error) {
+	return t.listBalances(bookmark, pageSize, false)
+}
+
+// ExportBalances returns up to 'pageSize' balances, including empty
+// ones, in order of their addresses, starting at the 'bookmark'
+// address. The bookmark for the next page is returned along with the
+// balances, and is empty once all balances have been exported.
+//
+// All balances within a page are read from the same snapshot of the
+// ledger. Balances may change between pages, and exports are
+// therefore only consistent while no transfers take place.
+func (t *Token) ExportBalances(bookmark string, pageSize int) ([]Holder, string, error) {
+	if err := t.checkAdmin(); err != nil {
+		return nil, "", err
+	}
+	return t.listBalances(bookmark, pageSize, true)
+}
+
+// ImportBalances restores balances previously exported using
+// ExportBalances. The balances must add up to the total token supply,
+// and addresses are validated as the recipients of transfers are.
+// Balances are only restored into the token as initialized, while
+// balances are as allocated to the initial owners and no allowance
+// has been approved, unless forced. Forcing an import overwrites the
+// listed balances and leaves balances not listed untouched, which may
+// break the total supply.
+func (t *Token) ImportBalances(balances []Holder, force bool) error {
+	if err := t.checkAdmin(); err != nil {
+		return err
+	}
+	var total uint64
+	seen := make(map[string]bool)
+	for _, h := range balances {
+		if err := checkAddress(h.Address); err != nil {
+			return err
+		}
+		if seen[h.Address] {
+			return fmt.Errorf("Balance of %s listed more than once", h.Address)
+		}
+		seen[h.Address] = true
+		if total+h.Available < total {
+			return fmt.Errorf("Balances exceed the total supply of %d", t.Supply)
+		}
+		total += h.Available
+	}
+	if total != t.Supply {
+		return fmt.Errorf("Balances add up to %d, not the total supply of %d", total, t.Supply)
+	}
+	if !force {
+		if err := t.checkGenesis(); err != nil {
+			return err
+		}
+	}
+	// The administrator's balance is replaced even if not listed
+	if !seen[t.Admin] {
+		balances = append(balances, Holder{Address: t.Admin})
+	}
+	for _, h := range balances {
+		if err := t.putBalance(h.Address, &Balance{Available: h.Available}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkGenesis returns an error unless balances are exactly as
+// allocated to the initial owners and no allowance is approved, i.e.
+// the token is as initialized. Tokens initialized before allocations
+// were recorded are never considered as initialized.
+func (t *Token) checkGenesis() error {
+	live := fmt.Errorf("Balances have changed since initialization, refusing to overwrite live balances")
+	genesis := make(map[string]uint64)
+	iter, err := t.caller.stub.GetStateByPartialCompositeKey(genesisIndex, []string{})
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return err
+		}
+		_, attrs, err := t.caller.stub.SplitCompositeKey(kv.Key)
+		if err != nil {
+			return err
+		}
+		if genesis[attrs[0]], err = stringToUint64(string(kv.Value)); err != nil {
+			return err
+		}
+	}
+	balances, err := t.caller.stub.GetStateByRange(firstSimpleKey, lastSimpleKey)
+	if err != nil {
+		return err
+	}
+	defer balances.Close()
+	n := 0
+	for balances.HasNext() {
+		kv, err := balances.Next()
+		if err != nil {
+			return err
+		}
+		if kv.Key == tokenKey {
+			continue
+		}
+		var bal Balance
+		if err = json.Unmarshal(kv.Value, &bal); err != nil {
+			return err
+		}
+		amount, ok := genesis[kv.Key]
+		if !ok || bal.Available != amount {
+			return live
+		}
+		n++
+	}
+	if n != len(genesis) || len(genesis) == 0 {
+		return live
+	}
+	allowances, err := t.caller.stub.GetStateByPartialCompositeKey(allowanceIndex, []string{})
+	if err != nil {
+		return err
+	}
+	defer allowances.Close()
+	if allowances.HasNext() {
+		return live
+	}
+	return nil
+}
+
+// BalancesMerkleRoot returns the Merkle root of all nonzero balances
+// in order of their addresses, allowing a balance to be verified
+// against a published root using BalanceProof. Each leaf is the hash
+// of the balance, as 8 little-endian bytes, followed by the address.
+func (t *Token) BalancesMerkleRoot() ([]byte, error) {
+	_, leaves, err := t.balanceLeaves()
+	if err != nil {
+		return nil, err
+	}
+	return merkle.Root(leaves), nil
+}
+
+// BalanceProof returns the balance of an address along with the proof
+// of the balance against the Merkle root of all nonzero balances.
+func (t *Token) BalanceProof(address string) (*BalanceProof, error) {
+	holders, leaves, err := t.balanceLeaves()
+	if err != nil {
+		return nil, err
+	}
+	for i, h := range holders {
+		if h.Address != address {
+			continue
+		}
+		proof, err := merkle.Proof(leaves, i)
+		if err != nil {
+			return nil, err
+		}
+		return &BalanceProof{Address: address, Available: h.Available,
+			Root: merkle.Root(leaves), Proof: proof}, nil
+	}
+	return nil, fmt.Errorf("No balance held by %s", address)
+}
+
+// balanceLeaves returns all nonzero balances in order of their
+// addresses, along with the Merkle leaf hashes of the balances.
+func (t *Token) balanceLeaves() ([]Holder, [][]byte, error) {
+	holders, _, err := t.listBalances("", -1, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	leaves := make([][]byte, len(holders))
+	for i, h := range holders {
+		leaves[i] = merkle.LeafHash(append(uint64ToBytes(h.Available), h.Address...))
+	}
+	return holders, leaves, nil
+}
+
+// listBalances returns a page of balances starting at the 'bookmark'
+// address, along with the bookmark for the next page. Empty balances
+// are only included if requested. A negative page size lists all
+// balances in a single page.
+func (t *Token) listBalances(bookmark string, pageSize int, includeEmpty bool) ([]Holder, string, error) {
+	if bookmark == "" {
+		bookmark = firstSimpleKey
+	}
+	iter, err := t.caller.stub.GetStateByRange(bookmark, lastSimpleKey)
+	if err != nil {
+		return nil, "", err
+	}
+	defer iter.Close()
+	holders := []Holder{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, "", err
+		}
+		if len(holders) == pageSize {
+			return holders, kv.Key, nil
+		}
+		if kv.Key == tokenKey {
+			continue
+		}
+		var bal Balance
+		if err = json.Unmarshal(kv.Value, &bal); err != nil {
+			return nil, "", err
+		}
+		if bal.Available > 0 || includeEmpty {
+			holders = append(holders, Holder{Address: kv.Key, Available: bal.Available})
+		}
+	}
+	return holders, "", nil
+}
+
 // Transfer transfers tokens from the invoker to the specified
 // address. The invoker must have sufficient funds to transfer. The
 // function returns and error if the transfer unsuccessful.
+//
+// Reads on the ledger return the last committed state and do not
+// reflect writes made earlier in the same transaction. Balances are
+// therefore read and written as separate read-modify-write steps that
+// are only safe when sender and receiver are distinct keys. A
+// transfer to self is a no-op once funds have been checked.
 func (t *Token) Transfer(to string, amount uint64) error {
 	if amount == 0 {
 		return fmt.Errorf("Attempting to transfer zero amount")
 	}
+	if err := t.checkRecipient(to); err != nil {
+		return err
+	}
 	// Get invoker's current balance
-	sender := getInvokerAddress()
+	sender := getInvokerAddress(t.caller)
+	if err := t.checkNotPaused(); err != nil {
+		return err
+	}
+	if err := t.checkTransfersEnabled(sender); err != nil {
+		return err
+	}
+	if err := t.checkNotFrozen(sender, to); err != nil {
+		return err
+	}
 	bal, err := t.getBalance(sender)
 	if err != nil {
 		return err
@@ -69,6 +525,10 @@ func (t *Token) Transfer(to string, amount uint64) error {
 	if bal.Available < amount {
 		return fmt.Errorf("Insufficient balance for %s", sender)
 	}
+	// Sender and receiver share the same key, nothing to move
+	if to == sender {
+		return nil
+	}
 	// Update sender's balance
 	bal.Available -= amount
 	if err = t.putBalance(sender, bal); err != nil {
@@ -89,78 +549,689 @@ func (t *Token) Transfer(to string, amount uint64) error {
 // Approve will allow 'spender' to transfer 'amount' tokens from the
 // invoker (owner) by calling TransferFrom. Calling Approve multiple
 // times will overwrite the previous amount.
+//
+// Each allowance is kept under its own key, and Approve reads neither
+// the owner's balance nor other allowances. Concurrent approvals by
+// the same owner to different spenders therefore both commit.
 func (t *Token) Approve(spender string, amount uint64) error {
+	// Overwrite previously approved amount if any
+	sender := getInvokerAddress(t.caller)
+	if err := t.checkApproval(sender, spender, amount); err != nil {
+		return err
+	}
+	return t.putAllowance(sender, spender, amount)
+}
+
+// checkApproval returns an error if 'sender' may not allow 'spender'
+// to transfer 'amount' tokens from its address.
+func (t *Token) checkApproval(sender string, spender string, amount uint64) error {
 	if amount == 0 {
 		return fmt.Errorf("Attempting to approve zero amount")
 	}
-	// Get invoker's current balance
-	sender := getInvokerAddress()
+	if err := checkSpender(spender); err != nil {
+		return err
+	}
+	if err := t.checkNotPaused(); err != nil {
+		return err
+	}
+	if err := t.checkTransfersEnabled(sender); err != nil {
+		return err
+	}
+	return t.checkAllowanceCap(amount)
+}
+
+// SafeApprove behaves as Approve, but rejects approving more tokens
+// than the invoker currently holds. Unlike Approve, SafeApprove reads
+// the invoker's balance and may therefore conflict with concurrent
+// transfers.
+func (t *Token) SafeApprove(spender string, amount uint64) error {
+	if amount == 0 {
+		return fmt.Errorf("Attempting to approve zero amount")
+	}
+	if err := checkSpender(spender); err != nil {
+		return err
+	}
+	sender := getInvokerAddress(t.caller)
+	if err := t.checkNotPaused(); err != nil {
+		return err
+	}
+	if err := t.checkTransfersEnabled(sender); err != nil {
+		return err
+	}
 	bal, err := t.getBalance(sender)
 	if err != nil {
 		return err
 	}
-	if bal.Approved == nil {
-		bal.Approved = make(map[string]uint64)
+	if bal.Available < amount {
+		return fmt.Errorf("Approved amount exceeds balance of %s", sender)
+	}
+	if err := t.checkAllowanceCap(amount); err != nil {
+		return err
+	}
+	return t.putAllowance(sender, spender, amount)
+}
+
+// IncreaseAllowance increases the amount 'spender' may transfer from
+// the invoker (owner) by 'delta'. Approve overwrites the allowance, and
+// a spender may transfer the previous allowance before a change takes
+// effect and the new allowance after. Adjusting the allowance instead
+// leaves no such window.
+func (t *Token) IncreaseAllowance(spender string, delta uint64) error {
+	_, err := t.adjustAllowance(spender, delta, true)
+	return err
+}
+
+// DecreaseAllowance decreases the amount 'spender' may transfer from
+// the invoker (owner) by 'delta'. Decreasing the allowance below zero
+// is an error, since the spender may have transferred part of the
+// allowance the invoker meant to revoke.
+func (t *Token) DecreaseAllowance(spender string, delta uint64) error {
+	_, err := t.adjustAllowance(spender, delta, false)
+	return err
+}
+
+// Revoke removes the allowance of 'spender' to transfer tokens from
+// the invoker (owner), returning the amount that was revoked. Revoking
+// an allowance that does not exist, or has been spent in full, is a
+// no-op and revokes zero. Unlike approvals, allowances may be revoked
+// while the token is paused, since revoking only reduces what may be
+// transferred.
+func (t *Token) Revoke(spender string) (uint64, error) {
+	sender := getInvokerAddress(t.caller)
+	approved, err := t.getAllowance(sender, spender)
+	if err != nil {
+		return 0, err
+	}
+	if approved == 0 {
+		return 0, nil
+	}
+	return approved, t.putAllowance(sender, spender, 0)
+}
+
+// adjustAllowance implements IncreaseAllowance and DecreaseAllowance,
+// returning the allowance following the adjustment.
+func (t *Token) adjustAllowance(spender string, delta uint64, increase bool) (uint64, error) {
+	if delta == 0 {
+		return 0, fmt.Errorf("Attempting to adjust allowance by zero amount")
+	}
+	if err := checkSpender(spender); err != nil {
+		return 0, err
+	}
+	sender := getInvokerAddress(t.caller)
+	if err := t.checkNotPaused(); err != nil {
+		return 0, err
+	}
+	if err := t.checkTransfersEnabled(sender); err != nil {
+		return 0, err
+	}
+	approved, err := t.getAllowance(sender, spender)
+	if err != nil {
+		return 0, err
+	}
+	if increase {
+		if approved+delta < approved {
+			return 0, fmt.Errorf("Increased allowance overflows")
+		}
+		approved += delta
+		if err := t.checkAllowanceCap(approved); err != nil {
+			return 0, err
+		}
+	} else {
+		if delta > approved {
+			return 0, fmt.Errorf("Decreased allowance below zero, %d approved for %s", approved, spender)
+		}
+		approved -= delta
+	}
+	return approved, t.putAllowance(sender, spender, approved)
+}
+
+// BatchTransfer transfers tokens from the invoker to each of the
+// recipients, debiting the invoker once for the total amount. The
+// total is checked before any state is written, so either all
+// transfers take effect or none does.
+//
+// Since reads do not reflect writes made earlier in the same
+// transaction, amounts for a recipient listed more than once are
+// credited together, and amounts transferred to the invoker are not
+// debited.
+func (t *Token) BatchTransfer(recipients []string, amounts []uint64) error {
+	if len(recipients) != len(amounts) {
+		return fmt.Errorf("Expected as many amounts as recipients, got %d recipients and %d amounts",
+			len(recipients), len(amounts))
+	}
+	if len(recipients) == 0 {
+		return fmt.Errorf("No recipients specified")
+	}
+	if limit := t.batchRecipientsLimit(); len(recipients) > limit {
+		return fmt.Errorf("Cannot transfer to more than %d recipients at once, split the batch into chunks of at most %d recipients",
+			limit, limit)
+	}
+	sender := getInvokerAddress(t.caller)
+	if err := t.checkNotPaused(); err != nil {
+		return err
+	}
+	if err := t.checkTransfersEnabled(sender); err != nil {
+		return err
+	}
+	if err := t.checkNotFrozen(sender); err != nil {
+		return err
+	}
+	var total uint64
+	var order []string
+	credits := make(map[string]uint64)
+	for i, to := range recipients {
+		if amounts[i] == 0 {
+			return fmt.Errorf("Attempting to transfer zero amount to %s", to)
+		}
+		if err := t.checkRecipient(to); err != nil {
+			return err
+		}
+		if err := t.checkNotFrozen(to); err != nil {
+			return err
+		}
+		if total+amounts[i] < total {
+			return fmt.Errorf("Total amount of the batch overflows")
+		}
+		total += amounts[i]
+		if _, ok := credits[to]; !ok {
+			order = append(order, to)
+		}
+		credits[to] += amounts[i]
+	}
+	bal, err := t.getBalance(sender)
+	if err != nil {
+		return err
+	}
+	if bal.Available < total {
+		return fmt.Errorf("Insufficient balance for %s", sender)
+	}
+	// Amounts transferred to self stay with the sender
+	bal.Available -= total - credits[sender]
+	if err = t.putBalance(sender, bal); err != nil {
+		return err
+	}
+	for _, to := range order {
+		if to == sender {
+			continue
+		}
+		if bal, err = t.getBalance(to); err != nil {
+			return err
+		}
+		bal.Available += credits[to]
+		if err = t.putBalance(to, bal); err != nil {
+			return err
+		}
 	}
-	// Overwrite previously approved amount if any
-	bal.Approved[spender] = amount
 	return nil
 }
 
+// TransferAndApprove transfers tokens from the invoker to the
+// specified address and allows 'spender' to transfer 'approved'
+// tokens from the invoker in one call. The approval is checked before
+// the transfer, which checks the amount before writing any state, so
+// either both take effect or neither does.
+func (t *Token) TransferAndApprove(to string, amount uint64, spender string, approved uint64) error {
+	sender := getInvokerAddress(t.caller)
+	if err := t.checkApproval(sender, spender, approved); err != nil {
+		return err
+	}
+	if err := t.Transfer(to, amount); err != nil {
+		return err
+	}
+	return t.putAllowance(sender, spender, approved)
+}
+
 // TransferFrom allows the invoker to transfer up to 'amount' tokens
 // from the owner's ('from') account to the receiver's ('to')
 // account. The invoker is allowed to call TransferFrom multiple times
 // as long as there are sufficient funds.
+//
+// As with Transfer, a transfer from an owner to itself must not read
+// and write the same balance twice. Only the allowance is consumed in
+// that case.
 func (t *Token) TransferFrom(from string, to string, amount uint64) error {
+	_, err := t.transferFrom(from, to, amount)
+	return err
+}
+
+// transferFrom implements TransferFrom, returning the receiver's
+// balance following the transfer. Since writes are not visible to
+// reads within a transaction, the balance cannot otherwise be queried
+// by the invoker in the same transaction.
+func (t *Token) transferFrom(from string, to string, amount uint64) (uint64, error) {
 	if amount == 0 {
-		return fmt.Errorf("Attempting to transfer zero amount")
+		return 0, fmt.Errorf("Attempting to transfer zero amount")
+	}
+	if from == "" {
+		return 0, fmt.Errorf("Owner address must not be empty")
+	}
+	if err := t.checkRecipient(to); err != nil {
+		return 0, err
+	}
+	if err := t.checkNotPaused(); err != nil {
+		return 0, err
+	}
+	if err := t.checkTransfersEnabled(from); err != nil {
+		return 0, err
 	}
-	// Get 'from's current balance
+	if err := t.checkNotFrozen(from, to); err != nil {
+		return 0, err
+	}
+	// Get 'from's current balance and the sender's allowance
 	bal, err := t.getBalance(from)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	sender := getInvokerAddress(t.caller)
+	approved, err := t.getAllowance(from, sender)
+	if err != nil {
+		return 0, err
 	}
 	// Check if sender is eligble to transfer tokens
-	sender := getInvokerAddress()
-	if bal.Approved[sender] < amount {
-		return fmt.Errorf("Insufficent balance approved for %s", sender)
+	if approved < amount {
+		return 0, fmt.Errorf("Insufficent balance approved for %s", sender)
 	}
 	if bal.Available < amount {
-		return fmt.Errorf("Insufficient balance for %s", sender)
+		return 0, fmt.Errorf("Insufficient balance for %s", sender)
+	}
+	// Consume the sender's allowance
+	if err = t.putAllowance(from, sender, approved-amount); err != nil {
+		return 0, err
+	}
+	spent, err := t.getSpent(from, sender)
+	if err != nil {
+		return 0, err
+	}
+	if err = t.putSpent(from, sender, spent+amount); err != nil {
+		return 0, err
+	}
+	if from == to {
+		return bal.Available, nil
 	}
 	// Update 'from's balance
-	bal.Approved[sender] -= amount
 	bal.Available -= amount
 	if err = t.putBalance(from, bal); err != nil {
-		return err
+		return 0, err
 	}
 	// Update 'to's balance
 	if bal, err = t.getBalance(to); err != nil {
+		return 0, err
+	}
+	bal.Available += amount
+	if err = t.putBalance(to, bal); err != nil {
+		return 0, err
+	}
+	return bal.Available, nil
+}
+
+// Mint creates 'amount' new tokens and credits them to the specified
+// address, increasing the total supply. Only the token administrator
+// may mint tokens, and only if the token is mintable.
+func (t *Token) Mint(to string, amount uint64) error {
+	if err := t.checkAdmin(); err != nil {
+		return err
+	}
+	if !t.Mintable {
+		return fmt.Errorf("Token is not mintable")
+	}
+	if amount == 0 {
+		return fmt.Errorf("Attempting to mint zero amount")
+	}
+	if err := t.checkRecipient(to); err != nil {
+		return err
+	}
+	// Balances never exceed the supply, checking the supply suffices
+	if t.Supply+amount < t.Supply {
+		return fmt.Errorf("Minting %d tokens exceeds the maximum supply", amount)
+	}
+	bal, err := t.getBalance(to)
+	if err != nil {
 		return err
 	}
 	bal.Available += amount
 	if err = t.putBalance(to, bal); err != nil {
 		return err
 	}
-	return nil
+	t.Supply += amount
+	return t.putToken()
+}
+
+// Burn destroys 'amount' tokens held by the invoker, reducing the
+// total supply. Unlike transferring tokens to the burn address, the
+// tokens no longer count towards the supply. Like transfers, burning
+// is rejected while the token is paused or for frozen addresses.
+func (t *Token) Burn(amount uint64) error {
+	if amount == 0 {
+		return fmt.Errorf("Attempting to burn zero amount")
+	}
+	owner := getInvokerAddress(t.caller)
+	if err := t.checkNotPaused(); err != nil {
+		return err
+	}
+	if err := t.checkNotFrozen(owner); err != nil {
+		return err
+	}
+	bal, err := t.getBalance(owner)
+	if err != nil {
+		return err
+	}
+	if bal.Available < amount {
+		return fmt.Errorf("Insufficient balance for %s", owner)
+	}
+	bal.Available -= amount
+	if err = t.putBalance(owner, bal); err != nil {
+		return err
+	}
+	t.Supply -= amount
+	return t.putToken()
+}
+
+// Transferable returns the amount of tokens the invoker may transfer
+// from the owner's account using TransferFrom, i.e. the remaining
+// allowance capped by the owner's available balance.
+func (t *Token) Transferable(owner string) (uint64, error) {
+	approved, err := t.getAllowance(owner, getInvokerAddress(t.caller))
+	if err != nil {
+		return 0, err
+	}
+	bal, err := t.getBalance(owner)
+	if err != nil {
+		return 0, err
+	}
+	if bal.Available < approved {
+		return bal.Available, nil
+	}
+	return approved, nil
 }
 
 // Allowance returns the amount of tokens approved by an owner for
 // spending by a given 'spender'.
 func (t *Token) Allowance(owner string, spender string) (uint64, error) {
-	// Get 'owner's current balance
-	bal, err := t.getBalance(owner)
+	return t.getAllowance(owner, spender)
+}
+
+// AllowanceUsage returns the cumulative amount of tokens transferred
+// from an owner by a given 'spender' using TransferFrom.
+func (t *Token) AllowanceUsage(owner string, spender string) (uint64, error) {
+	return t.getSpent(owner, spender)
+}
+
+// Allow adds an address to the allowlist of recipients. Only the
+// token administrator may maintain the allowlist.
+func (t *Token) Allow(address string) error {
+	if err := t.checkAdmin(); err != nil {
+		return err
+	}
+	key, err := t.caller.stub.CreateCompositeKey(allowlistIndex, []string{address})
 	if err != nil {
-		return 0, err
+		return err
+	}
+	return t.caller.stub.PutState(key, []byte{0x00})
+}
+
+// Disallow removes an address from the allowlist of recipients. Only
+// the token administrator may maintain the allowlist.
+func (t *Token) Disallow(address string) error {
+	if err := t.checkAdmin(); err != nil {
+		return err
+	}
+	key, err := t.caller.stub.CreateCompositeKey(allowlistIndex, []string{address})
+	if err != nil {
+		return err
+	}
+	return t.caller.stub.DelState(key)
+}
+
+// Freeze prevents an address from sending or receiving tokens, e.g. to
+// comply with a regulator. Allowances approved by the address remain
+// but cannot be spent while it is frozen. Only the owner and recipient
+// of a transfer are checked, not the spender. Only the token
+// administrator may freeze addresses.
+func (t *Token) Freeze(address string) error {
+	if err := t.checkAdmin(); err != nil {
+		return err
+	}
+	if address == "" {
+		return fmt.Errorf("Address must not be empty")
+	}
+	key, err := t.caller.stub.CreateCompositeKey(frozenIndex, []string{address})
+	if err != nil {
+		return err
+	}
+	return t.caller.stub.PutState(key, []byte{0x00})
+}
+
+// Unfreeze allows a frozen address to send and receive tokens again.
+// Only the token administrator may unfreeze addresses.
+func (t *Token) Unfreeze(address string) error {
+	if err := t.checkAdmin(); err != nil {
+		return err
+	}
+	key, err := t.caller.stub.CreateCompositeKey(frozenIndex, []string{address})
+	if err != nil {
+		return err
+	}
+	return t.caller.stub.DelState(key)
+}
+
+// SetMaxAllowance caps the amount any single spender may be approved
+// to transfer from an owner. A cap of zero removes the cap. Only the
+// token administrator may set the cap. Allowances approved before the
+// cap was set are not reduced.
+func (t *Token) SetMaxAllowance(amount uint64) error {
+	if err := t.checkAdmin(); err != nil {
+		return err
+	}
+	t.MaxAllowance = amount
+	return t.putToken()
+}
+
+// SetMaxBatchRecipients caps the number of recipients of a single
+// batch transfer, up to maxBatchRecipientsLimit. A cap of zero
+// restores the default. Only the token administrator may set the cap.
+func (t *Token) SetMaxBatchRecipients(n int) error {
+	if err := t.checkAdmin(); err != nil {
+		return err
+	}
+	if n < 0 || n > maxBatchRecipientsLimit {
+		return fmt.Errorf("Batch recipients cap must be between 0 and %d", maxBatchRecipientsLimit)
+	}
+	t.MaxBatchRecipients = n
+	return t.putToken()
+}
+
+// Pause halts all transfers, burns and approvals until the token is
+// unpaused. Only the token administrator may pause the token.
+func (t *Token) Pause() error {
+	if err := t.checkAdmin(); err != nil {
+		return err
+	}
+	t.Paused = true
+	return t.putToken()
+}
+
+// Unpause resumes transfers, burns and approvals of a paused token.
+// Only the token administrator may unpause the token.
+func (t *Token) Unpause() error {
+	if err := t.checkAdmin(); err != nil {
+		return err
+	}
+	t.Paused = false
+	return t.putToken()
+}
+
+// checkNotPaused returns an error if the token has been paused.
+func (t *Token) checkNotPaused() error {
+	if t.Paused {
+		return fmt.Errorf("Token is paused")
+	}
+	return nil
+}
+
+// batchRecipientsLimit returns the maximum number of recipients of a
+// single batch transfer.
+func (t *Token) batchRecipientsLimit() int {
+	if t.MaxBatchRecipients == 0 {
+		return maxBatchRecipients
+	}
+	return t.MaxBatchRecipients
+}
+
+// checkAllowanceCap returns an error if the given allowance exceeds
+// the cap set by the token administrator.
+func (t *Token) checkAllowanceCap(allowance uint64) error {
+	if t.MaxAllowance != 0 && allowance > t.MaxAllowance {
+		return fmt.Errorf("Allowance of %d exceeds the cap of %d", allowance, t.MaxAllowance)
+	}
+	return nil
+}
+
+// RegisterAlias registers a human-readable name for an address, e.g.
+// the address of a treasury or an exchange, replacing any name
+// previously registered. Only the token administrator may register
+// aliases. Aliases are informational, and are not accepted in place of
+// addresses.
+func (t *Token) RegisterAlias(address string, name string) error {
+	if err := t.checkAdmin(); err != nil {
+		return err
+	}
+	if address == "" || name == "" {
+		return fmt.Errorf("Address and alias must not be empty")
+	}
+	if len(name) > maxAliasLength {
+		return fmt.Errorf("Alias must not exceed %d characters", maxAliasLength)
+	}
+	key, err := t.caller.stub.CreateCompositeKey(aliasIndex, []string{address})
+	if err != nil {
+		return err
+	}
+	return t.caller.stub.PutState(key, []byte(name))
+}
+
+// ResolveAlias returns the name registered for an address.
+func (t *Token) ResolveAlias(address string) (string, error) {
+	key, err := t.caller.stub.CreateCompositeKey(aliasIndex, []string{address})
+	if err != nil {
+		return "", err
+	}
+	b, err := t.caller.stub.GetState(key)
+	if err != nil {
+		return "", err
+	}
+	if b == nil {
+		return "", fmt.Errorf("No alias registered for %s", address)
+	}
+	return string(b), nil
+}
+
+// checkAddress returns an error if the address cannot hold a balance,
+// i.e. it is empty or its key would collide with the token or with
+// composite keys.
+func checkAddress(address string) error {
+	if address == "" || address == tokenKey || address < firstSimpleKey {
+		return fmt.Errorf("Malformed address '%s'", address)
 	}
-	return bal.Approved[spender], nil
+	return nil
+}
+
+// checkRecipient returns an error if the recipient is not a valid
+// address, or if the token is in whitelist mode and the recipient is
+// not on the allowlist.
+func (t *Token) checkRecipient(to string) error {
+	if err := checkAddress(to); err != nil {
+		return err
+	}
+	if !t.Whitelist {
+		return nil
+	}
+	key, err := t.caller.stub.CreateCompositeKey(allowlistIndex, []string{to})
+	if err != nil {
+		return err
+	}
+	b, err := t.caller.stub.GetState(key)
+	if err != nil {
+		return err
+	}
+	if b == nil {
+		return fmt.Errorf("Recipient %s is not on the allowlist", to)
+	}
+	return nil
+}
+
+// checkNotFrozen returns an error if any of the given addresses has
+// been frozen.
+func (t *Token) checkNotFrozen(addresses ...string) error {
+	for _, address := range addresses {
+		key, err := t.caller.stub.CreateCompositeKey(frozenIndex, []string{address})
+		if err != nil {
+			return err
+		}
+		b, err := t.caller.stub.GetState(key)
+		if err != nil {
+			return err
+		}
+		if b != nil {
+			return fmt.Errorf("Address %s is frozen", address)
+		}
+	}
+	return nil
+}
+
+// checkSpender returns an error if no identity can spend an allowance
+// approved for the given address, i.e. the address is empty or is the
+// burn address.
+func checkSpender(spender string) error {
+	if spender == "" || spender == burnAddress {
+		return fmt.Errorf("Cannot approve the empty or zero address")
+	}
+	return nil
+}
+
+// checkTransfersEnabled returns an error if the tokens of the given
+// owner may not be transferred or approved yet, i.e. the transaction
+// precedes the end of the lock-up and the owner is not the token
+// administrator.
+func (t *Token) checkTransfersEnabled(owner string) error {
+	if owner == t.Admin || getTxTime(t.caller) >= t.TransfersEnabledAt {
+		return nil
+	}
+	return fmt.Errorf("Transfers are disabled until %d", t.TransfersEnabledAt)
+}
+
+// checkInitialized returns an error if the token was not initialized
+// completely, i.e. the token record is missing or incomplete. Init
+// writes the token last, so its presence marks a completed
+// initialization without reading any further keys.
+func (t *Token) checkInitialized() error {
+	if t.Symbol == "" || t.Admin == "" {
+		return fmt.Errorf("Token has not been initialized")
+	}
+	return nil
+}
+
+// checkAdmin returns an error if the invoker is not the token
+// administrator.
+func (t *Token) checkAdmin() error {
+	if getInvokerAddress(t.caller) != t.Admin {
+		return fmt.Errorf("Invoker is not authorized to administer the token")
+	}
+	return nil
+}
+
+// putToken writes the token to the ledger.
+func (t *Token) putToken() error {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return t.caller.stub.PutState(tokenKey, b)
 }
 
 // getBalance returns owner's current balance from the ledger.
 func (t *Token) getBalance(owner string) (*Balance, error) {
 	var b []byte
 	var err error
-	if b, err = caller.stub.GetState(owner); err != nil {
+	if b, err = t.caller.stub.GetState(owner); err != nil {
 		return nil, err
 	}
 	var bal Balance
@@ -179,8 +1250,65 @@ func (t *Token) putBalance(owner string, bal *Balance) error {
 	if err != nil {
 		return err
 	}
-	if err = caller.stub.PutState(owner, b); err != nil {
+	if err = t.caller.stub.PutState(owner, b); err != nil {
 		return err
 	}
 	return nil
 }
+
+// getAllowance returns the amount approved by owner for transferring
+// by spender from the ledger.
+func (t *Token) getAllowance(owner string, spender string) (uint64, error) {
+	key, err := t.caller.stub.CreateCompositeKey(allowanceIndex, []string{owner, spender})
+	if err != nil {
+		return 0, err
+	}
+	b, err := t.caller.stub.GetState(key)
+	if err != nil {
+		return 0, err
+	}
+	if b == nil {
+		return 0, nil
+	}
+	return bytesToUint64(b), nil
+}
+
+// putAllowance writes the amount approved by owner for transferring
+// by spender to the ledger. A zero allowance removes the key.
+func (t *Token) putAllowance(owner string, spender string, amount uint64) error {
+	key, err := t.caller.stub.CreateCompositeKey(allowanceIndex, []string{owner, spender})
+	if err != nil {
+		return err
+	}
+	if amount == 0 {
+		return t.caller.stub.DelState(key)
+	}
+	return t.caller.stub.PutState(key, uint64ToBytes(amount))
+}
+
+// getSpent returns the cumulative amount transferred by spender from
+// owner from the ledger.
+func (t *Token) getSpent(owner string, spender string) (uint64, error) {
+	key, err := t.caller.stub.CreateCompositeKey(spentIndex, []string{owner, spender})
+	if err != nil {
+		return 0, err
+	}
+	b, err := t.caller.stub.GetState(key)
+	if err != nil {
+		return 0, err
+	}
+	if b == nil {
+		return 0, nil
+	}
+	return bytesToUint64(b), nil
+}
+
+// putSpent writes the cumulative amount transferred by spender from
+// owner to the ledger.
+func (t *Token) putSpent(owner string, spender string, amount uint64) error {
+	key, err := t.caller.stub.CreateCompositeKey(spentIndex, []string{owner, spender})
+	if err != nil {
+		return err
+	}
+	return t.caller.stub.PutState(key, uint64ToBytes(amount))
+}
@@ -2,14 +2,20 @@ package main
 
 import (
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"os"
 	"reflect"
 	"strconv"
+	"strings"
+	"sync/atomic"
 
 	tokens "github.com/dileban/atomic-swaps/fabric/lib/asset/fungible"
 	"github.com/dileban/atomic-swaps/fabric/lib/security"
+	"github.com/golang/protobuf/proto"
 	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
@@ -17,7 +23,11 @@ import (
 
 // TokenChaincode is ... implements shim.Chaincode
 type TokenChaincode struct {
-	token tokens.SimpleToken
+	token *Token
+	// failures counts the invocations that failed on this peer since
+	// the chaincode started, as a failed transaction commits no state.
+	// Handlers see a snapshot of the count.
+	failures uint64
 }
 
 // CallerProps is a container for meta data from the remote client as
@@ -29,14 +39,162 @@ type CallerProps struct {
 	stub shim.ChaincodeStubInterface
 }
 
+// Options holds optional settings supplied to Init.
+type Options struct {
+	// Mintable allows the token supply to be increased after creation.
+	Mintable bool `json:"mintable"`
+
+	// Whitelist restricts transfers to recipients on an allowlist
+	// maintained by the token administrator. The initial owners are
+	// added to the allowlist.
+	Whitelist bool `json:"whitelist"`
+
+	// Decimals is the number of decimal places of the token, up to
+	// maxDecimals. Defaults to zero, i.e. indivisible tokens.
+	Decimals uint64 `json:"decimals"`
+
+	// TransfersEnabledAt is the time (wall clock), in seconds, before
+	// which transfers and approvals are rejected, e.g. to impose a
+	// lock-up on the initial owners. Defaults to no lock-up.
+	TransfersEnabledAt int64 `json:"transfersEnabledAt"`
+}
+
+// Allocation is the amount of tokens allocated to an initial owner
+// out of the total token supply.
+type Allocation struct {
+	Address string `json:"address"`
+	Amount  uint64 `json:"amount"`
+}
+
+// HoldersPage is a page of token holders, along with the bookmark to
+// supply for fetching the next page.
+type HoldersPage struct {
+	Holders  []Holder `json:"holders"`
+	Bookmark string   `json:"bookmark"`
+}
+
+// StateExport is a page of the exported token state, along with the
+// bookmark to supply for fetching the next page.
+type StateExport struct {
+	Token    *Token   `json:"token"`
+	Balances []Holder `json:"balances"`
+	Bookmark string   `json:"bookmark"`
+}
+
 // initialOwner is the address of the initial owner of the token
 // supply. If specified, the Init function checks to see of the
 // supplied owner address matches. Its value must be specified before
 // the multi-org chaincode package signing process begins.
 const initialOwner = ""
 
-// For use within handlers and the token implementation.
-var caller *CallerProps
+// version is the feature version of the token contract, following
+// semantic versioning.
+const version = "1.0.0"
+
+// maxSumAddresses is the maximum number of addresses whose balances
+// may be summed in a single call.
+const maxSumAddresses = 100
+
+// maxBatchRecipients is the default maximum number of recipients of a
+// single batch transfer.
+const maxBatchRecipients = 100
+
+// maxBatchRecipientsLimit is the largest maximum number of recipients
+// of a single batch transfer the administrator may set.
+const maxBatchRecipientsLimit = 1000
+
+// allApproved is the amount supplied to TransferFromHandler to
+// transfer the full remaining allowance, capped by the owner's
+// balance.
+const allApproved = "all"
+
+// maxDecimals is the maximum number of decimal places of a token. A
+// balance holds at most 19 decimal digits.
+const maxDecimals = 18
+
+// maxPageSize is the maximum number of entries returned by a single
+// call to a paginated handler.
+const maxPageSize = 100
+
+// metricIndex is the name of the composite key index for the counters
+// maintained by the handlers.
+const metricIndex = "metric"
+
+// Names of the counters maintained by the handlers.
+const (
+	metricTransfers = "transfers"
+	metricApprovals = "approvals"
+)
+
+// metrics lists the counters returned by MetricsHandler.
+var metrics = []string{metricTransfers, metricApprovals}
+
+// maxCompactedIncrements is the maximum number of increments of a
+// counter merged by a single invocation of CompactMetricsHandler.
+const maxCompactedIncrements = 1000
+
+// capabilities lists the features supported by the token contract.
+var capabilities = []string{tokens.CapTransfer, tokens.CapApprove, tokens.CapTransferFrom,
+	tokens.CapChaincodeAddresses, tokens.CapTransferFromBalance, tokens.CapMint,
+	tokens.CapBurn}
+
+// chaincodeIDEnv is the environment variable through which the peer
+// passes the name and version of the chaincode to its process.
+const chaincodeIDEnv = "CORE_CHAINCODE_ID_NAME"
+
+// CostEstimate is a heuristic of the cost of an operation, given as
+// the number of state reads and writes it performs and a qualitative
+// category for clients deciding whether to batch operations.
+type CostEstimate struct {
+	Function string `json:"function"`
+	Category string `json:"category"`
+	Reads    int    `json:"reads"`
+	Writes   int    `json:"writes"`
+}
+
+// Cost categories reported by EstimateCostHandler. Queries are cheap,
+// operations writing up to maxMediumCostWrites keys are of medium
+// cost, and any others are expensive.
+const (
+	costLow             = "low"
+	costMedium          = "medium"
+	costHigh            = "high"
+	maxMediumCostWrites = 5
+)
+
+// accessPattern describes the state accessed by a handler, including
+// reading the token record, as a fixed number of reads and writes plus
+// reads and writes per item of a batch or page, up to maxItems, or up
+// to the recipients cap of the token for batches of recipients.
+// Recipients are additionally read from the allowlist, if enabled.
+type accessPattern struct {
+	reads, writes         int
+	itemReads, itemWrites int
+	recipients            int
+	itemRecipients        int
+	maxItems              int
+}
+
+// accessPatterns lists the access patterns of the handlers whose cost
+// may be estimated.
+var accessPatterns = map[string]accessPattern{
+	"Transfer":           {reads: 5, writes: 3, recipients: 1},
+	"BatchTransfer":      {reads: 3, writes: 2, itemReads: 2, itemWrites: 1, itemRecipients: 1},
+	"TransferFrom":       {reads: 7, writes: 5, recipients: 1},
+	"TransferAndApprove": {reads: 5, writes: 5, recipients: 1},
+	"Approve":            {reads: 1, writes: 2},
+	"SafeApprove":        {reads: 2, writes: 2},
+	"IncreaseAllowance":  {reads: 2, writes: 2},
+	"DecreaseAllowance":  {reads: 2, writes: 2},
+	"Revoke":             {reads: 2, writes: 1},
+	"Mint":               {reads: 2, writes: 2, recipients: 1},
+	"Burn":               {reads: 3, writes: 2},
+	"TokenSupply":        {reads: 1},
+	"BalanceOf":          {reads: 2},
+	"Allowance":          {reads: 2},
+	"SumBalances":        {reads: 1, itemReads: 1, maxItems: maxSumAddresses},
+	"ListHolders":        {reads: 1, itemReads: 1, maxItems: maxPageSize},
+}
 
 // Init is called during chaincode instantiation. The arguments passed
 // to Init by the remote client includes:
@@ -44,40 +202,142 @@ var caller *CallerProps
 //   0: Symbol of the token, e.g. "FUSD"
 //   1: Name of the token, e.g. "Fabric USD: 1-1 peg to US Dollar"
 //   2: Total token supply, e.g. "210000000"
-//   3: Address of the initial owner of the tokens, e.g. "29cad..b6"
+//   3: Address of the initial owner of the tokens, e.g. "29cad..b6",
+//      or a JSON encoded list of allocations to several owners, e.g.
+//      [{"address": "29cad..b6", "amount": 100}, ...]
+//   4: Optional JSON encoded token options, e.g. {"mintable": true}
+//
+// The supply and all other amounts supplied to the chaincode are in
+// the smallest unit of the token. With the 'decimals' option, e.g.
+// {"decimals": 2}, the handlers report balances and supply as decimal
+// strings, e.g. "1.50" for 150.
 //
 // Init could have alternatively used the invoker as the initial
 // owner. The option of specifying a token owner allows the network to
 // ensure the invoker does not have unncessary control over the entire
 // token supply.
+//
+// The amounts allocated to several owners must add up to the total
+// token supply exactly. The first owner listed administers the token.
+//
+// A token without supply is only of use if it is mintable, and is
+// otherwise rejected. If initialOwner is specified, the owner, or the
+// first of several owners, must match it.
 func (tcc *TokenChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
-	// TODO: Validate args and handle upgrades
+	// TODO: Handle upgrades
 	args := stub.GetStringArgs()
+	if len(args) < 4 || len(args) > 5 {
+		return shim.Error(fmt.Sprintf("Expected 4 or 5 arguments, got %d", len(args)))
+	}
+	// Owners are validated along with their allocations
+	for i, arg := range []string{"symbol", "name", "supply"} {
+		if strings.TrimSpace(args[i]) == "" {
+			return shim.Error(fmt.Sprintf("Token %s must not be empty", arg))
+		}
+	}
 	symbol := args[0]
 	name := args[1]
-	supply := stringToUint64(args[2])
-	owner := args[3]
+	supply, err := strconv.ParseUint(args[2], 10, 64)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Malformed token supply '%s'", args[2]))
+	}
+	allocations, err := readAllocations(args[3], supply)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Error reading initial owners: %s", err))
+	}
+	if err := checkInitialOwner(allocations[0].Address, initialOwner); err != nil {
+		return shim.Error(err.Error())
+	}
 
-	t := Token{Symbol: symbol, Name: name, Decimals: 0, Supply: supply}
+	var opts Options
+	if len(args) > 4 {
+		if err := json.Unmarshal([]byte(args[4]), &opts); err != nil {
+			return shim.Error(fmt.Sprintf("Error reading token options: %s", err))
+		}
+	}
+	if supply == 0 && !opts.Mintable {
+		return shim.Error("Token supply must be greater than zero unless the token is mintable")
+	}
+	if opts.Decimals > maxDecimals {
+		return shim.Error(fmt.Sprintf("Decimals must not exceed %d", maxDecimals))
+	}
+
+	for _, a := range allocations {
+		bal := Balance{Available: a.Amount}
+		b, err := json.Marshal(bal)
+
+		if err != nil {
+			return shim.Error("Error marshalling balance")
+		}
+		if err = stub.PutState(a.Address, b); err != nil {
+			return shim.Error("Error writing owner's balance to ledger")
+		}
+		key, _ := stub.CreateCompositeKey(genesisIndex, []string{a.Address})
+		if err = stub.PutState(key, []byte(strconv.FormatUint(a.Amount, 10))); err != nil {
+			return shim.Error("Error writing owner's allocation to ledger")
+		}
+		if opts.Whitelist {
+			key, _ := stub.CreateCompositeKey(allowlistIndex, []string{a.Address})
+			if err = stub.PutState(key, []byte{0x00}); err != nil {
+				return shim.Error("Error writing allowlist to ledger")
+			}
+		}
+	}
+
+	// The token is written last, so that its presence marks a
+	// completed initialization
+	admin := allocations[0].Address
+	t := Token{Symbol: symbol, Name: name, Decimals: opts.Decimals, Supply: supply, Admin: admin,
+		Mintable: opts.Mintable, Whitelist: opts.Whitelist, TransfersEnabledAt: opts.TransfersEnabledAt}
 	b, err := json.Marshal(t)
 
 	if err != nil {
 		return shim.Error("Error marshalling token")
 	}
 	if err = stub.PutState("token", b); err != nil {
-		shim.Error("Error writing token to ledger")
+		return shim.Error("Error writing token to ledger")
 	}
+	return shim.Success(nil)
+}
 
-	bal := Balance{Approved: nil, Available: supply}
-	b, err = json.Marshal(bal)
-
-	if err != nil {
-		return shim.Error("Error marshalling balance")
+// readAllocations returns the initial owners of the token supply. The
+// supplied owner is either a single address receiving the entire
+// supply, or a JSON encoded list of allocations adding up to it. Owner
+// addresses must be in the format derived from the owner's public key,
+// as tokens held by any other address can never be spent.
+func readAllocations(owner string, supply uint64) ([]Allocation, error) {
+	if !strings.HasPrefix(strings.TrimSpace(owner), "[") {
+		if !security.IsAddress(owner) {
+			return nil, fmt.Errorf("Malformed owner address '%s'", owner)
+		}
+		return []Allocation{{Address: owner, Amount: supply}}, nil
 	}
-	if err = stub.PutState(owner, b); err != nil {
-		shim.Error("Error writing owner's balance to ledger")
+	var allocations []Allocation
+	if err := json.Unmarshal([]byte(owner), &allocations); err != nil {
+		return nil, err
 	}
-	return shim.Success(nil)
+	if len(allocations) == 0 {
+		return nil, fmt.Errorf("No owners specified")
+	}
+	var total uint64
+	seen := make(map[string]bool)
+	for _, a := range allocations {
+		if !security.IsAddress(a.Address) {
+			return nil, fmt.Errorf("Malformed owner address '%s'", a.Address)
+		}
+		if seen[a.Address] {
+			return nil, fmt.Errorf("Owner %s specified more than once", a.Address)
+		}
+		seen[a.Address] = true
+		if total+a.Amount < total {
+			return nil, fmt.Errorf("Allocations exceed the total supply of %d", supply)
+		}
+		total += a.Amount
+	}
+	if total != supply {
+		return nil, fmt.Errorf("Allocations add up to %d, not the total supply of %d", total, supply)
+	}
+	return allocations, nil
 }
 
 // Invoke is called to update or query the state of the ledger. The
@@ -88,60 +348,266 @@ func (tcc *TokenChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 //   1..N: A list of arguments for the function defined in the
 //      'SimpleToken' interface.
 func (tcc *TokenChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	response := tcc.dispatch(stub)
+	if response.Status >= shim.ERRORTHRESHOLD {
+		atomic.AddUint64(&tcc.failures, 1)
+	}
+	return response
+}
+
+// dispatch invokes the handler named by the function of the
+// transaction proposal.
+func (tcc *TokenChaincode) dispatch(stub shim.ChaincodeStubInterface) pb.Response {
 	f, params := stub.GetFunctionAndParameters()
+	if f == "" || f == "init" {
+		return shim.Error(fmt.Sprintf("Function name '%s' is reserved", f))
+	}
 	var b []byte
 	var err error
 
-	// Retrieve token from ledger
-	if b, err = stub.GetState("token"); err != nil {
-		shim.Error("Error reading token from ledger")
+	// Initialize caller props for use in handlers and the token
+	cert, _ := cid.GetX509Certificate(stub)
+	caller := &CallerProps{args: params, cert: cert, stub: stub}
+
+	// Retrieve token from ledger, leaving it zero valued until the
+	// chaincode is initialized
+	if b, err = stub.GetState(tokenKey); err != nil {
+		return shim.Error("Error reading token from ledger")
 	}
-	tcc.token = &Token{}
-	if err = json.Unmarshal(b, tcc.token); err != nil {
-		shim.Error("Error unmarshaling token json")
+	token := &Token{caller: caller}
+	if b != nil {
+		if err = json.Unmarshal(b, token); err != nil {
+			return shim.Error("Error unmarshaling token json")
+		}
 	}
 
-	// Initialize caller props for use in handlers
-	cert, _ := cid.GetX509Certificate(stub)
-	caller = &CallerProps{args: params, cert: cert, stub: stub}
-
-	// Dispatch to appropriate handler based on supplied func name
+	// Dispatch to appropriate handler based on supplied func name. The
+	// handler operates on state scoped to this invocation, leaving the
+	// chaincode itself untouched.
 	// TODO: Handle potential panics
-	v := reflect.ValueOf(tcc).MethodByName(f + "Handler").Call([]reflect.Value{})
+	cc := &TokenChaincode{token: token, failures: atomic.LoadUint64(&tcc.failures)}
+	handler := reflect.ValueOf(cc).MethodByName(f + "Handler")
+	if !handler.IsValid() {
+		return shim.Error(fmt.Sprintf("Unknown function: %s", f))
+	}
+	v := handler.Call([]reflect.Value{reflect.ValueOf(caller)})
 	return v[0].Interface().(pb.Response)
 }
 
 // TokenSupplyHandler fetches the total token supply of the
 // underlying asset. The total supply is returned to the client in
-// string form.
-func (tcc *TokenChaincode) TokenSupplyHandler() pb.Response {
+// decimal string form.
+func (tcc *TokenChaincode) TokenSupplyHandler(caller *CallerProps) pb.Response {
 	supply, _ := tcc.token.TokenSupply()
-	return shim.Success([]byte(strconv.FormatUint(supply, 10)))
+	return shim.Success([]byte(formatAmount(supply, tcc.token.Decimals)))
+}
+
+// CirculatingSupplyHandler fetches the token supply less the tokens
+// burned or held in custody by chaincodes. Like the total supply, the
+// circulating supply is returned to the client in decimal string form.
+func (tcc *TokenChaincode) CirculatingSupplyHandler(caller *CallerProps) pb.Response {
+	supply, err := tcc.token.CirculatingSupply()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(formatAmount(supply, tcc.token.Decimals)))
+}
+
+// SupplyBreakdownHandler fetches the token supply divided into the
+// tokens in circulation, locked in custody by chaincodes and burned.
+// The breakdown is returned to the client as JSON, in the smallest
+// unit.
+func (tcc *TokenChaincode) SupplyBreakdownHandler(caller *CallerProps) pb.Response {
+	breakdown, err := tcc.token.SupplyBreakdown()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	b, err := json.Marshal(breakdown)
+	if err != nil {
+		return shim.Error("Error marshalling supply breakdown")
+	}
+	return shim.Success(b)
 }
 
 // BalanceOfHandler fetches the balance available to the invoker for
 // the underlying asset. The balance is returned to the client in
-// string form.
-func (tcc *TokenChaincode) BalanceOfHandler() pb.Response {
-	// TODO: Validate args
+// decimal string form.
+func (tcc *TokenChaincode) BalanceOfHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "owner"); err != nil {
+		return shim.Error(err.Error())
+	}
 	balance, err := tcc.token.BalanceOf(caller.args[0])
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	return shim.Success([]byte(strconv.FormatUint(balance, 10)))
+	return shim.Success([]byte(formatAmount(balance, tcc.token.Decimals)))
+}
+
+// GetHistoryForAddressHandler fetches the changes to the balance of an
+// address, oldest first. The changes are returned to the client as a
+// JSON array.
+func (tcc *TokenChaincode) GetHistoryForAddressHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "address"); err != nil {
+		return shim.Error(err.Error())
+	}
+	address := caller.args[0]
+
+	changes, err := tcc.token.GetHistoryForAddress(address)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Failed to read history of %s: %s", address, err))
+	}
+	b, err := json.Marshal(changes)
+	if err != nil {
+		return shim.Error("Error marshalling balance history")
+	}
+	return shim.Success(b)
+}
+
+// SumBalancesHandler fetches the combined balance of a list of
+// addresses, up to maxSumAddresses. The balance is returned to the
+// client in decimal string form.
+func (tcc *TokenChaincode) SumBalancesHandler(caller *CallerProps) pb.Response {
+	if len(caller.args) > maxSumAddresses {
+		return shim.Error(fmt.Sprintf("Cannot sum balances of more than %d addresses", maxSumAddresses))
+	}
+	total, err := tcc.token.SumBalances(caller.args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(formatAmount(total, tcc.token.Decimals)))
+}
+
+// ListHoldersHandler fetches a page of token holders with a nonzero
+// balance. The arguments include the page size (up to maxPageSize)
+// and an optional bookmark returned with the previous page. The page
+// is returned to the client as JSON.
+func (tcc *TokenChaincode) ListHoldersHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "pageSize"); err != nil {
+		return shim.Error(err.Error())
+	}
+	pageSize, err := readPageSize(caller)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	var bookmark string
+	if len(caller.args) > 1 {
+		bookmark = caller.args[1]
+	}
+	holders, next, err := tcc.token.ListHolders(bookmark, pageSize)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	b, err := json.Marshal(HoldersPage{Holders: holders, Bookmark: next})
+	if err != nil {
+		return shim.Error("Error marshalling holders")
+	}
+	return shim.Success(b)
+}
+
+// BalancesMerkleRootHandler fetches the Merkle root of all nonzero
+// balances, for light clients verifying balances against a published
+// root. The root is returned to the client in hex form.
+func (tcc *TokenChaincode) BalancesMerkleRootHandler(caller *CallerProps) pb.Response {
+	root, err := tcc.token.BalancesMerkleRoot()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(hex.EncodeToString(root)))
+}
+
+// BalanceProofHandler fetches the balance of a given address along
+// with the proof of the balance against the Merkle root of all
+// nonzero balances. The proof is returned to the client as JSON.
+func (tcc *TokenChaincode) BalanceProofHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "address"); err != nil {
+		return shim.Error(err.Error())
+	}
+	proof, err := tcc.token.BalanceProof(caller.args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	b, err := json.Marshal(proof)
+	if err != nil {
+		return shim.Error("Error marshalling balance proof")
+	}
+	return shim.Success(b)
+}
+
+// ExportStateHandler fetches a page of the token state for backup,
+// comprising the token and all balances. The arguments include the
+// page size (up to maxPageSize) and an optional bookmark returned with
+// the previous page. The page is returned to the client as JSON. Only
+// the token administrator may export the token state.
+func (tcc *TokenChaincode) ExportStateHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "pageSize"); err != nil {
+		return shim.Error(err.Error())
+	}
+	pageSize, err := readPageSize(caller)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	var bookmark string
+	if len(caller.args) > 1 {
+		bookmark = caller.args[1]
+	}
+	balances, next, err := tcc.token.ExportBalances(bookmark, pageSize)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	b, err := json.Marshal(StateExport{Token: tcc.token, Balances: balances, Bookmark: next})
+	if err != nil {
+		return shim.Error("Error marshalling token state")
+	}
+	return shim.Success(b)
+}
+
+// ImportStateHandler restores balances from token state exported
+// using ExportStateHandler. The arguments include the exported state
+// as JSON, with the balances of all pages combined, and an optional
+// "force" flag allowing balances to be restored after balances have
+// changed since initialization, e.g. by a transfer or an earlier
+// import, or allowances have been approved. Only the token
+// administrator may import token state.
+func (tcc *TokenChaincode) ImportStateHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "state"); err != nil {
+		return shim.Error(err.Error())
+	}
+	var export StateExport
+	if err := json.Unmarshal([]byte(caller.args[0]), &export); err != nil {
+		return shim.Error(fmt.Sprintf("Error reading token state: %s", err))
+	}
+	force := len(caller.args) > 1 && caller.args[1] == "force"
+	if export.Token != nil && export.Token.Symbol != tcc.token.Symbol {
+		return shim.Error(fmt.Sprintf("Token state exported for %s, not %s", export.Token.Symbol, tcc.token.Symbol))
+	}
+	if err := tcc.token.ImportBalances(export.Balances, force); err != nil {
+		return shim.Error(fmt.Sprintf("Failed to import token state: %s", err))
+	}
+	return shim.Success(nil)
 }
 
 // TransferHandler transfers tokens from the invoker's address to the
 // specified address. If the transfer is successful, the handler
 // raises the 'Transferred' event and returns an empty payload.
-func (tcc *TokenChaincode) TransferHandler() pb.Response {
-	// TODO: Validate args
+func (tcc *TokenChaincode) TransferHandler(caller *CallerProps) pb.Response {
+	if err := tcc.token.checkInitialized(); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := requireArgs(caller, "to", "amount"); err != nil {
+		return shim.Error(err.Error())
+	}
 	to := caller.args[0]
-	amount := stringToUint64(caller.args[1])
+	amount, err := stringToUint64(caller.args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 	if err := tcc.token.Transfer(to, amount); err != nil {
 		return shim.Error(fmt.Sprintf("Failed to transfer tokens to %s: %s", to, err))
 	}
-	from := getInvokerAddress()
+	if err := incrementMetric(caller, metricTransfers); err != nil {
+		return shim.Error(err.Error())
+	}
+	from := getInvokerAddress(caller)
 	_ = caller.stub.SetEvent("Transferred", newTransferredEvent(from, to, amount))
 	return shim.Success(nil)
 }
@@ -150,38 +616,265 @@ func (tcc *TokenChaincode) TransferHandler() pb.Response {
 // invoker's address to the specified address. If the approval was
 // successful, the handler raises the 'Approved' event and returns an
 // empty payload.
-func (tcc *TokenChaincode) ApproveHandler() pb.Response {
-	// TODO: Validate args
+func (tcc *TokenChaincode) ApproveHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "spender", "amount"); err != nil {
+		return shim.Error(err.Error())
+	}
 	spender := caller.args[0]
-	amount := stringToUint64(caller.args[1])
+	amount, err := stringToUint64(caller.args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 	if err := tcc.token.Approve(spender, amount); err != nil {
 		return shim.Error(fmt.Sprintf("Failed to approve token transfer to %s: %s", spender, err))
 	}
-	owner := getInvokerAddress()
+	if err := incrementMetric(caller, metricApprovals); err != nil {
+		return shim.Error(err.Error())
+	}
+	owner := getInvokerAddress(caller)
+	_ = caller.stub.SetEvent("Approved", newApprovedEvent(owner, spender, amount))
+	return shim.Success(nil)
+}
+
+// RevokeHandler removes the allowance of a spender to transfer tokens
+// from the invoker's address. If an allowance was revoked, the handler
+// raises the 'Revoked' event. Revoking a missing allowance succeeds
+// without raising an event. Like allowances, the revoked amount is
+// returned to the client in string form, in the smallest unit.
+func (tcc *TokenChaincode) RevokeHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "spender"); err != nil {
+		return shim.Error(err.Error())
+	}
+	spender := caller.args[0]
+	revoked, err := tcc.token.Revoke(spender)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Failed to revoke allowance of %s: %s", spender, err))
+	}
+	if revoked > 0 {
+		owner := getInvokerAddress(caller)
+		_ = caller.stub.SetEvent("Revoked", newRevokedEvent(owner, spender, revoked))
+	}
+	return shim.Success([]byte(strconv.FormatUint(revoked, 10)))
+}
+
+// SafeApproveHandler allows a spender to transfer tokens from the
+// invoker's address, up to the invoker's current balance. If the
+// approval was successful, the handler raises the 'Approved' event and
+// returns an empty payload.
+func (tcc *TokenChaincode) SafeApproveHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "spender", "amount"); err != nil {
+		return shim.Error(err.Error())
+	}
+	spender := caller.args[0]
+	amount, err := stringToUint64(caller.args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := tcc.token.SafeApprove(spender, amount); err != nil {
+		return shim.Error(fmt.Sprintf("Failed to approve token transfer to %s: %s", spender, err))
+	}
+	if err := incrementMetric(caller, metricApprovals); err != nil {
+		return shim.Error(err.Error())
+	}
+	owner := getInvokerAddress(caller)
 	_ = caller.stub.SetEvent("Approved", newApprovedEvent(owner, spender, amount))
 	return shim.Success(nil)
 }
 
+// IncreaseAllowanceHandler increases the amount a spender may transfer
+// from the invoker's address. If the increase was successful, the
+// handler raises the 'Approved' event with the new allowance and
+// returns the allowance in string form.
+func (tcc *TokenChaincode) IncreaseAllowanceHandler(caller *CallerProps) pb.Response {
+	return tcc.adjustAllowance(caller, true)
+}
+
+// DecreaseAllowanceHandler decreases the amount a spender may transfer
+// from the invoker's address. If the decrease was successful, the
+// handler raises the 'Approved' event with the new allowance and
+// returns the allowance in string form.
+func (tcc *TokenChaincode) DecreaseAllowanceHandler(caller *CallerProps) pb.Response {
+	return tcc.adjustAllowance(caller, false)
+}
+
+// adjustAllowance implements IncreaseAllowanceHandler and
+// DecreaseAllowanceHandler.
+func (tcc *TokenChaincode) adjustAllowance(caller *CallerProps, increase bool) pb.Response {
+	if err := requireArgs(caller, "spender", "delta"); err != nil {
+		return shim.Error(err.Error())
+	}
+	spender := caller.args[0]
+	delta, err := stringToUint64(caller.args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	approved, err := tcc.token.adjustAllowance(spender, delta, increase)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Failed to adjust allowance of %s: %s", spender, err))
+	}
+	if err := incrementMetric(caller, metricApprovals); err != nil {
+		return shim.Error(err.Error())
+	}
+	owner := getInvokerAddress(caller)
+	_ = caller.stub.SetEvent("Approved", newApprovedEvent(owner, spender, approved))
+	return shim.Success([]byte(strconv.FormatUint(approved, 10)))
+}
+
+// BatchTransferHandler transfers tokens from the invoker's address to
+// several recipients, given as parallel JSON arrays of addresses and
+// amounts, e.g. ["alice", "bob"] and [100, 250]. Either all transfers
+// take effect or none does. If successful, the handler raises a single
+// 'BatchTransferred' event listing the transfers and returns an empty
+// payload.
+func (tcc *TokenChaincode) BatchTransferHandler(caller *CallerProps) pb.Response {
+	if err := tcc.token.checkInitialized(); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := requireArgs(caller, "recipients", "amounts"); err != nil {
+		return shim.Error(err.Error())
+	}
+	var recipients []string
+	if err := json.Unmarshal([]byte(caller.args[0]), &recipients); err != nil {
+		return shim.Error(fmt.Sprintf("Error reading recipients: %s", err))
+	}
+	var amounts []uint64
+	if err := json.Unmarshal([]byte(caller.args[1]), &amounts); err != nil {
+		return shim.Error(fmt.Sprintf("Error reading amounts: %s", err))
+	}
+	if err := tcc.token.BatchTransfer(recipients, amounts); err != nil {
+		return shim.Error(fmt.Sprintf("Failed to transfer tokens: %s", err))
+	}
+	if err := addMetric(caller, metricTransfers, uint64(len(recipients))); err != nil {
+		return shim.Error(err.Error())
+	}
+	from := getInvokerAddress(caller)
+	_ = caller.stub.SetEvent("BatchTransferred", newBatchTransferredEvent(from, recipients, amounts))
+	return shim.Success(nil)
+}
+
+// TransferAndApproveHandler transfers tokens from the invoker's
+// address to the specified address and approves a spender to transfer
+// tokens from the invoker's address. If both were successful, the
+// handler raises the 'TransferredAndApproved' event and returns an
+// empty payload.
+func (tcc *TokenChaincode) TransferAndApproveHandler(caller *CallerProps) pb.Response {
+	if err := tcc.token.checkInitialized(); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := requireArgs(caller, "to", "amount", "spender", "approved"); err != nil {
+		return shim.Error(err.Error())
+	}
+	to := caller.args[0]
+	amount, err := stringToUint64(caller.args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	spender := caller.args[2]
+	approved, err := stringToUint64(caller.args[3])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := tcc.token.TransferAndApprove(to, amount, spender, approved); err != nil {
+		return shim.Error(fmt.Sprintf("Failed to transfer tokens to %s and approve %s: %s", to, spender, err))
+	}
+	for _, name := range []string{metricTransfers, metricApprovals} {
+		if err := incrementMetric(caller, name); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	owner := getInvokerAddress(caller)
+	_ = caller.stub.SetEvent("TransferredAndApproved", newTransferredAndApprovedEvent(owner, to, amount, spender, approved))
+	return shim.Success(nil)
+}
+
 // TransferFromHandler transfers approved tokens from the owner's
 // address to the specified address. The owner must have sufficient
-// funds for the transfer. If the transfer was successful, the handler
-// raises the 'Transferred' event and returns an empty payload.
-func (tcc *TokenChaincode) TransferFromHandler() pb.Response {
-	// TODO: Validate args
+// funds for the transfer. The amount may be given as allApproved to
+// transfer the full remaining allowance, capped by the owner's
+// balance. If the transfer was successful, the handler raises the
+// 'Transferred' event with the amount transferred and returns the
+// recipient's balance following the transfer in decimal string form.
+func (tcc *TokenChaincode) TransferFromHandler(caller *CallerProps) pb.Response {
+	if err := tcc.token.checkInitialized(); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := requireArgs(caller, "from", "to", "amount"); err != nil {
+		return shim.Error(err.Error())
+	}
 	from := caller.args[0]
 	to := caller.args[1]
-	amount := stringToUint64(caller.args[2])
-	if err := tcc.token.TransferFrom(from, to, amount); err != nil {
+	var amount uint64
+	var err error
+	if caller.args[2] == allApproved {
+		amount, err = tcc.token.Transferable(from)
+	} else {
+		amount, err = stringToUint64(caller.args[2])
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	balance, err := tcc.token.transferFrom(from, to, amount)
+	if err != nil {
 		return shim.Error(fmt.Sprintf("Failed to transfer tokens from %s to %s: %s", from, to, err))
 	}
+	if err := incrementMetric(caller, metricTransfers); err != nil {
+		return shim.Error(err.Error())
+	}
 	_ = caller.stub.SetEvent("Transferred", newTransferredEvent(from, to, amount))
+	return shim.Success([]byte(formatAmount(balance, tcc.token.Decimals)))
+}
+
+// MintHandler creates new tokens and credits them to the specified
+// address. Only the token administrator may mint tokens. If minting is
+// successful, the handler raises the 'Minted' event and returns an
+// empty payload.
+func (tcc *TokenChaincode) MintHandler(caller *CallerProps) pb.Response {
+	if err := tcc.token.checkInitialized(); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := requireArgs(caller, "to", "amount"); err != nil {
+		return shim.Error(err.Error())
+	}
+	to := caller.args[0]
+	amount, err := stringToUint64(caller.args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := tcc.token.Mint(to, amount); err != nil {
+		return shim.Error(fmt.Sprintf("Failed to mint tokens to %s: %s", to, err))
+	}
+	_ = caller.stub.SetEvent("Minted", newMintedEvent(to, amount))
+	return shim.Success(nil)
+}
+
+// BurnHandler destroys tokens held by the invoker, reducing the total
+// supply. If burning is successful, the handler raises the 'Burned'
+// event and returns an empty payload.
+func (tcc *TokenChaincode) BurnHandler(caller *CallerProps) pb.Response {
+	if err := tcc.token.checkInitialized(); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := requireArgs(caller, "amount"); err != nil {
+		return shim.Error(err.Error())
+	}
+	amount, err := stringToUint64(caller.args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := tcc.token.Burn(amount); err != nil {
+		return shim.Error(fmt.Sprintf("Failed to burn tokens: %s", err))
+	}
+	from := getInvokerAddress(caller)
+	_ = caller.stub.SetEvent("Burned", newBurnedEvent(from, amount))
 	return shim.Success(nil)
 }
 
 // AllowanceHandler fetches the amount of tokens allowed for spending
 // from a given owner's address by a given spender.
-func (tcc *TokenChaincode) AllowanceHandler() pb.Response {
-	// TODO: Validate args
+func (tcc *TokenChaincode) AllowanceHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "owner", "spender"); err != nil {
+		return shim.Error(err.Error())
+	}
 	allowance, err := tcc.token.Allowance(caller.args[0], caller.args[1])
 	if err != nil {
 		return shim.Error(err.Error())
@@ -189,10 +882,347 @@ func (tcc *TokenChaincode) AllowanceHandler() pb.Response {
 	return shim.Success([]byte(strconv.FormatUint(allowance, 10)))
 }
 
+// AllowanceUsageHandler fetches the cumulative amount of tokens
+// transferred from a given owner's address by a given spender. The
+// amount is returned to the client in string form.
+func (tcc *TokenChaincode) AllowanceUsageHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "owner", "spender"); err != nil {
+		return shim.Error(err.Error())
+	}
+	spent, err := tcc.token.AllowanceUsage(caller.args[0], caller.args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(strconv.FormatUint(spent, 10)))
+}
+
+// FreezeHandler prevents an address from sending or receiving tokens.
+// If successful, the handler raises the 'Frozen' event and returns an
+// empty payload. Only the token administrator may freeze addresses.
+func (tcc *TokenChaincode) FreezeHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "address"); err != nil {
+		return shim.Error(err.Error())
+	}
+	address := caller.args[0]
+	if err := tcc.token.Freeze(address); err != nil {
+		return shim.Error(fmt.Sprintf("Failed to freeze %s: %s", address, err))
+	}
+	_ = caller.stub.SetEvent("Frozen", newFrozenEvent(address))
+	return shim.Success(nil)
+}
+
+// UnfreezeHandler allows a frozen address to send and receive tokens
+// again. If successful, the handler raises the 'Unfrozen' event and
+// returns an empty payload. Only the token administrator may unfreeze
+// addresses.
+func (tcc *TokenChaincode) UnfreezeHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "address"); err != nil {
+		return shim.Error(err.Error())
+	}
+	address := caller.args[0]
+	if err := tcc.token.Unfreeze(address); err != nil {
+		return shim.Error(fmt.Sprintf("Failed to unfreeze %s: %s", address, err))
+	}
+	_ = caller.stub.SetEvent("Unfrozen", newUnfrozenEvent(address))
+	return shim.Success(nil)
+}
+
+// SetMaxAllowanceHandler caps the amount any single spender may be
+// approved to transfer from an owner. A cap of zero removes the cap.
+// Only the token administrator may set the cap.
+func (tcc *TokenChaincode) SetMaxAllowanceHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "amount"); err != nil {
+		return shim.Error(err.Error())
+	}
+	amount, err := stringToUint64(caller.args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := tcc.token.SetMaxAllowance(amount); err != nil {
+		return shim.Error(fmt.Sprintf("Failed to set allowance cap: %s", err))
+	}
+	return shim.Success(nil)
+}
+
+// SetMaxBatchRecipientsHandler caps the number of recipients of a
+// single batch transfer. A cap of zero restores the default. Only the
+// token administrator may set the cap.
+func (tcc *TokenChaincode) SetMaxBatchRecipientsHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "recipients"); err != nil {
+		return shim.Error(err.Error())
+	}
+	n, err := stringToUint64(caller.args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := tcc.token.SetMaxBatchRecipients(int(n)); err != nil {
+		return shim.Error(fmt.Sprintf("Failed to set batch recipients cap: %s", err))
+	}
+	return shim.Success(nil)
+}
+
+// PauseHandler halts all transfers, burns and approvals. If
+// successful, the handler raises the 'Paused' event and returns an
+// empty payload. Only the token administrator may pause the token.
+func (tcc *TokenChaincode) PauseHandler(caller *CallerProps) pb.Response {
+	if err := tcc.token.Pause(); err != nil {
+		return shim.Error(fmt.Sprintf("Failed to pause token: %s", err))
+	}
+	_ = caller.stub.SetEvent("Paused", newPausedEvent(getInvokerAddress(caller)))
+	return shim.Success(nil)
+}
+
+// UnpauseHandler resumes transfers, burns and approvals. If
+// successful, the handler raises the 'Unpaused' event and returns an
+// empty payload. Only the token administrator may unpause the token.
+func (tcc *TokenChaincode) UnpauseHandler(caller *CallerProps) pb.Response {
+	if err := tcc.token.Unpause(); err != nil {
+		return shim.Error(fmt.Sprintf("Failed to unpause token: %s", err))
+	}
+	_ = caller.stub.SetEvent("Unpaused", newUnpausedEvent(getInvokerAddress(caller)))
+	return shim.Success(nil)
+}
+
+// RegisterAliasHandler registers a human-readable name for an address.
+// Only the token administrator may register aliases.
+func (tcc *TokenChaincode) RegisterAliasHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "address", "name"); err != nil {
+		return shim.Error(err.Error())
+	}
+	address := caller.args[0]
+	name := caller.args[1]
+	if err := tcc.token.RegisterAlias(address, name); err != nil {
+		return shim.Error(fmt.Sprintf("Failed to register alias of %s: %s", address, err))
+	}
+	return shim.Success(nil)
+}
+
+// ResolveAliasHandler fetches the name registered for an address. The
+// name is returned to the client as is.
+func (tcc *TokenChaincode) ResolveAliasHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "address"); err != nil {
+		return shim.Error(err.Error())
+	}
+	name, err := tcc.token.ResolveAlias(caller.args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(name))
+}
+
+// AllowHandler adds an address to the allowlist of recipients of a
+// token in whitelist mode. Only the token administrator may maintain
+// the allowlist.
+func (tcc *TokenChaincode) AllowHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "address"); err != nil {
+		return shim.Error(err.Error())
+	}
+	address := caller.args[0]
+	if err := tcc.token.Allow(address); err != nil {
+		return shim.Error(fmt.Sprintf("Failed to allow %s: %s", address, err))
+	}
+	return shim.Success(nil)
+}
+
+// DisallowHandler removes an address from the allowlist of recipients
+// of a token in whitelist mode. Only the token administrator may
+// maintain the allowlist.
+func (tcc *TokenChaincode) DisallowHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "address"); err != nil {
+		return shim.Error(err.Error())
+	}
+	address := caller.args[0]
+	if err := tcc.token.Disallow(address); err != nil {
+		return shim.Error(fmt.Sprintf("Failed to disallow %s: %s", address, err))
+	}
+	return shim.Success(nil)
+}
+
+// VersionHandler returns the feature version of the token contract
+// along with the capabilities it supports. Clients, including other
+// chaincodes, may use this to adapt their behaviour.
+func (tcc *TokenChaincode) VersionHandler(caller *CallerProps) pb.Response {
+	b, err := json.Marshal(tokens.Version{Version: version, Capabilities: capabilities})
+	if err != nil {
+		return shim.Error("Error marshalling version")
+	}
+	return shim.Success(b)
+}
+
+// GetRawStateHandler fetches the raw bytes stored under a given key
+// for diagnosing the state of the ledger. The bytes are returned to
+// the client base64 encoded. Only the token administrator may read
+// raw state.
+func (tcc *TokenChaincode) GetRawStateHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "key"); err != nil {
+		return shim.Error(err.Error())
+	}
+	key := caller.args[0]
+	if err := tcc.token.checkAdmin(); err != nil {
+		return shim.Error(err.Error())
+	}
+	b, err := caller.stub.GetState(key)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Error reading key %s: %s", key, err))
+	}
+	return shim.Success([]byte(base64.StdEncoding.EncodeToString(b)))
+}
+
+// MetricsHandler fetches the counters maintained by the handlers as a
+// JSON object, e.g. {"transfers": 10, "approvals": 2, ...}. Each
+// counter is recorded under a key per increment rather than a single
+// key per counter, so that concurrent operations do not conflict with
+// one another when validated, until merged by CompactMetricsHandler.
+// Failed operations are not counted, since state written by a failed
+// transaction is never committed; see FailuresHandler.
+func (tcc *TokenChaincode) MetricsHandler(caller *CallerProps) pb.Response {
+	counters := make(map[string]uint64)
+	for _, name := range metrics {
+		count, err := getMetric(caller, name)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		counters[name] = count
+	}
+	b, err := json.Marshal(counters)
+	if err != nil {
+		return shim.Error("Error marshalling metrics")
+	}
+	return shim.Success(b)
+}
+
+// FailuresHandler fetches the number of invocations that failed on
+// the peer answering the query since the chaincode started, in decimal
+// string form. The count is kept in memory rather than on the ledger,
+// so it differs from peer to peer and is reset by restarts. It is a
+// diagnostic for querying individual peers, and must not be invoked
+// by transactions requiring endorsement by several peers.
+func (tcc *TokenChaincode) FailuresHandler(caller *CallerProps) pb.Response {
+	return shim.Success([]byte(strconv.FormatUint(tcc.failures, 10)))
+}
+
+// CompactMetricsHandler merges the increments recorded for each
+// counter, up to maxCompactedIncrements per counter, into a single
+// increment holding their sum, bounding the keys read when fetching
+// the counters. Increments committed while compacting invalidate the
+// compaction, as its range reads are validated at commit, rather than
+// being lost. The handler returns the number of increments merged,
+// which is 0 once the counters are compact. Only the administrator
+// may compact the counters.
+func (tcc *TokenChaincode) CompactMetricsHandler(caller *CallerProps) pb.Response {
+	if err := tcc.token.checkAdmin(); err != nil {
+		return shim.Error(err.Error())
+	}
+	var merged int
+	for _, name := range metrics {
+		n, err := compactMetric(caller, name)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		merged += n
+	}
+	return shim.Success([]byte(strconv.Itoa(merged)))
+}
+
+// EstimateCostHandler estimates the cost of invoking a function from
+// its known access pattern. The optional hint gives the number of
+// items of a batch or page, e.g. the number of recipients of a batch
+// transfer, and defaults to one. The estimate is returned to the
+// client as JSON.
+func (tcc *TokenChaincode) EstimateCostHandler(caller *CallerProps) pb.Response {
+	if err := requireArgs(caller, "function"); err != nil {
+		return shim.Error(err.Error())
+	}
+	items := uint64(1)
+	if len(caller.args) > 1 && caller.args[1] != "" {
+		var err error
+		if items, err = stringToUint64(caller.args[1]); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	estimate, err := estimateCost(caller.args[0], items, tcc.token)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	b, err := json.Marshal(estimate)
+	if err != nil {
+		return shim.Error("Error marshalling cost estimate")
+	}
+	return shim.Success(b)
+}
+
 // newTransferredEvent returns a byte array representing a chaincode
 // event for successful token transfers.
 func newTransferredEvent(from string, to string, amount uint64) []byte {
-	t := tokens.Transfer{From: from, To: to, Amount: amount}
+	t := tokens.Transfer{SchemaVersion: tokens.EventSchemaVersion, From: from, To: to, Amount: amount}
+	b, _ := json.Marshal(t)
+	return b
+}
+
+// newBatchTransferredEvent returns a byte array representing a
+// chaincode event for successful batch transfers.
+func newBatchTransferredEvent(from string, recipients []string, amounts []uint64) []byte {
+	t := tokens.BatchTransfer{SchemaVersion: tokens.EventSchemaVersion, From: from}
+	for i, to := range recipients {
+		t.Transfers = append(t.Transfers,
+			tokens.Transfer{SchemaVersion: tokens.EventSchemaVersion, From: from, To: to, Amount: amounts[i]})
+	}
+	b, _ := json.Marshal(t)
+	return b
+}
+
+// newMintedEvent returns a byte array representing a chaincode event
+// for successfully minted tokens.
+func newMintedEvent(to string, amount uint64) []byte {
+	t := tokens.Mint{SchemaVersion: tokens.EventSchemaVersion, To: to, Amount: amount}
+	b, _ := json.Marshal(t)
+	return b
+}
+
+// newBurnedEvent returns a byte array representing a chaincode event
+// for successfully burned tokens.
+func newBurnedEvent(from string, amount uint64) []byte {
+	t := tokens.Burn{SchemaVersion: tokens.EventSchemaVersion, From: from, Amount: amount}
+	b, _ := json.Marshal(t)
+	return b
+}
+
+// newFrozenEvent returns a byte array representing a chaincode event
+// for frozen addresses.
+func newFrozenEvent(address string) []byte {
+	t := tokens.Freeze{SchemaVersion: tokens.EventSchemaVersion, Address: address}
+	b, _ := json.Marshal(t)
+	return b
+}
+
+// newUnfrozenEvent returns a byte array representing a chaincode event
+// for unfrozen addresses.
+func newUnfrozenEvent(address string) []byte {
+	t := tokens.Unfreeze{SchemaVersion: tokens.EventSchemaVersion, Address: address}
+	b, _ := json.Marshal(t)
+	return b
+}
+
+// newRevokedEvent returns a byte array representing a chaincode event
+// for revoked allowances.
+func newRevokedEvent(owner string, spender string, amount uint64) []byte {
+	t := tokens.Revocation{SchemaVersion: tokens.EventSchemaVersion, Owner: owner, Spender: spender, Amount: amount}
+	b, _ := json.Marshal(t)
+	return b
+}
+
+// newPausedEvent returns a byte array representing a chaincode event
+// for a paused token.
+func newPausedEvent(admin string) []byte {
+	t := tokens.Pause{SchemaVersion: tokens.EventSchemaVersion, Admin: admin}
+	b, _ := json.Marshal(t)
+	return b
+}
+
+// newUnpausedEvent returns a byte array representing a chaincode event
+// for an unpaused token.
+func newUnpausedEvent(admin string) []byte {
+	t := tokens.Unpause{SchemaVersion: tokens.EventSchemaVersion, Admin: admin}
 	b, _ := json.Marshal(t)
 	return b
 }
@@ -200,18 +1230,198 @@ func newTransferredEvent(from string, to string, amount uint64) []byte {
 // newApprovedEvent returns a byte array representing a chaincode
 // event for successful approvals.
 func newApprovedEvent(owner string, spender string, amount uint64) []byte {
-	t := tokens.Approval{Owner: owner, Spender: spender, Amount: amount}
+	t := tokens.Approval{SchemaVersion: tokens.EventSchemaVersion, Owner: owner, Spender: spender, Amount: amount}
 	b, _ := json.Marshal(t)
 	return b
 }
 
+// newTransferredAndApprovedEvent returns a byte array representing a
+// chaincode event for a successful transfer and approval.
+func newTransferredAndApprovedEvent(owner string, to string, amount uint64, spender string, approved uint64) []byte {
+	t := tokens.TransferAndApproval{
+		SchemaVersion: tokens.EventSchemaVersion,
+		Transfer:      tokens.Transfer{SchemaVersion: tokens.EventSchemaVersion, From: owner, To: to, Amount: amount},
+		Approval:      tokens.Approval{SchemaVersion: tokens.EventSchemaVersion, Owner: owner, Spender: spender, Amount: approved}}
+	b, _ := json.Marshal(t)
+	return b
+}
+
+// estimateCost returns the cost of invoking a function on the given
+// number of items of the token, reading recipients from the allowlist
+// if enabled.
+func estimateCost(function string, items uint64, t *Token) (*CostEstimate, error) {
+	pattern, ok := accessPatterns[function]
+	if !ok {
+		return nil, fmt.Errorf("No cost estimate for function %s", function)
+	}
+	maxItems := pattern.maxItems
+	if pattern.itemRecipients > 0 {
+		maxItems = t.batchRecipientsLimit()
+	}
+	if maxItems == 0 {
+		items = 0
+	} else if items == 0 || items > uint64(maxItems) {
+		return nil, fmt.Errorf("Number of items must be between 1 and %d", maxItems)
+	}
+	n := int(items)
+	estimate := &CostEstimate{
+		Function: function,
+		Reads:    pattern.reads + n*pattern.itemReads,
+		Writes:   pattern.writes + n*pattern.itemWrites,
+	}
+	if t.Whitelist {
+		estimate.Reads += pattern.recipients + n*pattern.itemRecipients
+	}
+	switch {
+	case estimate.Writes == 0:
+		estimate.Category = costLow
+	case estimate.Writes <= maxMediumCostWrites:
+		estimate.Category = costMedium
+	default:
+		estimate.Category = costHigh
+	}
+	return estimate, nil
+}
+
+// checkInitialOwner returns an error if an initial owner is expected
+// and the given owner is not it.
+func checkInitialOwner(owner string, expected string) error {
+	if expected != "" && owner != expected {
+		return fmt.Errorf("Initial owner must be %s", expected)
+	}
+	return nil
+}
+
+// getMetric returns the named counter maintained by the handlers,
+// summing the increments recorded for it.
+func getMetric(caller *CallerProps, name string) (uint64, error) {
+	iter, err := caller.stub.GetStateByPartialCompositeKey(metricIndex, []string{name})
+	if err != nil {
+		return 0, fmt.Errorf("Error reading metric %s from ledger", name)
+	}
+	defer iter.Close()
+	var count uint64
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return 0, fmt.Errorf("Error reading metric %s from ledger", name)
+		}
+		value, err := stringToUint64(string(kv.Value))
+		if err != nil {
+			return 0, fmt.Errorf("Malformed value for metric %s", name)
+		}
+		count += value
+	}
+	return count, nil
+}
+
+// incrementMetric increments the named counter maintained by the
+// handlers. Each increment is written under a key of its own, keyed by
+// transaction ID, and is never read back within a transaction, so
+// concurrent increments of a counter do not conflict.
+func incrementMetric(caller *CallerProps, name string) error {
+	return addMetric(caller, name, 1)
+}
+
+// addMetric adds 'n' to the named counter maintained by the handlers,
+// e.g. once for each transfer of a batch, under a single key. Values
+// are encoded as decimal strings.
+func addMetric(caller *CallerProps, name string, n uint64) error {
+	key, err := caller.stub.CreateCompositeKey(metricIndex, []string{name, caller.stub.GetTxID()})
+	if err != nil {
+		return fmt.Errorf("Error creating key for metric %s", name)
+	}
+	if err := caller.stub.PutState(key, []byte(strconv.FormatUint(n, 10))); err != nil {
+		return fmt.Errorf("Error writing metric %s to ledger", name)
+	}
+	return nil
+}
+
+// compactMetric replaces up to maxCompactedIncrements of the
+// increments recorded for the named counter by one holding their sum,
+// returning the number of increments replaced.
+func compactMetric(caller *CallerProps, name string) (int, error) {
+	iter, err := caller.stub.GetStateByPartialCompositeKey(metricIndex, []string{name})
+	if err != nil {
+		return 0, fmt.Errorf("Error reading metric %s from ledger", name)
+	}
+	defer iter.Close()
+	var keys []string
+	var sum uint64
+	for iter.HasNext() && len(keys) < maxCompactedIncrements {
+		kv, err := iter.Next()
+		if err != nil {
+			return 0, fmt.Errorf("Error reading metric %s from ledger", name)
+		}
+		value, err := stringToUint64(string(kv.Value))
+		if err != nil {
+			return 0, fmt.Errorf("Malformed value for metric %s", name)
+		}
+		keys = append(keys, kv.Key)
+		sum += value
+	}
+	if len(keys) < 2 {
+		return 0, nil
+	}
+	for _, key := range keys {
+		if err := caller.stub.DelState(key); err != nil {
+			return 0, fmt.Errorf("Error deleting metric %s from ledger", name)
+		}
+	}
+	if err := addMetric(caller, name, sum); err != nil {
+		return 0, err
+	}
+	return len(keys), nil
+}
+
+// getTxTime returns the (wall clock) time of the current transaction
+// in seconds, as specified by the client.
+func getTxTime(caller *CallerProps) int64 {
+	t, _ := caller.stub.GetTxTimestamp()
+	return t.GetSeconds()
+}
+
 // getInvokerAddress gets a hex-based address representing the
-// invoker's public key.
-func getInvokerAddress() string {
+// invoker's public key, or the chaincode address of a chaincode
+// invoking the token.
+func getInvokerAddress(caller *CallerProps) string {
+	if chaincode := getCallingChaincode(caller); chaincode != "" {
+		return chaincodeAddressPrefix + chaincode
+	}
 	cert := security.NewX509Certificate(caller.cert)
 	return cert.GetAddress()
 }
 
+// getCallingChaincode returns the name of the chaincode invoking the
+// token, or an empty string if the token was invoked directly by a
+// client. A chaincode invoking the token passes on the proposal
+// addressed to it, so a proposal addressed to any chaincode other
+// than the token identifies the caller. Chaincodes are thereby
+// resolved to their chaincode address, allowing them to hold tokens
+// in custody.
+func getCallingChaincode(caller *CallerProps) string {
+	self := strings.SplitN(os.Getenv(chaincodeIDEnv), ":", 2)[0]
+	if self == "" {
+		return ""
+	}
+	signedProposal, err := caller.stub.GetSignedProposal()
+	if err != nil || signedProposal == nil {
+		return ""
+	}
+	proposal := &pb.Proposal{}
+	if err = proto.Unmarshal(signedProposal.ProposalBytes, proposal); err != nil {
+		return ""
+	}
+	header := &pb.ChaincodeHeaderExtension{}
+	if err = proto.Unmarshal(proposal.Header, header); err != nil || header.ChaincodeId == nil {
+		return ""
+	}
+	if name := header.ChaincodeId.Name; name != self {
+		return name
+	}
+	return ""
+}
+
 // uint64ToBytes converts an unsigned integer to a byte array.
 func uint64ToBytes(i uint64) []byte {
 	b := make([]byte, 8)
@@ -224,15 +1434,70 @@ func bytesToUint64(b []byte) uint64 {
 	return binary.LittleEndian.Uint64(b)
 }
 
-// uint64ToBytes converts a string to an unsigned integer.
-func stringToUint64(s string) uint64 {
-	i, _ := strconv.ParseUint(s, 10, 64)
-	return i
+// formatAmount formats an amount in the smallest unit of a token as a
+// decimal string with exactly 'decimals' fractional digits, e.g.
+// "1.50" for 150 with two decimals. The conversion is exact, and
+// removing the decimal point yields the amount in the smallest unit.
+func formatAmount(amount uint64, decimals uint64) string {
+	s := strconv.FormatUint(amount, 10)
+	if decimals == 0 {
+		return s
+	}
+	if pad := int(decimals) + 1 - len(s); pad > 0 {
+		s = strings.Repeat("0", pad) + s
+	}
+	return s[:len(s)-int(decimals)] + "." + s[len(s)-int(decimals):]
+}
+
+// requireArgs returns an error if fewer arguments were supplied than
+// the named arguments a handler requires, naming those expected.
+func requireArgs(caller *CallerProps, names ...string) error {
+	if len(caller.args) < len(names) {
+		return fmt.Errorf("Expected %d arguments (%s), got %d", len(names), strings.Join(names, ", "), len(caller.args))
+	}
+	return nil
+}
+
+// readPageSize returns the page size supplied as the first argument
+// of a paginated handler, which must lie between 1 and maxPageSize.
+// The size is checked before conversion, so that sizes beyond the
+// range of int are rejected rather than wrapped.
+func readPageSize(caller *CallerProps) (int, error) {
+	size, err := stringToUint64(caller.args[0])
+	if err != nil {
+		return 0, err
+	}
+	if size == 0 || size > maxPageSize {
+		return 0, fmt.Errorf("Page size must be between 1 and %d", maxPageSize)
+	}
+	return int(size), nil
+}
+
+// stringToUint64 converts a string to an unsigned integer, reporting
+// values that are not numeric or do not fit in 64 bits.
+func stringToUint64(s string) (uint64, error) {
+	i, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Malformed number '%s'", s)
+	}
+	return i, nil
+}
+
+// startChaincode starts a chaincode, replaced when testing.
+var startChaincode = shim.Start
+
+// run starts the TokenChaincode, returning an error if it could not be
+// started or stopped unexpectedly.
+func run() error {
+	if err := startChaincode(new(TokenChaincode)); err != nil {
+		return fmt.Errorf("Error starting TokenChaincode: %s", err)
+	}
+	return nil
 }
 
 func main() {
-	tcc := new(TokenChaincode)
-	if err := shim.Start(tcc); err != nil {
-		fmt.Printf("Error starting TokenChaincode: %s", err)
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 }
@@ -1,59 +1,2064 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"math/big"
+	"os"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	tokens "github.com/dileban/atomic-swaps/fabric/lib/asset/fungible"
+	"github.com/dileban/atomic-swaps/fabric/lib/merkle"
+	"github.com/dileban/atomic-swaps/fabric/lib/security"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	"github.com/hyperledger/fabric/protos/msp"
 	pb "github.com/hyperledger/fabric/protos/peer"
 	"github.com/stretchr/testify/assert"
 )
 
 const ccName = "tokenChaincode"
 
-const owner = "000000"
+const supply = 10000
+
+// txID is incremented for every mock transaction, since metrics are
+// recorded per transaction ID.
+var txID int
+
+// The identity used for mock invocations, who is also the initial
+// owner of the token supply.
+var ownerIdentity, owner = newIdentity()
+
+func TestInit(t *testing.T) {
+	stub := newMockStub()
+	r := initMock(stub)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	// Check initial token state
+	token, err := readToken(stub)
+	assert.NoError(t, err)
+	assert.Equal(t, *token, Token{Symbol: "FUSD", Name: "Fabric USD", Decimals: 0, Supply: supply, Admin: owner})
+}
+
+func TestInitZeroSupply(t *testing.T) {
+	stub := newMockStub()
+	r := stub.MockInit("init", byteArray("FUSD", "Fabric USD", "0", owner))
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "mintable")
+	assert.Empty(t, stub.State)
+
+	r = stub.MockInit("init", byteArray("FUSD", "Fabric USD", "0", owner, `{"mintable": false}`))
+	assert.Equal(t, shim.ERROR, int(r.Status))
+
+	r = stub.MockInit("init", byteArray("FUSD", "Fabric USD", "0", owner, `{"mintable": true}`))
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	token, err := readToken(stub)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), token.Supply)
+	assert.True(t, token.Mintable)
+}
+
+func TestDecimals(t *testing.T) {
+	stub := newMockStub()
+	r := stub.MockInit("init", byteArray("FUSD", "Fabric USD", "10000", owner, `{"decimals": 2}`))
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	token, err := readToken(stub)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), token.Decimals)
+	assert.Equal(t, uint64(supply), token.Supply)
+
+	// Amounts are supplied in the smallest unit and reported with
+	// decimals
+	r = invokeMock(stub, "TokenSupply")
+	assert.Equal(t, "100.00", string(r.Payload))
+	r = invokeMock(stub, "Transfer", "dileban", "1")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "BalanceOf", "dileban")
+	assert.Equal(t, "0.01", string(r.Payload))
+	invokeMock(stub, "Transfer", "dileban", "149")
+	r = invokeMock(stub, "BalanceOf", "dileban")
+	assert.Equal(t, "1.50", string(r.Payload))
+	r = invokeMock(stub, "SumBalances", owner, "dileban")
+	assert.Equal(t, "100.00", string(r.Payload))
+	bal, err := readBalance(stub, "dileban")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(150), bal.Available)
+
+	// Allowances, including revoked ones, are reported in the smallest
+	// unit
+	r = invokeMock(stub, "Approve", "spender", "150")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "Allowance", owner, "spender")
+	assert.Equal(t, "150", string(r.Payload))
+	r = invokeMock(stub, "Revoke", "spender")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, "150", string(r.Payload))
+
+	// Tokens without decimals report plain integers
+	stub = newMockStub()
+	initMock(stub)
+	r = invokeMock(stub, "TokenSupply")
+	assert.Equal(t, "10000", string(r.Payload))
+
+	stub = newMockStub()
+	r = stub.MockInit("init", byteArray("FUSD", "Fabric USD", "10000", owner, `{"decimals": 19}`))
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "Decimals must not exceed")
+}
+
+func TestFormatAmount(t *testing.T) {
+	assert.Equal(t, "150", formatAmount(150, 0))
+	assert.Equal(t, "1.50", formatAmount(150, 2))
+	assert.Equal(t, "0.00", formatAmount(0, 2))
+	assert.Equal(t, "0.005", formatAmount(5, 3))
+	assert.Equal(t, "0.999", formatAmount(999, 3))
+	assert.Equal(t, "1.000", formatAmount(1000, 3))
+	assert.Equal(t, "18.446744073709551615", formatAmount(^uint64(0), maxDecimals))
+}
+
+func TestTransfersEnabledAt(t *testing.T) {
+	stub := newMockStub()
+	enabledAt := time.Now().Unix() + 3600
+	r := stub.MockInit("init", byteArray("FUSD", "Fabric USD", "10000", owner,
+		fmt.Sprintf(`{"transfersEnabledAt": %d}`, enabledAt)))
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	// The administrator is exempt from the lock-up
+	holderIdentity, holder := newIdentity()
+	r = invokeMock(stub, "Transfer", holder, "100")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "Approve", holder, "100")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	// Other owners may neither transfer nor approve before the
+	// enablement time
+	stub.Creator = holderIdentity
+	for _, args := range [][]string{
+		{"Transfer", owner, "50"},
+		{"Approve", owner, "50"},
+		{"SafeApprove", owner, "50"},
+		{"TransferAndApprove", owner, "50", "spender", "50"},
+	} {
+		r = invokeMock(stub, args...)
+		assert.Equal(t, shim.ERROR, int(r.Status), args[0])
+		assert.Contains(t, r.Message, "Transfers are disabled until", args[0])
+	}
+	// The administrator's approved tokens may be transferred
+	r = invokeMock(stub, "TransferFrom", owner, holder, "100")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	// Transfers are enabled once the time has passed
+	token, err := readToken(stub)
+	assert.NoError(t, err)
+	token.TransfersEnabledAt = time.Now().Unix() - 1
+	b, _ := json.Marshal(token)
+	stub.State[tokenKey] = b
+	r = invokeMock(stub, "Transfer", owner, "50")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	bal, err := readBalance(stub, holder)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(150), bal.Available)
+}
+
+func TestInitArgs(t *testing.T) {
+	stub := newMockStub()
+	r := stub.MockInit("init", byteArray("FUSD", "Fabric USD", "10000"))
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "Expected 4 or 5 arguments, got 3")
+	r = stub.MockInit("init", byteArray("FUSD", "Fabric USD", "10000", owner, "{}", "extra"))
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	r = stub.MockInit("init", byteArray("", "Fabric USD", "10000", owner))
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "Token symbol must not be empty")
+	r = stub.MockInit("init", byteArray("FUSD", " ", "10000", owner))
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "Token name must not be empty")
+	r = stub.MockInit("init", byteArray("FUSD", "Fabric USD", "ten", owner))
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "Malformed token supply")
+	assert.Empty(t, stub.State)
+}
+
+func TestInitialOwner(t *testing.T) {
+	_, other := newIdentity()
+	err := checkInitialOwner(other, owner)
+	assert.EqualError(t, err, "Initial owner must be "+owner)
+	assert.NoError(t, checkInitialOwner(owner, owner))
+
+	// Any owner is accepted unless an initial owner is specified
+	assert.NoError(t, checkInitialOwner(other, ""))
+	stub := newMockStub()
+	r := stub.MockInit("init", byteArray("FUSD", "Fabric USD", "10000", other))
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+}
+
+func TestInitWriteErrors(t *testing.T) {
+	for key, message := range map[string]string{
+		owner:    "Error writing owner's balance to ledger",
+		tokenKey: "Error writing token to ledger",
+	} {
+		stub := shim.NewMockStub(ccName, &failingChaincode{failKey: key})
+		r := stub.MockInit("init", byteArray("FUSD", "Fabric USD", "10000", owner))
+		assert.Equal(t, shim.ERROR, int(r.Status), key)
+		assert.Equal(t, message, r.Message)
+	}
+}
+
+func TestInitMalformedOwner(t *testing.T) {
+	for _, address := range []string{"dileban", "", owner[:63], owner + "0", strings.ToUpper(owner), owner[:63] + "g"} {
+		stub := newMockStub()
+		r := stub.MockInit("init", byteArray("FUSD", "Fabric USD", "10000", address))
+		assert.Equal(t, shim.ERROR, int(r.Status), address)
+		assert.Contains(t, r.Message, "Malformed owner address")
+		assert.Empty(t, stub.State)
+	}
+	stub := newMockStub()
+	r := stub.MockInit("init", byteArray("FUSD", "Fabric USD", "10000", `[{"address": "dileban", "amount": 10000}]`))
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "Malformed owner address")
+}
+
+func TestInitMultipleOwners(t *testing.T) {
+	stub := newMockStub()
+	_, other := newIdentity()
+	owners := `[{"address": "` + owner + `", "amount": 6000}, {"address": "` + other + `", "amount": 4000}]`
+	r := stub.MockInit("init", byteArray("FUSD", "Fabric USD", "10000", owners))
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	token, err := readToken(stub)
+	assert.NoError(t, err)
+	assert.Equal(t, owner, token.Admin)
+	bal, err := readBalance(stub, owner)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(6000), bal.Available)
+	bal, err = readBalance(stub, other)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4000), bal.Available)
+
+	// Allocations must add up to the total supply exactly
+	stub = newMockStub()
+	owners = `[{"address": "` + owner + `", "amount": 6000}, {"address": "` + other + `", "amount": 3999}]`
+	r = stub.MockInit("init", byteArray("FUSD", "Fabric USD", "10000", owners))
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "add up to 9999")
+	assert.Empty(t, stub.State)
+
+	owners = `[{"address": "` + owner + `", "amount": 18446744073709551615}, {"address": "` + other + `", "amount": 10001}]`
+	r = stub.MockInit("init", byteArray("FUSD", "Fabric USD", "10000", owners))
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Empty(t, stub.State)
+}
+
+func TestPartialInit(t *testing.T) {
+	// Transfers are rejected before the token is initialized
+	stub := newMockStub()
+	r := invokeMock(stub, "Transfer", "dileban", "100")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "not been initialized")
+
+	for _, args := range [][]string{
+		{"TransferFrom", owner, "dileban", "100"},
+		{"TransferAndApprove", "dileban", "100", "spender", "100"},
+		{"Burn", "100"},
+	} {
+		r = invokeMock(stub, args...)
+		assert.Equal(t, shim.ERROR, int(r.Status), args[0])
+		assert.Contains(t, r.Message, "not been initialized", args[0])
+	}
+	assert.NotContains(t, stub.State, "dileban")
+
+	// A complete initialization writes the token last, and its
+	// presence suffices
+	initMock(stub)
+	r = invokeMock(stub, "Transfer", "dileban", "100")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	// A malformed token is reported rather than treated as uninitialized
+	stub.State[tokenKey] = []byte("{")
+	r = invokeMock(stub, "TokenSupply")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Equal(t, "Error unmarshaling token json", r.Message)
+}
+
+func TestInvoke(t *testing.T) {
+	stub := newMockStub()
+	r := initMock(stub)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	r = stub.MockInvokeWithSignedProposal("1", byteArray("TokenSupply"), &pb.SignedProposal{})
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, strconv.Itoa(supply), string(r.Payload))
+
+	r = stub.MockInvokeWithSignedProposal("1", byteArray("BalanceOf", owner), &pb.SignedProposal{})
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, strconv.Itoa(supply), string(r.Payload))
+
+	r = stub.MockInvokeWithSignedProposal("1", byteArray("Transfer", "dileban", "100"), &pb.SignedProposal{})
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Nil(t, r.Payload)
+}
+
+func TestInvokeReservedNames(t *testing.T) {
+	stub := newMockStub()
+	r := initMock(stub)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	for _, f := range []string{"init", ""} {
+		r = invokeMock(stub, f)
+		assert.Equal(t, shim.ERROR, int(r.Status))
+		assert.Contains(t, r.Message, "is reserved")
+	}
+}
+
+func TestInvokeUnknownFunction(t *testing.T) {
+	stub := newMockStub()
+	initMock(stub)
+	for _, f := range []string{"Bogus", "transfer"} {
+		r := invokeMock(stub, f, "dileban", "100")
+		assert.Equal(t, shim.ERROR, int(r.Status))
+		assert.Equal(t, "Unknown function: "+f, r.Message)
+	}
+}
+
+func TestTransferToSelf(t *testing.T) {
+	stub := newMockStub()
+	r := initMock(stub)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	// A transfer to self must neither create nor destroy tokens
+	r = invokeMock(stub, "Transfer", owner, "100")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	bal, err := readBalance(stub, owner)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(supply), bal.Available)
+
+	// Funds are still checked for a transfer to self
+	r = invokeMock(stub, "Transfer", owner, strconv.Itoa(supply+1))
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	bal, err = readBalance(stub, owner)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(supply), bal.Available)
+}
+
+func TestTransferFromToSelf(t *testing.T) {
+	stub := newMockStub()
+	r := initMock(stub)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	spenderIdentity, spender := newIdentity()
+	r = invokeMock(stub, "Approve", spender, "300")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	// A transfer from an owner to itself consumes the allowance but
+	// neither creates nor destroys tokens
+	stub.Creator = spenderIdentity
+	r = invokeMock(stub, "TransferFrom", owner, owner, "100")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, strconv.Itoa(supply), string(r.Payload))
+	bal, err := readBalance(stub, owner)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(supply), bal.Available)
+	r = invokeMock(stub, "Allowance", owner, spender)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, "200", string(r.Payload))
+
+	// The allowance is still checked for a transfer to self
+	r = invokeMock(stub, "TransferFrom", owner, owner, "201")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "Insufficent balance approved")
+	bal, err = readBalance(stub, owner)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(supply), bal.Available)
+}
+
+func TestVersion(t *testing.T) {
+	stub := newMockStub()
+	r := initMock(stub)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	r = invokeMock(stub, "Version")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	var v tokens.Version
+	assert.NoError(t, json.Unmarshal(r.Payload, &v))
+	assert.Equal(t, version, v.Version)
+	assert.Equal(t, []string{tokens.CapTransfer, tokens.CapApprove, tokens.CapTransferFrom,
+		tokens.CapChaincodeAddresses, tokens.CapTransferFromBalance, tokens.CapMint, tokens.CapBurn}, v.Capabilities)
+}
+
+func TestChaincodeAddresses(t *testing.T) {
+	os.Setenv(chaincodeIDEnv, ccName+":1.0")
+	defer os.Unsetenv(chaincodeIDEnv)
+	stub := newMockStub()
+	r := initMock(stub)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	// A chaincode invoking the token passes on the proposal addressed
+	// to it
+	invokeFrom := func(chaincode string, args ...string) pb.Response {
+		txID++
+		ext, _ := proto.Marshal(&pb.ChaincodeHeaderExtension{ChaincodeId: &pb.ChaincodeID{Name: chaincode}})
+		b, _ := proto.Marshal(&pb.Proposal{Header: ext})
+		return stub.MockInvokeWithSignedProposal(strconv.Itoa(txID), byteArray(args...),
+			&pb.SignedProposal{ProposalBytes: b})
+	}
+
+	// Tokens are locked in custody as the swap chaincode does, by
+	// approving its chaincode address and letting it transfer from
+	// the owner
+	r = invokeFrom(ccName, "Approve", "cc:swaps", "100")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeFrom("swaps", "TransferFrom", owner, "cc:swaps", "100")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, "100", string(r.Payload))
+	r = invokeFrom("swaps", "Allowance", owner, "cc:swaps")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, "0", string(r.Payload))
+
+	// Tokens in custody are released by the chaincode alone
+	r = invokeFrom(ccName, "Transfer", "dileban", "40")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeFrom("swaps", "Transfer", "dileban", "100")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	balance, err := readBalance(stub, "cc:swaps")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), balance.Available)
+	balance, err = readBalance(stub, "dileban")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(140), balance.Available)
+	balance, err = readBalance(stub, owner)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(supply-140), balance.Available)
+}
+
+func TestApproveTransferNoConflict(t *testing.T) {
+	cc := new(recordingChaincode)
+	stub := shim.NewMockStub(ccName, cc)
+	stub.Creator = ownerIdentity
+	r := initMock(stub)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	r = invokeMock(stub, "Approve", "spender", "500")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	approve := cc.last
+	r = invokeMock(stub, "Transfer", "dileban", "100")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	transfer := cc.last
+
+	// Neither transaction reads a key written by the other, so both
+	// would pass MVCC validation if committed in the same block
+	for key := range approve.writes {
+		assert.NotContains(t, transfer.reads, key)
+	}
+	for key := range transfer.writes {
+		assert.NotContains(t, approve.reads, key)
+	}
+	assert.NotContains(t, approve.reads, owner)
+
+	r = invokeMock(stub, "Allowance", owner, "spender")
+	assert.Equal(t, "500", string(r.Payload))
+	r = invokeMock(stub, "BalanceOf", owner)
+	assert.Equal(t, strconv.Itoa(supply-100), string(r.Payload))
+}
+
+func TestApprovePersists(t *testing.T) {
+	stub := newMockStub()
+	r := initMock(stub)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	// Allowances are kept under their own key, not in the owner's
+	// balance, and must be written to the ledger
+	r = invokeMock(stub, "Approve", "spender", "500")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	key, err := stub.CreateCompositeKey(allowanceIndex, []string{owner, "spender"})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(500), bytesToUint64(stub.State[key]))
+	bal, err := readBalance(stub, owner)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(supply), bal.Available)
+}
+
+func TestSafeApprove(t *testing.T) {
+	stub := newMockStub()
+	r := initMock(stub)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	r = invokeMock(stub, "SafeApprove", "spender", strconv.Itoa(supply))
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "Allowance", owner, "spender")
+	assert.Equal(t, strconv.Itoa(supply), string(r.Payload))
+
+	r = invokeMock(stub, "SafeApprove", "spender", strconv.Itoa(supply+1))
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "exceeds balance")
+	r = invokeMock(stub, "Allowance", owner, "spender")
+	assert.Equal(t, strconv.Itoa(supply), string(r.Payload))
+
+	// Approve still allows approving more than the balance
+	r = invokeMock(stub, "Approve", "spender", strconv.Itoa(supply+1))
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+}
+
+func TestAllowanceUsage(t *testing.T) {
+	stub := newMockStub()
+	r := initMock(stub)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	spenderIdentity, spender := newIdentity()
+
+	r = invokeMock(stub, "Approve", spender, "500")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	stub.Creator = spenderIdentity
+	for _, amount := range []string{"100", "50", "25"} {
+		r = invokeMock(stub, "TransferFrom", owner, "dileban", amount)
+		assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	}
+	// The recipient's balance following the transfer is returned
+	assert.Equal(t, "175", string(r.Payload))
+	r = invokeMock(stub, "TransferFrom", owner, "dileban", "1000")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+
+	r = invokeMock(stub, "AllowanceUsage", owner, spender)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, "175", string(r.Payload))
+	r = invokeMock(stub, "Allowance", owner, spender)
+	assert.Equal(t, "325", string(r.Payload))
+
+	// Usage accumulates across approvals
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "Approve", spender, "100")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	stub.Creator = spenderIdentity
+	r = invokeMock(stub, "TransferFrom", owner, "dileban", "100")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "AllowanceUsage", owner, spender)
+	assert.Equal(t, "275", string(r.Payload))
+	r = invokeMock(stub, "AllowanceUsage", owner, "other")
+	assert.Equal(t, "0", string(r.Payload))
+}
+
+func TestTransferFromAllApproved(t *testing.T) {
+	stub := newMockStub()
+	initMock(stub)
+	spenderIdentity, spender := newIdentity()
+	holderIdentity, holder := newIdentity()
+	transferred := func() uint64 {
+		var transfer tokens.Transfer
+		assert.NoError(t, json.Unmarshal(lastEvent(stub).Payload, &transfer))
+		return transfer.Amount
+	}
+
+	// Balance exceeds the amount approved
+	r := invokeMock(stub, "Approve", spender, "300")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	stub.Creator = spenderIdentity
+	r = invokeMock(stub, "TransferFrom", owner, "dileban", allApproved)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, "300", string(r.Payload))
+	assert.Equal(t, uint64(300), transferred())
+	r = invokeMock(stub, "Allowance", owner, spender)
+	assert.Equal(t, "0", string(r.Payload))
+
+	// Nothing left to transfer
+	r = invokeMock(stub, "TransferFrom", owner, "dileban", allApproved)
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "zero amount")
+
+	// Amount approved exceeds the balance
+	stub.Creator = ownerIdentity
+	invokeMock(stub, "Transfer", holder, "200")
+	stub.Creator = holderIdentity
+	r = invokeMock(stub, "Approve", spender, "500")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	stub.Creator = spenderIdentity
+	r = invokeMock(stub, "TransferFrom", holder, "dileban", allApproved)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, "500", string(r.Payload))
+	assert.Equal(t, uint64(200), transferred())
+	r = invokeMock(stub, "Allowance", holder, spender)
+	assert.Equal(t, "300", string(r.Payload))
+	bal, err := readBalance(stub, holder)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), bal.Available)
+}
+
+func TestAdjustAllowance(t *testing.T) {
+	stub := newMockStub()
+	initMock(stub)
+	spenderIdentity, spender := newIdentity()
+	approved := func() uint64 {
+		var approval tokens.Approval
+		assert.NoError(t, json.Unmarshal(lastEvent(stub).Payload, &approval))
+		return approval.Amount
+	}
+
+	// Increase from zero
+	r := invokeMock(stub, "IncreaseAllowance", spender, "100")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, "100", string(r.Payload))
+	assert.Equal(t, uint64(100), approved())
+	r = invokeMock(stub, "IncreaseAllowance", spender, "50")
+	assert.Equal(t, "150", string(r.Payload))
+
+	// Adjustments account for transfers made in the meantime
+	stub.Creator = spenderIdentity
+	r = invokeMock(stub, "TransferFrom", owner, "dileban", "100")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "DecreaseAllowance", spender, "100")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "below zero, 50 approved")
+	r = invokeMock(stub, "Allowance", owner, spender)
+	assert.Equal(t, "50", string(r.Payload))
+
+	// Decrease to zero
+	r = invokeMock(stub, "DecreaseAllowance", spender, "50")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, "0", string(r.Payload))
+	assert.Equal(t, uint64(0), approved())
+	r = invokeMock(stub, "Allowance", owner, spender)
+	assert.Equal(t, "0", string(r.Payload))
+	r = invokeMock(stub, "DecreaseAllowance", spender, "1")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+
+	r = invokeMock(stub, "IncreaseAllowance", spender, "0")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	invokeMock(stub, "IncreaseAllowance", spender, "1")
+	r = invokeMock(stub, "IncreaseAllowance", spender, strconv.FormatUint(^uint64(0), 10))
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "overflows")
+}
+
+func TestMaxAllowance(t *testing.T) {
+	stub := newMockStub()
+	initMock(stub)
+	_, spender := newIdentity()
+
+	// Only the administrator may cap allowances
+	stub.Creator, _ = newIdentity()
+	r := invokeMock(stub, "SetMaxAllowance", "500")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "SetMaxAllowance", "500")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	token, err := readToken(stub)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(500), token.MaxAllowance)
+
+	// Approvals within the cap succeed
+	r = invokeMock(stub, "Approve", spender, "500")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "SafeApprove", spender, "400")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "IncreaseAllowance", spender, "100")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	// Approvals above the cap are rejected
+	for _, fn := range []string{"Approve", "SafeApprove"} {
+		r = invokeMock(stub, fn, spender, "501")
+		assert.Equal(t, shim.ERROR, int(r.Status), fn)
+		assert.Contains(t, r.Message, "Allowance of 501 exceeds the cap of 500", fn)
+	}
+	r = invokeMock(stub, "IncreaseAllowance", spender, "1")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "Allowance of 501 exceeds the cap of 500")
+	r = invokeMock(stub, "Allowance", owner, spender)
+	assert.Equal(t, "500", string(r.Payload))
+
+	// Decreases are not capped, and a zero cap removes the cap
+	r = invokeMock(stub, "SetMaxAllowance", "100")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "DecreaseAllowance", spender, "50")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "SetMaxAllowance", "0")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "Approve", spender, "5000")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+}
+
+func TestEmptyAddressApprovals(t *testing.T) {
+	stub := newMockStub()
+	initMock(stub)
+
+	for _, spender := range []string{"", burnAddress} {
+		for _, fn := range []string{"Approve", "SafeApprove", "IncreaseAllowance"} {
+			r := invokeMock(stub, fn, spender, "100")
+			assert.Equal(t, shim.ERROR, int(r.Status), fn)
+			assert.Contains(t, r.Message, "empty or zero address", fn)
+		}
+		r := invokeMock(stub, "TransferAndApprove", "dileban", "100", spender, "100")
+		assert.Equal(t, shim.ERROR, int(r.Status))
+		assert.Contains(t, r.Message, "empty or zero address")
+		r = invokeMock(stub, "Allowance", owner, spender)
+		assert.Equal(t, "0", string(r.Payload))
+	}
+
+	r := invokeMock(stub, "TransferFrom", "", "dileban", "100")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "Owner address must not be empty")
+}
+
+func TestConcurrentApprovals(t *testing.T) {
+	cc := new(recordingChaincode)
+	stub := shim.NewMockStub(ccName, cc)
+	stub.Creator = ownerIdentity
+	r := initMock(stub)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	r = invokeMock(stub, "Approve", "spender1", "500")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	first := cc.last
+	r = invokeMock(stub, "Approve", "spender2", "300")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	second := cc.last
+
+	// Neither approval reads or writes a key written by the other, so
+	// both would pass MVCC validation if committed in the same block
+	for key := range first.writes {
+		assert.NotContains(t, second.reads, key)
+		assert.NotContains(t, second.writes, key)
+	}
+	for key := range second.writes {
+		assert.NotContains(t, first.reads, key)
+	}
+
+	r = invokeMock(stub, "Allowance", owner, "spender1")
+	assert.Equal(t, "500", string(r.Payload))
+	r = invokeMock(stub, "Allowance", owner, "spender2")
+	assert.Equal(t, "300", string(r.Payload))
+}
+
+func TestGetRawState(t *testing.T) {
+	stub := newMockStub()
+	r := initMock(stub)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	r = invokeMock(stub, "GetRawState", "token")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	b, err := base64.StdEncoding.DecodeString(string(r.Payload))
+	assert.NoError(t, err)
+	assert.Equal(t, stub.State["token"], b)
+
+	// Only the administrator may read raw state
+	stub.Creator, _ = newIdentity()
+	r = invokeMock(stub, "GetRawState", "token")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "not authorized")
+}
+
+func TestTransferAndApprove(t *testing.T) {
+	stub := newMockStub()
+	r := initMock(stub)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	r = invokeMock(stub, "TransferAndApprove", "dileban", "100", "spender", "50")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	bal, err := readBalance(stub, "dileban")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(100), bal.Available)
+	r = invokeMock(stub, "Allowance", owner, "spender")
+	assert.Equal(t, "50", string(r.Payload))
+
+	// Both the transfer and approval are reported in a single event
+	var e tokens.TransferAndApproval
+	event := lastEvent(stub)
+	assert.Equal(t, "TransferredAndApproved", event.EventName)
+	assert.NoError(t, json.Unmarshal(event.Payload, &e))
+	assert.Equal(t, tokens.Transfer{SchemaVersion: 1, From: owner, To: "dileban", Amount: 100}, e.Transfer)
+	assert.Equal(t, tokens.Approval{SchemaVersion: 1, Owner: owner, Spender: "spender", Amount: 50}, e.Approval)
+
+	// A failed transfer leaves the allowance untouched
+	r = invokeMock(stub, "TransferAndApprove", "dileban", strconv.Itoa(supply), "other", "50")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	r = invokeMock(stub, "Allowance", owner, "other")
+	assert.Equal(t, "0", string(r.Payload))
+
+	// A failed approval leaves balances untouched
+	r = invokeMock(stub, "TransferAndApprove", "dileban", "100", "other", "0")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	bal, err = readBalance(stub, "dileban")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(100), bal.Available)
+	bal, err = readBalance(stub, owner)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(supply-100), bal.Available)
+
+	// As does an approval exceeding the allowance cap
+	r = invokeMock(stub, "SetMaxAllowance", "500")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "TransferAndApprove", "dileban", "100", "other", "501")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "exceeds the cap")
+	bal, err = readBalance(stub, "dileban")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(100), bal.Available)
+	bal, err = readBalance(stub, owner)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(supply-100), bal.Available)
+}
+
+func TestBatchTransfer(t *testing.T) {
+	stub := newMockStub()
+	r := initMock(stub)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assertBalance := func(address string, expected uint64) {
+		bal, err := readBalance(stub, address)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, bal.Available, address)
+	}
+
+	// Repeated recipients are credited together and amounts sent to
+	// self are not debited
+	r = invokeMock(stub, "BatchTransfer", fmt.Sprintf(`["alice", "bob", "alice", "%s"]`, owner), "[100, 250, 50, 10]")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assertBalance("alice", 150)
+	assertBalance("bob", 250)
+	assertBalance(owner, supply-400)
+
+	// All transfers are reported in a single event
+	var e tokens.BatchTransfer
+	event := lastEvent(stub)
+	assert.Equal(t, "BatchTransferred", event.EventName)
+	assert.NoError(t, json.Unmarshal(event.Payload, &e))
+	assert.Equal(t, owner, e.From)
+	assert.Equal(t, []tokens.Transfer{
+		{SchemaVersion: 1, From: owner, To: "alice", Amount: 100},
+		{SchemaVersion: 1, From: owner, To: "bob", Amount: 250},
+		{SchemaVersion: 1, From: owner, To: "alice", Amount: 50},
+		{SchemaVersion: 1, From: owner, To: owner, Amount: 10},
+	}, e.Transfers)
+	r = invokeMock(stub, "Metrics")
+	assert.Equal(t, `{"approvals":0,"transfers":4}`, string(r.Payload))
+
+	// Failed batches leave all balances untouched
+	tests := []struct {
+		recipients string
+		amounts    string
+		message    string
+	}{
+		{`["alice", "bob"]`, "[100]", "got 2 recipients and 1 amounts"},
+		{`[]`, "[]", "No recipients specified"},
+		{`["alice", "bob"]`, fmt.Sprintf("[100, %d]", supply-400), "Insufficient balance"},
+		{`["alice", "bob"]`, "[100, 0]", "zero amount"},
+		{`["alice", "bob"]`, "[1, 18446744073709551615]", "overflows"},
+		{`"alice"`, "[100]", "Error reading recipients"},
+		{`["alice"]`, `["100"]`, "Error reading amounts"},
+		{`["alice"]`, "[-1]", "Error reading amounts"},
+		{fmt.Sprintf(`[%s"alice"]`, strings.Repeat(`"alice", `, maxBatchRecipients)),
+			fmt.Sprintf("[%s1]", strings.Repeat("1, ", maxBatchRecipients)), "more than 100 recipients"},
+	}
+	for _, test := range tests {
+		r = invokeMock(stub, "BatchTransfer", test.recipients, test.amounts)
+		assert.Equal(t, shim.ERROR, int(r.Status), test.recipients)
+		assert.Contains(t, r.Message, test.message, test.recipients)
+	}
+	assertBalance("alice", 150)
+	assertBalance("bob", 250)
+	assertBalance(owner, supply-400)
+}
+
+func TestBatchTransferLimit(t *testing.T) {
+	stub := newMockStub()
+	r := initMock(stub)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	batch := func(n int) (string, string) {
+		recipients := make([]string, n)
+		amounts := make([]uint64, n)
+		for i := range recipients {
+			recipients[i] = fmt.Sprintf("holder%d", i)
+			amounts[i] = 1
+		}
+		b, _ := json.Marshal(recipients)
+		a, _ := json.Marshal(amounts)
+		return string(b), string(a)
+	}
+
+	// Batches of exactly the maximum number of recipients succeed
+	recipients, amounts := batch(maxBatchRecipients)
+	r = invokeMock(stub, "BatchTransfer", recipients, amounts)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	bal, err := readBalance(stub, fmt.Sprintf("holder%d", maxBatchRecipients-1))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), bal.Available)
+
+	// Larger batches are to be split
+	recipients, amounts = batch(maxBatchRecipients + 1)
+	r = invokeMock(stub, "BatchTransfer", recipients, amounts)
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "split the batch into chunks of at most 100 recipients")
+
+	// Only the administrator may change the cap, within its limit
+	stub.Creator, _ = newIdentity()
+	r = invokeMock(stub, "SetMaxBatchRecipients", "200")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "not authorized")
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "SetMaxBatchRecipients", strconv.Itoa(maxBatchRecipientsLimit+1))
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "between 0 and 1000")
+
+	// A raised cap admits larger batches, and bounds cost estimates
+	r = invokeMock(stub, "SetMaxBatchRecipients", "200")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "BatchTransfer", recipients, amounts)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "EstimateCost", "BatchTransfer", "200")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "EstimateCost", "BatchTransfer", "201")
+	assert.Equal(t, "Number of items must be between 1 and 200", r.Message)
+
+	// A lowered cap rejects batches the default admits
+	r = invokeMock(stub, "SetMaxBatchRecipients", "2")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	recipients, amounts = batch(3)
+	r = invokeMock(stub, "BatchTransfer", recipients, amounts)
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "more than 2 recipients")
+
+	// Zero restores the default
+	r = invokeMock(stub, "SetMaxBatchRecipients", "0")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	token, err := readToken(stub)
+	assert.NoError(t, err)
+	assert.Equal(t, maxBatchRecipients, token.batchRecipientsLimit())
+}
+
+func TestEstimateCost(t *testing.T) {
+	stub := newMockStub()
+	r := initMock(stub)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	estimate := func(args ...string) CostEstimate {
+		r := invokeMock(stub, append([]string{"EstimateCost"}, args...)...)
+		assert.Equal(t, shim.OK, int(r.Status), r.Message)
+		var e CostEstimate
+		assert.NoError(t, json.Unmarshal(r.Payload, &e))
+		return e
+	}
+
+	assert.Equal(t, CostEstimate{Function: "Transfer", Category: "medium", Reads: 5, Writes: 3}, estimate("Transfer"))
+	assert.Equal(t, CostEstimate{Function: "BatchTransfer", Category: "medium", Reads: 7, Writes: 4},
+		estimate("BatchTransfer", "2"))
+	assert.Equal(t, CostEstimate{Function: "BatchTransfer", Category: "high", Reads: 23, Writes: 12},
+		estimate("BatchTransfer", "10"))
+	assert.Equal(t, CostEstimate{Function: "BalanceOf", Category: "low", Reads: 2}, estimate("BalanceOf"))
+	assert.Equal(t, CostEstimate{Function: "ListHolders", Category: "low", Reads: 51}, estimate("ListHolders", "50"))
+
+	// Hints are ignored by functions without items, and batches
+	// default to a single item
+	assert.Equal(t, estimate("Transfer"), estimate("Transfer", "10"))
+	assert.Equal(t, 5, estimate("BatchTransfer").Reads)
+
+	// Recipients are read from the allowlist, if enabled
+	token, err := readToken(stub)
+	assert.NoError(t, err)
+	token.Whitelist = true
+	b, _ := json.Marshal(token)
+	stub.State[tokenKey] = b
+	assert.Equal(t, 6, estimate("Transfer").Reads)
+	assert.Equal(t, 33, estimate("BatchTransfer", "10").Reads)
+	assert.Equal(t, 2, estimate("BalanceOf").Reads)
+
+	for _, test := range []struct {
+		args    []string
+		message string
+	}{
+		{[]string{"Unknown"}, "No cost estimate for function Unknown"},
+		{[]string{"BatchTransfer", "0"}, "Number of items must be between 1 and 100"},
+		{[]string{"BatchTransfer", "101"}, "Number of items must be between 1 and 100"},
+		{[]string{"BatchTransfer", "x"}, "Malformed number 'x'"},
+	} {
+		r = invokeMock(stub, append([]string{"EstimateCost"}, test.args...)...)
+		assert.Equal(t, shim.ERROR, int(r.Status), test.args)
+		assert.Equal(t, test.message, r.Message, test.args)
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	stub := newMockStub()
+	r := initMock(stub)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	holderIdentity, holder := newIdentity()
+	r = invokeMock(stub, "Transfer", holder, "500")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	// Only the administrator may freeze addresses
+	stub.Creator = holderIdentity
+	r = invokeMock(stub, "Freeze", holder)
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "not authorized")
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "Freeze", holder)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	var e tokens.Freeze
+	event := lastEvent(stub)
+	assert.Equal(t, "Frozen", event.EventName)
+	assert.NoError(t, json.Unmarshal(event.Payload, &e))
+	assert.Equal(t, tokens.Freeze{SchemaVersion: 1, Address: holder}, e)
+
+	// Frozen addresses can neither send nor receive, directly or
+	// through allowances and batches
+	r = invokeMock(stub, "Transfer", holder, "100")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "is frozen")
+	r = invokeMock(stub, "BatchTransfer", fmt.Sprintf(`["dileban", "%s"]`, holder), "[100, 100]")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "is frozen")
+	r = invokeMock(stub, "Approve", holder, "100")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	stub.Creator = holderIdentity
+	r = invokeMock(stub, "Approve", owner, "100")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	for _, args := range [][]string{
+		{"Transfer", "dileban", "100"},
+		{"BatchTransfer", `["dileban"]`, "[100]"},
+		{"TransferFrom", owner, holder, "100"},
+		{"Burn", "100"},
+	} {
+		r = invokeMock(stub, args...)
+		assert.Equal(t, shim.ERROR, int(r.Status), args)
+		assert.Contains(t, r.Message, "is frozen", args)
+	}
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "TransferFrom", holder, "dileban", "100")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "is frozen")
+	bal, err := readBalance(stub, holder)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(500), bal.Available)
+
+	// Unfreezing restores normal operation
+	r = invokeMock(stub, "Unfreeze", holder)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	event = lastEvent(stub)
+	assert.Equal(t, "Unfrozen", event.EventName)
+	r = invokeMock(stub, "Transfer", holder, "100")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "TransferFrom", holder, "dileban", "100")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	stub.Creator = holderIdentity
+	r = invokeMock(stub, "Transfer", "dileban", "100")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	bal, err = readBalance(stub, holder)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(400), bal.Available)
+}
+
+func TestPause(t *testing.T) {
+	stub := newMockStub()
+	r := initMock(stub)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	holderIdentity, holder := newIdentity()
+	r = invokeMock(stub, "Transfer", holder, "500")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	stub.Creator = holderIdentity
+	r = invokeMock(stub, "Approve", owner, "100")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	// Only the administrator may pause the token
+	r = invokeMock(stub, "Pause")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "not authorized")
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "Pause")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	var e tokens.Pause
+	event := lastEvent(stub)
+	assert.Equal(t, "Paused", event.EventName)
+	assert.NoError(t, json.Unmarshal(event.Payload, &e))
+	assert.Equal(t, tokens.Pause{SchemaVersion: 1, Admin: owner}, e)
+
+	// Transfers, burns and approvals fail for everyone while paused
+	for _, creator := range [][]byte{ownerIdentity, holderIdentity} {
+		stub.Creator = creator
+		for _, args := range [][]string{
+			{"Transfer", "dileban", "100"},
+			{"TransferFrom", holder, "dileban", "100"},
+			{"Approve", "spender", "100"},
+			{"BatchTransfer", `["dileban"]`, "[100]"},
+			{"Burn", "100"},
+		} {
+			r = invokeMock(stub, args...)
+			assert.Equal(t, shim.ERROR, int(r.Status), args)
+			assert.Contains(t, r.Message, "Token is paused", args)
+		}
+	}
+	bal, err := readBalance(stub, holder)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(500), bal.Available)
+
+	// Only the administrator may unpause the token, after which
+	// transfers succeed again
+	r = invokeMock(stub, "Unpause")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "not authorized")
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "Unpause")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	event = lastEvent(stub)
+	assert.Equal(t, "Unpaused", event.EventName)
+	r = invokeMock(stub, "TransferFrom", holder, "dileban", "100")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	stub.Creator = holderIdentity
+	r = invokeMock(stub, "Transfer", "dileban", "100")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	bal, err = readBalance(stub, "dileban")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(200), bal.Available)
+}
+
+func TestRevoke(t *testing.T) {
+	stub := newMockStub()
+	r := initMock(stub)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	spenderIdentity, spender := newIdentity()
+	r = invokeMock(stub, "Approve", spender, "300")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	stub.Creator = spenderIdentity
+	r = invokeMock(stub, "TransferFrom", owner, "dileban", "100")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	// Revoking removes the remaining allowance
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "Revoke", spender)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, "200", string(r.Payload))
+	var e tokens.Revocation
+	event := lastEvent(stub)
+	assert.Equal(t, "Revoked", event.EventName)
+	assert.NoError(t, json.Unmarshal(event.Payload, &e))
+	assert.Equal(t, tokens.Revocation{SchemaVersion: 1, Owner: owner, Spender: spender, Amount: 200}, e)
+	r = invokeMock(stub, "Allowance", owner, spender)
+	assert.Equal(t, "0", string(r.Payload))
+	stub.Creator = spenderIdentity
+	r = invokeMock(stub, "TransferFrom", owner, "dileban", "100")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "Insufficent balance approved")
+
+	// Revoking a missing allowance is a no-op without an event
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "Revoke", spender)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, "0", string(r.Payload))
+	assert.Nil(t, lastEvent(stub))
+	r = invokeMock(stub, "Revoke", "nobody")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, "0", string(r.Payload))
+
+	// Allowances may be revoked while the token is paused
+	r = invokeMock(stub, "Approve", spender, "50")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "Pause")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "Revoke", spender)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, "50", string(r.Payload))
+}
+
+func TestCirculatingSupply(t *testing.T) {
+	stub := newMockStub()
+	r := initMock(stub)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "CirculatingSupply")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, strconv.Itoa(supply), string(r.Payload))
+
+	// Burned tokens and tokens locked in custody by chaincodes are out
+	// of circulation, tokens held by others are not
+	r = invokeMock(stub, "Transfer", burnAddress, "100")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "Transfer", "cc:swaps", "250")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "Transfer", "cc:otherSwaps", "50")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "Transfer", "dileban", "500")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "CirculatingSupply")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, strconv.Itoa(supply-400), string(r.Payload))
+
+	// The total supply is unaffected
+	r = invokeMock(stub, "TokenSupply")
+	assert.Equal(t, strconv.Itoa(supply), string(r.Payload))
+}
 
-const supply = 10000
+func TestAliases(t *testing.T) {
+	stub := newMockStub()
+	initMock(stub)
+	_, treasury := newIdentity()
 
-func TestInit(t *testing.T) {
+	// Only the administrator may register aliases
+	stub.Creator, _ = newIdentity()
+	r := invokeMock(stub, "RegisterAlias", treasury, "Treasury")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "RegisterAlias", treasury, "Treasury")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "ResolveAlias", treasury)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, "Treasury", string(r.Payload))
+
+	// Registering again replaces the alias
+	r = invokeMock(stub, "RegisterAlias", treasury, "Reserve")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "ResolveAlias", treasury)
+	assert.Equal(t, "Reserve", string(r.Payload))
+
+	r = invokeMock(stub, "ResolveAlias", owner)
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "No alias registered for "+owner)
+	r = invokeMock(stub, "RegisterAlias", owner, "")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	r = invokeMock(stub, "RegisterAlias", owner, strings.Repeat("x", maxAliasLength+1))
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "must not exceed")
+}
+
+func TestTooFewArgs(t *testing.T) {
+	stub := newMockStub()
+	initMock(stub)
+
+	tests := []struct {
+		args    []string
+		message string
+	}{
+		{[]string{"Transfer"}, "Expected 2 arguments (to, amount), got 0"},
+		{[]string{"Transfer", "dileban"}, "Expected 2 arguments (to, amount), got 1"},
+		{[]string{"Approve", "spender"}, "Expected 2 arguments (spender, amount), got 1"},
+		{[]string{"TransferFrom", owner, "dileban"}, "Expected 3 arguments (from, to, amount), got 2"},
+		{[]string{"Allowance", owner}, "Expected 2 arguments (owner, spender), got 1"},
+		{[]string{"BalanceOf"}, "Expected 1 arguments (owner), got 0"},
+	}
+	for _, test := range tests {
+		r := invokeMock(stub, test.args...)
+		assert.Equal(t, shim.ERROR, int(r.Status), test.args)
+		assert.Equal(t, test.message, r.Message, test.args)
+	}
+}
+
+func TestMalformedNumbers(t *testing.T) {
+	stub := newMockStub()
+	initMock(stub)
+
+	for _, value := range []string{"abc", "-1", "1.5", "", "18446744073709551616"} {
+		for _, args := range [][]string{
+			{"Transfer", "dileban", value},
+			{"Approve", "spender", value},
+			{"TransferFrom", owner, "dileban", value},
+			{"Burn", value},
+			{"ListHolders", value},
+		} {
+			r := invokeMock(stub, args...)
+			assert.Equal(t, shim.ERROR, int(r.Status), args)
+			assert.Equal(t, fmt.Sprintf("Malformed number '%s'", value), r.Message, args)
+		}
+	}
+	balance, err := readBalance(stub, owner)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(10000), balance.Available)
+}
+
+func TestEventSchemaVersion(t *testing.T) {
+	stub := newMockStub()
+	r := stub.MockInit("init", byteArray("FUSD", "Fabric USD", "10000", owner, `{"mintable": true}`))
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	_, spender := newIdentity()
+
+	for _, call := range []struct {
+		args  []string
+		event string
+	}{
+		{[]string{"Transfer", "dileban", "100"}, "Transferred"},
+		{[]string{"Approve", spender, "100"}, "Approved"},
+		{[]string{"TransferAndApprove", "dileban", "100", spender, "50"}, "TransferredAndApproved"},
+		{[]string{"Revoke", spender}, "Revoked"},
+		{[]string{"Mint", "dileban", "100"}, "Minted"},
+		{[]string{"Burn", "100"}, "Burned"},
+	} {
+		r = invokeMock(stub, call.args...)
+		assert.Equal(t, shim.OK, int(r.Status), r.Message)
+		event := lastEvent(stub)
+		assert.Equal(t, call.event, event.EventName)
+		var fields map[string]interface{}
+		assert.NoError(t, json.Unmarshal(event.Payload, &fields))
+		assert.Equal(t, float64(tokens.EventSchemaVersion), fields["schemaVersion"], call.event)
+	}
+}
+
+func TestSupplyBreakdown(t *testing.T) {
+	stub := newMockStub()
+	r := stub.MockInit("init", byteArray("FUSD", "Fabric USD", "10000", owner, `{"mintable": true}`))
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	breakdown := func() SupplyBreakdown {
+		r := invokeMock(stub, "SupplyBreakdown")
+		assert.Equal(t, shim.OK, int(r.Status), r.Message)
+		var b SupplyBreakdown
+		assert.NoError(t, json.Unmarshal(r.Payload, &b))
+		// The breakdown accounts for the whole supply
+		assert.Equal(t, b.Total, b.Circulating+b.Locked+b.Burned)
+		r = invokeMock(stub, "CirculatingSupply")
+		assert.Equal(t, strconv.FormatUint(b.Circulating, 10), string(r.Payload))
+		r = invokeMock(stub, "TokenSupply")
+		assert.Equal(t, strconv.FormatUint(b.Total, 10), string(r.Payload))
+		return b
+	}
+	assert.Equal(t, SupplyBreakdown{Total: 10000, Circulating: 10000}, breakdown())
+
+	// Mints and burns change the total supply
+	r = invokeMock(stub, "Mint", "dileban", "500")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "Burn", "200")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, SupplyBreakdown{Total: 10300, Circulating: 10300}, breakdown())
+
+	// Transfers to the burn address and locks in custody do not
+	r = invokeMock(stub, "Transfer", burnAddress, "100")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "Transfer", "cc:swaps", "250")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, SupplyBreakdown{Total: 10300, Circulating: 9950, Locked: 250, Burned: 100}, breakdown())
+}
+
+func TestSumBalances(t *testing.T) {
 	stub := newMockStub()
 	r := initMock(stub)
 	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "Transfer", "alice", "100")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "Transfer", "bob", "250")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
 
-	// Check initial token state
+	r = invokeMock(stub, "SumBalances", "alice", "bob", "unknown")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, "350", string(r.Payload))
+	r = invokeMock(stub, "SumBalances", owner, "alice", "bob")
+	assert.Equal(t, strconv.Itoa(supply), string(r.Payload))
+
+	addresses := make([]string, maxSumAddresses+1)
+	r = invokeMock(stub, append([]string{"SumBalances"}, addresses...)...)
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "more than")
+}
+
+func TestWhitelist(t *testing.T) {
+	stub := newMockStub()
+	r := stub.MockInit("init", byteArray("FUSD", "Fabric USD", "10000", owner, `{"whitelist": true}`))
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	// Recipients must be on the allowlist
+	r = invokeMock(stub, "Transfer", "dileban", "100")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "not on the allowlist")
+	r = invokeMock(stub, "Allow", "dileban")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "Transfer", "dileban", "100")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	// Initial owners are allowlisted, only the administrator may
+	// maintain the allowlist
+	holderIdentity, holder := newIdentity()
+	r = invokeMock(stub, "Allow", holder)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "Transfer", holder, "100")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	stub.Creator = holderIdentity
+	r = invokeMock(stub, "Transfer", owner, "50")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "Allow", "spender")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "not authorized")
+
+	// Removed addresses no longer receive tokens
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "Disallow", "dileban")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "Transfer", "dileban", "100")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	bal, err := readBalance(stub, "dileban")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(100), bal.Available)
+}
+
+func TestMint(t *testing.T) {
+	stub := newMockStub()
+	r := stub.MockInit("init", byteArray("FUSD", "Fabric USD", "10000", owner, `{"mintable": true}`))
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	r = invokeMock(stub, "Mint", "dileban", "500")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
 	token, err := readToken(stub)
 	assert.NoError(t, err)
-	assert.Equal(t, *token, Token{Symbol: "FUSD", Name: "Fabric USD", Decimals: 0, Supply: supply})
+	assert.Equal(t, uint64(10500), token.Supply)
+	assert.True(t, token.Mintable)
+	bal, err := readBalance(stub, "dileban")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(500), bal.Available)
+	event := lastEvent(stub)
+	assert.Equal(t, "Minted", event.EventName)
+	var mint tokens.Mint
+	assert.NoError(t, json.Unmarshal(event.Payload, &mint))
+	assert.Equal(t, tokens.Mint{SchemaVersion: 1, To: "dileban", Amount: 500}, mint)
+
+	// Only the administrator may mint
+	holderIdentity, _ := newIdentity()
+	stub.Creator = holderIdentity
+	r = invokeMock(stub, "Mint", "dileban", "500")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "not authorized")
+	stub.Creator = ownerIdentity
+
+	// The supply may not overflow
+	r = invokeMock(stub, "Mint", "dileban", strconv.FormatUint(^uint64(0)-10000, 10))
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "maximum supply")
+	r = invokeMock(stub, "Mint", "dileban", "0")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+
+	// Tokens with a fixed supply may not be minted
+	stub = newMockStub()
+	initMock(stub)
+	r = invokeMock(stub, "Mint", owner, "500")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "not mintable")
+	token, err = readToken(stub)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(supply), token.Supply)
 }
 
-func TestInvoke(t *testing.T) {
+func TestBurn(t *testing.T) {
+	stub := newMockStub()
+	initMock(stub)
+
+	r := invokeMock(stub, "Burn", "400")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	token, err := readToken(stub)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(supply-400), token.Supply)
+	bal, err := readBalance(stub, owner)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(supply-400), bal.Available)
+	event := lastEvent(stub)
+	assert.Equal(t, "Burned", event.EventName)
+	var burn tokens.Burn
+	assert.NoError(t, json.Unmarshal(event.Payload, &burn))
+	assert.Equal(t, tokens.Burn{SchemaVersion: 1, From: owner, Amount: 400}, burn)
+	r = invokeMock(stub, "TokenSupply")
+	assert.Equal(t, strconv.Itoa(supply-400), string(r.Payload))
+
+	// Burns may not exceed the invoker's balance
+	r = invokeMock(stub, "Burn", strconv.Itoa(supply))
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "Insufficient balance")
+	r = invokeMock(stub, "Burn", "0")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	token, err = readToken(stub)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(supply-400), token.Supply)
+}
+
+func TestListHolders(t *testing.T) {
 	stub := newMockStub()
 	r := initMock(stub)
 	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	holderIdentity, holder := newIdentity()
+	for _, to := range []string{"alice", "bob", "carol", holder} {
+		r = invokeMock(stub, "Transfer", to, "100")
+		assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	}
+	r = invokeMock(stub, "Approve", "alice", "50")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	// Emptied accounts are not listed
+	stub.Creator = holderIdentity
+	r = invokeMock(stub, "Transfer", "bob", "100")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
 
-	r = stub.MockInvokeWithSignedProposal("1", byteArray("TokenSupply"), &pb.SignedProposal{})
+	var holders []Holder
+	var page HoldersPage
+	bookmark := ""
+	for pages := 0; pages == 0 || bookmark != ""; pages++ {
+		r = invokeMock(stub, "ListHolders", "2", bookmark)
+		assert.Equal(t, shim.OK, int(r.Status), r.Message)
+		assert.NoError(t, json.Unmarshal(r.Payload, &page))
+		assert.True(t, len(page.Holders) <= 2)
+		holders = append(holders, page.Holders...)
+		bookmark = page.Bookmark
+	}
+	assert.ElementsMatch(t, []Holder{
+		{Address: owner, Available: supply - 400},
+		{Address: "alice", Available: 100},
+		{Address: "bob", Available: 200},
+		{Address: "carol", Available: 100}}, holders)
+
+	// Sizes beyond the range of int do not wrap to an unbounded page
+	for _, size := range []string{"0", strconv.Itoa(maxPageSize + 1), "18446744073709551615"} {
+		r = invokeMock(stub, "ListHolders", size)
+		assert.Equal(t, shim.ERROR, int(r.Status), size)
+		assert.Equal(t, "Page size must be between 1 and 100", r.Message, size)
+	}
+}
+
+func TestBalancesMerkleRoot(t *testing.T) {
+	stub := newMockStub()
+	initMock(stub)
+	invokeMock(stub, "Transfer", "dileban", "100")
+	invokeMock(stub, "Transfer", "spender", "50")
+
+	// The root is stable for a fixed set of balances
+	r := invokeMock(stub, "BalancesMerkleRoot")
 	assert.Equal(t, shim.OK, int(r.Status), r.Message)
-	assert.Equal(t, strconv.Itoa(supply), string(r.Payload))
+	root := string(r.Payload)
+	assert.Len(t, root, 64)
+	r = invokeMock(stub, "BalancesMerkleRoot")
+	assert.Equal(t, root, string(r.Payload))
 
-	r = stub.MockInvokeWithSignedProposal("1", byteArray("BalanceOf", owner), &pb.SignedProposal{})
+	// Balances are proven against the root
+	r = invokeMock(stub, "BalanceProof", "dileban")
 	assert.Equal(t, shim.OK, int(r.Status), r.Message)
-	assert.Equal(t, strconv.Itoa(supply), string(r.Payload))
+	var proof BalanceProof
+	assert.NoError(t, json.Unmarshal(r.Payload, &proof))
+	assert.Equal(t, uint64(100), proof.Available)
+	assert.Equal(t, root, hex.EncodeToString(proof.Root))
+	leaf := merkle.LeafHash(append(uint64ToBytes(100), "dileban"...))
+	assert.True(t, merkle.Verify(proof.Root, leaf, proof.Proof))
+	forged := merkle.LeafHash(append(uint64ToBytes(1000), "dileban"...))
+	assert.False(t, merkle.Verify(proof.Root, forged, proof.Proof))
+	r = invokeMock(stub, "BalanceProof", "nobody")
+	assert.Equal(t, shim.ERROR, int(r.Status))
 
-	r = stub.MockInvokeWithSignedProposal("1", byteArray("Transfer", "dileban", "100"), &pb.SignedProposal{})
+	// The root changes along with any balance
+	invokeMock(stub, "Transfer", "dileban", "1")
+	r = invokeMock(stub, "BalancesMerkleRoot")
+	assert.NotEqual(t, root, string(r.Payload))
+	assert.False(t, merkle.Verify(hexDecode(string(r.Payload)), leaf, proof.Proof))
+}
+
+func TestExportState(t *testing.T) {
+	stub := newMockStub()
+	r := initMock(stub)
 	assert.Equal(t, shim.OK, int(r.Status), r.Message)
-	assert.Nil(t, r.Payload)
+	holderIdentity, holder := newIdentity()
+	for _, to := range []string{"alice", "bob", holder} {
+		r = invokeMock(stub, "Transfer", to, "100")
+		assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	}
+	stub.Creator = holderIdentity
+	r = invokeMock(stub, "Transfer", "bob", "100")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	// Only the administrator may export the token state
+	r = invokeMock(stub, "ExportState", "2")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "not authorized")
+
+	stub.Creator = ownerIdentity
+	var balances []Holder
+	var export StateExport
+	bookmark := ""
+	for pages := 0; pages == 0 || bookmark != ""; pages++ {
+		r = invokeMock(stub, "ExportState", "2", bookmark)
+		assert.Equal(t, shim.OK, int(r.Status), r.Message)
+		assert.NoError(t, json.Unmarshal(r.Payload, &export))
+		assert.Equal(t, "FUSD", export.Token.Symbol)
+		assert.Equal(t, uint64(supply), export.Token.Supply)
+		assert.True(t, len(export.Balances) <= 2)
+		balances = append(balances, export.Balances...)
+		bookmark = export.Bookmark
+	}
+	// Empty balances are exported too
+	assert.ElementsMatch(t, []Holder{
+		{Address: owner, Available: supply - 300},
+		{Address: "alice", Available: 100},
+		{Address: "bob", Available: 200},
+		{Address: holder, Available: 0}}, balances)
+
+	// Sizes beyond the range of int do not wrap to an unbounded page
+	for _, size := range []string{"0", strconv.Itoa(maxPageSize + 1), "18446744073709551615"} {
+		r = invokeMock(stub, "ExportState", size)
+		assert.Equal(t, shim.ERROR, int(r.Status), size)
+		assert.Equal(t, "Page size must be between 1 and 100", r.Message, size)
+	}
+}
+
+func TestImportState(t *testing.T) {
+	stub := newMockStub()
+	r := initMock(stub)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	export := StateExport{Balances: []Holder{
+		{Address: "alice", Available: 6000},
+		{Address: "bob", Available: 4000}}}
+	b, _ := json.Marshal(export)
+
+	// Restoring a fresh token
+	r = invokeMock(stub, "ImportState", string(b))
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	for address, amount := range map[string]uint64{"alice": 6000, "bob": 4000, owner: 0} {
+		bal, err := readBalance(stub, address)
+		assert.NoError(t, err)
+		assert.Equal(t, amount, bal.Available)
+	}
+
+	// Live balances are not overwritten unless forced
+	r = invokeMock(stub, "ImportState", string(b))
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "refusing to overwrite")
+	export.Balances[0].Available = 1000
+	export.Balances = append(export.Balances, Holder{Address: owner, Available: 5000})
+	b, _ = json.Marshal(export)
+	r = invokeMock(stub, "ImportState", string(b), "force")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	bal, err := readBalance(stub, owner)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(5000), bal.Available)
+
+	// Balances must add up to the total supply
+	export.Balances[0].Available = 999
+	b, _ = json.Marshal(export)
+	r = invokeMock(stub, "ImportState", string(b), "force")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "add up to 9999")
+
+	// Addresses whose keys would collide with the token or composite
+	// keys are rejected
+	allowance, _ := stub.CreateCompositeKey(allowanceIndex, []string{owner, "spender"})
+	for _, address := range []string{"", tokenKey, allowance} {
+		export.Balances = []Holder{{Address: address, Available: supply}}
+		b, _ = json.Marshal(export)
+		r = invokeMock(stub, "ImportState", string(b), "force")
+		assert.Equal(t, shim.ERROR, int(r.Status))
+		assert.Contains(t, r.Message, "Malformed address")
+	}
+	r = invokeMock(stub, "Transfer", tokenKey, "1")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "Malformed address")
+
+	stub.Creator, _ = newIdentity()
+	r = invokeMock(stub, "ImportState", string(b), "force")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "not authorized")
+
+	// Tokens allocated to several owners at Init may be restored
+	_, other := newIdentity()
+	stub = newMockStub()
+	r = stub.MockInit("init", byteArray("FUSD", "Fabric USD", "10000",
+		fmt.Sprintf(`[{"address": "%s", "amount": 4000}, {"address": "%s", "amount": 6000}]`, owner, other)))
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	export.Balances = []Holder{{Address: "alice", Available: 6000}, {Address: other, Available: 4000}}
+	b, _ = json.Marshal(export)
+	r = invokeMock(stub, "ImportState", string(b))
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	bal, err = readBalance(stub, other)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4000), bal.Available)
+
+	// Balances changed by transfers or approvals are live, even if
+	// never imported
+	for _, args := range [][]string{
+		{"Transfer", "carol", "100"},
+		{"Approve", "spender", "100"},
+	} {
+		stub = newMockStub()
+		initMock(stub)
+		r = invokeMock(stub, args...)
+		assert.Equal(t, shim.OK, int(r.Status), r.Message)
+		export.Balances = []Holder{{Address: "alice", Available: 6000}, {Address: "bob", Available: 4000}}
+		b, _ = json.Marshal(export)
+		r = invokeMock(stub, "ImportState", string(b))
+		assert.Equal(t, shim.ERROR, int(r.Status), args[0])
+		assert.Contains(t, r.Message, "refusing to overwrite", args[0])
+		assert.NotContains(t, stub.State, "alice", args[0])
+	}
+
+	// Tokens initialized without a record of their allocations are
+	// never fresh
+	stub = newMockStub()
+	initMock(stub)
+	key, _ := stub.CreateCompositeKey(genesisIndex, []string{owner})
+	stub.MockTransactionStart("legacy")
+	stub.DelState(key)
+	stub.MockTransactionEnd("legacy")
+	r = invokeMock(stub, "ImportState", string(b))
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "refusing to overwrite")
+}
+
+func TestMetrics(t *testing.T) {
+	stub := newMockStub()
+	r := initMock(stub)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	var counters map[string]uint64
+	r = invokeMock(stub, "Metrics")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.NoError(t, json.Unmarshal(r.Payload, &counters))
+	assert.Equal(t, map[string]uint64{"transfers": 0, "approvals": 0}, counters)
+
+	r = invokeMock(stub, "Transfer", "dileban", "100")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "Approve", "spender", "50")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "TransferAndApprove", "dileban", "100", "spender", "50")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	// Failed operations are only counted by the peer
+	r = invokeMock(stub, "Transfer", "dileban", strconv.Itoa(supply))
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	r = invokeMock(stub, "Unknown")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+
+	r = invokeMock(stub, "Metrics")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.NoError(t, json.Unmarshal(r.Payload, &counters))
+	assert.Equal(t, map[string]uint64{"transfers": 2, "approvals": 2}, counters)
+	r = invokeMock(stub, "Failures")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, "2", string(r.Payload))
+
+	// Increments that are not decimal strings are reported
+	key, _ := stub.CreateCompositeKey(metricIndex, []string{metricTransfers, "malformed"})
+	stub.MockTransactionStart("malformed")
+	stub.PutState(key, []byte{3, 0, 0, 0, 0, 0, 0, 0})
+	stub.MockTransactionEnd("malformed")
+	r = invokeMock(stub, "Metrics")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Equal(t, "Malformed value for metric transfers", r.Message)
+}
+
+func TestCompactMetrics(t *testing.T) {
+	stub := newMockStub()
+	r := initMock(stub)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	for i := 0; i < 3; i++ {
+		r = invokeMock(stub, "Transfer", "dileban", "100")
+		assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	}
+	r = invokeMock(stub, "Approve", "spender", "50")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	increments := func(name string) []string {
+		iter, err := stub.GetStateByPartialCompositeKey(metricIndex, []string{name})
+		assert.NoError(t, err)
+		defer iter.Close()
+		var values []string
+		for iter.HasNext() {
+			kv, _ := iter.Next()
+			values = append(values, string(kv.Value))
+		}
+		return values
+	}
+	assert.Equal(t, []string{"1", "1", "1"}, increments(metricTransfers))
+
+	// Only the administrator may compact the counters
+	holderIdentity, _ := newIdentity()
+	stub.Creator = holderIdentity
+	r = invokeMock(stub, "CompactMetrics")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "not authorized")
+
+	// Transfers are merged into a single key, a lone approval is left
+	stub.Creator = ownerIdentity
+	r = invokeMock(stub, "CompactMetrics")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, "3", string(r.Payload))
+	assert.Equal(t, []string{"3"}, increments(metricTransfers))
+	assert.Equal(t, []string{"1"}, increments(metricApprovals))
+
+	r = invokeMock(stub, "Metrics")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	var counters map[string]uint64
+	assert.NoError(t, json.Unmarshal(r.Payload, &counters))
+	assert.Equal(t, uint64(3), counters[metricTransfers])
+	assert.Equal(t, uint64(1), counters[metricApprovals])
+
+	r = invokeMock(stub, "CompactMetrics")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, "0", string(r.Payload))
+}
+
+func TestHandlerCallerProps(t *testing.T) {
+	stub := newMockStub()
+	r := initMock(stub)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "Transfer", "dileban", "100")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	// Handlers may be called directly with constructed caller props
+	tcc := new(TokenChaincode)
+	props := &CallerProps{stub: stub}
+	r = tcc.VersionHandler(props)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = tcc.MetricsHandler(props)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, `{"approvals":0,"transfers":1}`, string(r.Payload))
+}
+
+func TestInvokeNoStateBleed(t *testing.T) {
+	cc := new(TokenChaincode)
+	stub := shim.NewMockStub(ccName, cc)
+	stub.Creator = ownerIdentity
+	r := initMock(stub)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	r = invokeMock(stub, "Transfer", "dileban", "100")
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Nil(t, cc.token)
+
+	// Each invocation reads the token afresh and resolves its own
+	// invoker
+	token, err := readToken(stub)
+	assert.NoError(t, err)
+	token.Whitelist = true
+	b, _ := json.Marshal(token)
+	stub.State[tokenKey] = b
+	r = invokeMock(stub, "Transfer", "dileban", "100")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "not on the allowlist")
+	holderIdentity, _ := newIdentity()
+	stub.Creator = holderIdentity
+	r = invokeMock(stub, "Allow", "dileban")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "not authorized")
+	assert.Nil(t, cc.token)
+}
+
+func TestTokenCallerProps(t *testing.T) {
+	stub := newMockStub()
+	r := initMock(stub)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	// Token methods operate on the caller props the token is
+	// constructed with
+	cert, err := cid.GetX509Certificate(stub)
+	assert.NoError(t, err)
+	token, err := readToken(stub)
+	assert.NoError(t, err)
+	token.caller = &CallerProps{cert: cert, stub: stub}
+	stub.MockTransactionStart("direct")
+	assert.NoError(t, token.Transfer("dileban", 100))
+	stub.MockTransactionEnd("direct")
+	bal, err := readBalance(stub, "dileban")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(100), bal.Available)
+	balance, err := token.BalanceOf(owner)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(supply-100), balance)
+}
+
+func TestGetHistoryForAddress(t *testing.T) {
+	stub := newMockStub()
+	r := initMock(stub)
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+
+	// The mock stub does not keep history, so transfers are made
+	// through a stub recording the writes to each key
+	hs := &historyStub{MockStub: stub, history: map[string][]*queryresult.KeyModification{}}
+	cert, err := cid.GetX509Certificate(stub)
+	assert.NoError(t, err)
+	transfer := func(txID string, seconds int64, amount uint64) {
+		token, err := readToken(stub)
+		assert.NoError(t, err)
+		token.caller = &CallerProps{cert: cert, stub: hs}
+		stub.MockTransactionStart(txID)
+		stub.TxTimestamp = &timestamp.Timestamp{Seconds: seconds}
+		assert.NoError(t, token.Transfer("dileban", amount))
+		stub.MockTransactionEnd(txID)
+	}
+	transfer("tx1", 1000, 100)
+	transfer("tx2", 2000, 50)
+
+	tcc := &TokenChaincode{token: &Token{caller: &CallerProps{stub: hs}}}
+	r = tcc.GetHistoryForAddressHandler(&CallerProps{args: []string{"dileban"}, stub: hs})
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	var changes []BalanceChange
+	assert.NoError(t, json.Unmarshal(r.Payload, &changes))
+	assert.Equal(t, []BalanceChange{
+		{TxID: "tx1", Timestamp: 1000, Available: 100},
+		{TxID: "tx2", Timestamp: 2000, Available: 150},
+	}, changes)
+	r = tcc.GetHistoryForAddressHandler(&CallerProps{args: []string{owner}, stub: hs})
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.NoError(t, json.Unmarshal(r.Payload, &changes))
+	assert.Len(t, changes, 2)
+	assert.Equal(t, uint64(supply-150), changes[1].Available)
+
+	// Addresses without history have none, the token is not an address
+	r = tcc.GetHistoryForAddressHandler(&CallerProps{args: []string{"nobody"}, stub: hs})
+	assert.Equal(t, shim.OK, int(r.Status), r.Message)
+	assert.Equal(t, "[]", string(r.Payload))
+	r = tcc.GetHistoryForAddressHandler(&CallerProps{args: []string{tokenKey}, stub: hs})
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "Malformed address")
+
+	// Peers without history report an error
+	r = invokeMock(stub, "GetHistoryForAddress", "dileban")
+	assert.Equal(t, shim.ERROR, int(r.Status))
+	assert.Contains(t, r.Message, "Failed to read history of dileban")
+}
+
+func TestRun(t *testing.T) {
+	defer func(start func(shim.Chaincode) error) { startChaincode = start }(startChaincode)
+
+	var started shim.Chaincode
+	startChaincode = func(cc shim.Chaincode) error {
+		started = cc
+		return fmt.Errorf("peer unreachable")
+	}
+	err := run()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Error starting TokenChaincode: peer unreachable")
+	assert.IsType(t, new(TokenChaincode), started)
+
+	startChaincode = func(cc shim.Chaincode) error { return nil }
+	assert.NoError(t, run())
+}
+
+// recordingChaincode wraps the token chaincode, keeping track of the
+// read-write set of the last invocation.
+type recordingChaincode struct {
+	TokenChaincode
+	last *recordingStub
+}
+
+func (cc *recordingChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	cc.last = &recordingStub{stub, map[string]bool{}, map[string]bool{}}
+	return cc.TokenChaincode.Invoke(cc.last)
+}
+
+// failingChaincode wraps the token chaincode, failing writes to the
+// given key during initialization.
+type failingChaincode struct {
+	TokenChaincode
+	failKey string
+}
+
+func (cc *failingChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	return cc.TokenChaincode.Init(&failingStub{stub, cc.failKey})
+}
+
+// failingStub fails writes to a given key.
+type failingStub struct {
+	shim.ChaincodeStubInterface
+	failKey string
+}
+
+func (s *failingStub) PutState(key string, value []byte) error {
+	if key == s.failKey {
+		return fmt.Errorf("Write to %s failed", key)
+	}
+	return s.ChaincodeStubInterface.PutState(key, value)
+}
+
+// recordingStub records the keys read and written through a stub.
+type recordingStub struct {
+	shim.ChaincodeStubInterface
+	reads  map[string]bool
+	writes map[string]bool
+}
+
+func (s *recordingStub) GetState(key string) ([]byte, error) {
+	s.reads[key] = true
+	return s.ChaincodeStubInterface.GetState(key)
+}
+
+func (s *recordingStub) PutState(key string, value []byte) error {
+	s.writes[key] = true
+	return s.ChaincodeStubInterface.PutState(key, value)
+}
+
+func (s *recordingStub) DelState(key string) error {
+	s.writes[key] = true
+	return s.ChaincodeStubInterface.DelState(key)
 }
 
 func newMockStub() *shim.MockStub {
-	return shim.NewMockStub(ccName, new(TokenChaincode))
+	stub := shim.NewMockStub(ccName, new(TokenChaincode))
+	stub.Creator = ownerIdentity
+	return stub
+}
+
+// historyStub records the writes made through it, serving them from
+// GetHistoryForKey, which the mock stub does not implement.
+type historyStub struct {
+	*shim.MockStub
+	history map[string][]*queryresult.KeyModification
+}
+
+func (hs *historyStub) PutState(key string, value []byte) error {
+	hs.history[key] = append(hs.history[key], &queryresult.KeyModification{
+		TxId: hs.TxID, Value: value, Timestamp: hs.TxTimestamp})
+	return hs.MockStub.PutState(key, value)
+}
+
+func (hs *historyStub) DelState(key string) error {
+	hs.history[key] = append(hs.history[key], &queryresult.KeyModification{
+		TxId: hs.TxID, Timestamp: hs.TxTimestamp, IsDelete: true})
+	return hs.MockStub.DelState(key)
+}
+
+func (hs *historyStub) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+	return &historyIterator{modifications: hs.history[key]}, nil
+}
+
+// historyIterator iterates over the modifications recorded by a
+// historyStub.
+type historyIterator struct {
+	modifications []*queryresult.KeyModification
+}
+
+func (it *historyIterator) HasNext() bool {
+	return len(it.modifications) > 0
+}
+
+func (it *historyIterator) Next() (*queryresult.KeyModification, error) {
+	km := it.modifications[0]
+	it.modifications = it.modifications[1:]
+	return km, nil
+}
+
+func (it *historyIterator) Close() error {
+	return nil
 }
 
 func initMock(stub *shim.MockStub) pb.Response {
 	return stub.MockInit("init", byteArray("FUSD", "Fabric USD", "10000", owner))
 }
 
+func invokeMock(stub *shim.MockStub, args ...string) pb.Response {
+	txID++
+	return stub.MockInvokeWithSignedProposal(strconv.Itoa(txID), byteArray(args...), &pb.SignedProposal{})
+}
+
+// lastEvent returns the most recent event raised through the stub,
+// discarding any earlier events.
+func lastEvent(stub *shim.MockStub) *pb.ChaincodeEvent {
+	var event *pb.ChaincodeEvent
+	for {
+		select {
+		case event = <-stub.ChaincodeEventsChannel:
+		default:
+			return event
+		}
+	}
+}
+
+// newIdentity returns a serialized identity backed by a freshly
+// generated certificate, along with the address derived from it.
+func newIdentity() ([]byte, string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1)}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	cert, _ := x509.ParseCertificate(der)
+	id := &msp.SerializedIdentity{
+		Mspid:   "Org1MSP",
+		IdBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+	b, _ := proto.Marshal(id)
+	return b, security.NewX509Certificate(cert).GetAddress()
+}
+
 func readToken(stub *shim.MockStub) (*Token, error) {
 	var t Token
 	var b []byte
@@ -80,6 +2085,11 @@ func readBalance(stub *shim.MockStub, address string) (*Balance, error) {
 	return &bal, nil
 }
 
+func hexDecode(s string) []byte {
+	b, _ := hex.DecodeString(s)
+	return b
+}
+
 func byteArray(s ...string) [][]byte {
 	args := make([][]byte, len(s))
 	for i, v := range s {
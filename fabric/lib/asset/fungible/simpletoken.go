@@ -2,22 +2,145 @@ package asset
 
 // TODO: Look into language neutral options
 
+// EventSchemaVersion is the version of the structure of the events
+// below, recorded in each event as SchemaVersion. It is incremented
+// whenever an event changes, so that consumers may handle each
+// version. Events without a version predate versioning.
+const EventSchemaVersion = 1
+
 // Transfer represents a transfer event, raised when the transfer of
 // tokens from an owner to a recipient is successful.
 type Transfer struct {
-	From   string `json:"from"`
-	To     string `json:"to"`
-	Amount uint64 `json:"amount"`
+	SchemaVersion int    `json:"schemaVersion"`
+	From          string `json:"from"`
+	To            string `json:"to"`
+	Amount        uint64 `json:"amount"`
 }
 
 // Approval represents an approval event, raised when an amount of
 // tokens has been approved for spending by a 'spender'.
 type Approval struct {
-	Owner   string `json:"owner"`
-	Spender string `json:"spender"`
-	Amount  uint64 `json:"amount"`
+	SchemaVersion int    `json:"schemaVersion"`
+	Owner         string `json:"owner"`
+	Spender       string `json:"spender"`
+	Amount        uint64 `json:"amount"`
+}
+
+// Revocation represents a revocation event, raised when an owner
+// revokes the remaining allowance of a 'spender'.
+type Revocation struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	Owner         string `json:"owner"`
+	Spender       string `json:"spender"`
+	Amount        uint64 `json:"amount"`
+}
+
+// TransferAndApproval represents the event raised when tokens are
+// transferred and an approval is made in a single transaction. Only
+// one event may be raised per transaction, so both are reported
+// together.
+type TransferAndApproval struct {
+	SchemaVersion int      `json:"schemaVersion"`
+	Transfer      Transfer `json:"transfer"`
+	Approval      Approval `json:"approval"`
+}
+
+// BatchTransfer represents the event raised when tokens are
+// transferred from an owner to several recipients in a single
+// transaction. Only one event may be raised per transaction, so the
+// transfers are reported together, in the order they were requested.
+type BatchTransfer struct {
+	SchemaVersion int        `json:"schemaVersion"`
+	From          string     `json:"from"`
+	Transfers     []Transfer `json:"transfers"`
+}
+
+// Mint represents a mint event, raised when new tokens are created
+// and credited to a recipient, increasing the total supply.
+type Mint struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	To            string `json:"to"`
+	Amount        uint64 `json:"amount"`
+}
+
+// Burn represents a burn event, raised when tokens are destroyed by
+// their owner, reducing the total supply.
+type Burn struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	From          string `json:"from"`
+	Amount        uint64 `json:"amount"`
+}
+
+// Freeze represents a freeze event, raised when an address is frozen
+// by the token administrator and may no longer send or receive tokens.
+type Freeze struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	Address       string `json:"address"`
+}
+
+// Unfreeze represents an unfreeze event, raised when a frozen address
+// may send and receive tokens again.
+type Unfreeze struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	Address       string `json:"address"`
+}
+
+// Pause represents a pause event, raised when the token administrator
+// halts all transfers, burns and approvals.
+type Pause struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	Admin         string `json:"admin"`
 }
 
+// Unpause represents an unpause event, raised when the token
+// administrator resumes transfers, burns and approvals.
+type Unpause struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	Admin         string `json:"admin"`
+}
+
+// Version describes the feature version of a token contract along
+// with the capabilities it supports.
+type Version struct {
+	Version      string   `json:"version"`
+	Capabilities []string `json:"capabilities"`
+}
+
+// Capabilities a token contract may report.
+const (
+	// CapTransfer indicates support for Transfer.
+	CapTransfer = "transfer"
+
+	// CapApprove indicates support for Approve and Allowance.
+	CapApprove = "approve"
+
+	// CapTransferFrom indicates support for TransferFrom.
+	CapTransferFrom = "transferFrom"
+
+	// CapChaincodeAddresses indicates that the contract resolves the
+	// invoker to a chaincode address when called by another
+	// chaincode, allowing chaincodes to hold tokens in custody.
+	CapChaincodeAddresses = "chaincodeAddresses"
+
+	// CapHold indicates support for Hold and Release, allowing tokens
+	// to be held in place under a reference rather than transferred
+	// into custody. Hold(owner, ref, amount) holds tokens the owner
+	// has approved for the invoker, and Release(ref, to) transfers
+	// held tokens to their recipient.
+	CapHold = "hold"
+
+	// CapTransferFromBalance indicates that TransferFrom returns the
+	// recipient's balance following the transfer, allowing the
+	// invoker to verify the amount actually credited.
+	CapTransferFromBalance = "transferFromBalance"
+
+	// CapMint indicates support for Mint.
+	CapMint = "mint"
+
+	// CapBurn indicates support for Burn.
+	CapBurn = "burn"
+)
+
 // SimpleToken interface is modeled after Ethereum's ERC20 standard.
 //
 // See: https://github.com/ethereum/EIPs/blob/master/EIPS/eip-20.md
@@ -37,6 +160,17 @@ type SimpleToken interface {
 	// multiple times overwrites the previous approved amount.
 	Approve(spender string, amount uint64) error
 
+	// IncreaseAllowance increases the amount 'spender' may transfer
+	// from the invoker (owner) by 'delta'. Unlike Approve, adjusting an
+	// allowance this way is not open to a spender transferring both
+	// the previous and the new allowance.
+	IncreaseAllowance(spender string, delta uint64) error
+
+	// DecreaseAllowance decreases the amount 'spender' may transfer
+	// from the invoker (owner) by 'delta'. Decreasing the allowance
+	// below zero is an error.
+	DecreaseAllowance(spender string, delta uint64) error
+
 	// TransferFrom allows the invoker to transfer up to 'amount'
 	// tokens from the owner's ('from') account to the receiver's
 	// ('to') account. The invoker is allowed to call TransferFrom
@@ -46,4 +180,13 @@ type SimpleToken interface {
 	// Allowance returns the amount of tokens approved by an owner for
 	// spending by a given 'spender'.
 	Allowance(owner string, spender string) (uint64, error)
+
+	// Mint creates 'amount' new tokens and credits them to the
+	// specified address, increasing the total supply. Only the token's
+	// designated minter may mint tokens.
+	Mint(to string, amount uint64) error
+
+	// Burn destroys 'amount' tokens held by the invoker, reducing the
+	// total supply. The invoker must have sufficient funds to burn.
+	Burn(amount uint64) error
 }
@@ -1,26 +1,163 @@
 package htlc
 
+// EventSchemaVersion is the version of the structure of the events
+// below, recorded in each event as SchemaVersion. It is incremented
+// whenever an event changes, so that consumers may handle each
+// version. Events without a version predate versioning. Version 2
+// added the claimed and remaining amounts to Claimed.
+const EventSchemaVersion = 2
+
 // Locked represents a lock event, raised when a new agreement is
 // created between the owner and a counterpary.
 type Locked struct {
-	AgreementID  string `json:"agreementId"`
-	Owner        string `json:"owner"`
-	CounterParty string `json:"counterparty"`
-	Image        string `json:"image"`
-	Amount       uint64 `json:"amount"`
-	Expiry       int64  `json:"expiry"`
+	SchemaVersion int    `json:"schemaVersion"`
+	AgreementID   string `json:"agreementId"`
+	Owner         string `json:"owner"`
+	CounterParty  string `json:"counterparty"`
+	Image         string `json:"image"`
+	Amount        uint64 `json:"amount"`
+	Expiry        int64  `json:"expiry"`
 }
 
 // Unlocked represents an unlock event, raised when the owner releases
 // her tokens after the lock time has elapsed.
 type Unlocked struct {
-	AgreementID string `json:"agreementId"`
+	SchemaVersion int    `json:"schemaVersion"`
+	AgreementID   string `json:"agreementId"`
 }
 
 // Claimed represents a claim event, raised when the counterparty
-// claims her tokens using the known secret.
+// claims her tokens using the known secret. The secret is revealed so
+// that the owner may observe it and claim on the other chain. Claims
+// of agreements with several images reveal each secret supplied.
+// Partial claims leave the remaining amount locked in the agreement.
 type Claimed struct {
-	AgreementID string `json:"agreementId"`
+	SchemaVersion int      `json:"schemaVersion"`
+	AgreementID   string   `json:"agreementId"`
+	Secret        string   `json:"secret"`
+	Secrets       []string `json:"secrets,omitempty"`
+	Amount        uint64   `json:"amount"`
+	Remaining     uint64   `json:"remaining"`
+}
+
+// CancelledEarly represents an early cancellation event, raised when
+// the owner cancels an agreement shortly after creating it.
+type CancelledEarly struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	AgreementID   string `json:"agreementId"`
+}
+
+// AbortRequested represents an abort request event, raised when the
+// counterparty consents to the owner cancelling an agreement before
+// its expiry.
+type AbortRequested struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	AgreementID   string `json:"agreementId"`
+}
+
+// Cancelled represents a cancellation event, raised when the owner
+// cancels an agreement the counterparty has agreed to abort.
+type Cancelled struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	AgreementID   string `json:"agreementId"`
+}
+
+// Encodings of a secret, applied to decode the secret before hashing.
+const (
+	// EncodingUTF8 hashes the bytes of the secret string as is.
+	EncodingUTF8 = "utf8"
+
+	// EncodingHex decodes the secret from its hex representation.
+	EncodingHex = "hex"
+)
+
+// Hash algorithms used to obtain the image of a secret.
+const (
+	// HashSHA256 hashes the secret using SHA-256.
+	HashSHA256 = "sha256"
+
+	// HashSHA512 hashes the secret using SHA-512.
+	HashSHA512 = "sha512"
+
+	// HashSHA256d hashes the secret twice using SHA-256, as in
+	// Bitcoin's OP_HASH256.
+	HashSHA256d = "sha256d"
+
+	// HashRIPEMD160 hashes the secret using RIPEMD-160, as in
+	// Bitcoin's OP_RIPEMD160.
+	HashRIPEMD160 = "ripemd160"
+)
+
+// Escrow modes, determining how locked tokens are held.
+const (
+	// EscrowCustody transfers locked tokens to the address of the
+	// swap contract.
+	EscrowCustody = "custody"
+
+	// EscrowHold holds locked tokens in place in the token contract,
+	// referenced by the agreement ID.
+	EscrowHold = "hold"
+)
+
+// Combinators of the images of an agreement, determining the secrets
+// required to claim tokens.
+const (
+	// CombinatorAnd requires the secrets of all images.
+	CombinatorAnd = "and"
+
+	// CombinatorOr requires the secret of any one image.
+	CombinatorOr = "or"
+)
+
+// LockOptions captures optional terms of an agreement, supplied when
+// creating the agreement.
+type LockOptions struct {
+	// SecretEncoding is the encoding of the secret to be revealed by
+	// the counterparty. Defaults to EncodingUTF8.
+	SecretEncoding string `json:"secretEncoding"`
+
+	// HashRounds is the number of times the secret is hashed to obtain
+	// the image, e.g. 2 for a hash of the hash. Defaults to 1.
+	HashRounds int `json:"hashRounds"`
+
+	// HashAlgorithm is the algorithm used to hash the secret. Defaults
+	// to the algorithm configured by the swap contract.
+	HashAlgorithm string `json:"hashAlgorithm"`
+
+	// Hint is a human readable hint about where to find the secret,
+	// shown to the counterparty. It must not reveal the secret.
+	Hint string `json:"hint"`
+
+	// Escrow is the mode of holding locked tokens. Defaults to
+	// EscrowCustody.
+	Escrow string `json:"escrow"`
+
+	// MirrorChannel and MirrorAgreementID reference the agreement
+	// forming the other leg of the swap, on the mirror chain.
+	MirrorChannel     string `json:"mirrorChannel"`
+	MirrorAgreementID string `json:"mirrorAgreementId"`
+
+	// AllowDelegatedClaim permits the Delegate to claim tokens on
+	// behalf of the counterparty. Tokens claimed by the delegate are
+	// credited to the counterparty.
+	AllowDelegatedClaim bool   `json:"allowDelegatedClaim"`
+	Delegate            string `json:"delegate"`
+
+	// Images are the images of further secrets, in addition to the
+	// image supplied to Lock. The Combinator determines whether the
+	// secrets of all images or of any one image are required to claim
+	// tokens. Defaults to CombinatorAnd.
+	Images     []string `json:"images"`
+	Combinator string   `json:"combinator"`
+
+	// RefundAddress is the address tokens are returned to when the
+	// owner unlocks them, e.g. a cold wallet. Defaults to the owner.
+	RefundAddress string `json:"refundAddress"`
+
+	// Owner is the address on whose behalf tokens are locked, when the
+	// lock is submitted by a locker the owner has authorized. Defaults
+	// to the invoker.
+	Owner string `json:"owner"`
 }
 
 // HTLC interface captures the protocol for a Hashed TimeLock Contract
@@ -39,9 +176,10 @@ type HTLC interface {
 	// and the counterparty. The agreement includes the image of a
 	// known secret, the amount of tokens to swap, the name of the
 	// underlying token contract to invoke and an agreed upon lock time
-	// during which the invoker is unable to withdraw her tokens. Lock
-	// returns the agreement id.
-	Lock(counterparty string, image string, amount uint64, tokenContract string, lockTime int64) (string, error)
+	// during which the invoker is unable to withdraw her tokens.
+	// Optional terms are supplied as options. Lock returns the
+	// agreement id.
+	Lock(counterparty string, image string, amount uint64, tokenContract string, lockTime int64, options LockOptions) (string, error)
 
 	// Unlock releases tokens locked by the invoker (owner) under a
 	// given agreement id. Tokens can only be released once the
@@ -50,6 +188,7 @@ type HTLC interface {
 
 	// Claim allows the counterparty to claim tokens from the agreement
 	// setup by the creator. The counterparty must provide the correct
-	// agreement id and secret to claim her tokens.
-	Claim(agreementID string, secret string) error
+	// agreement id and secret to claim her tokens, or several secrets
+	// for agreements with several images.
+	Claim(agreementID string, secrets ...string) error
 }
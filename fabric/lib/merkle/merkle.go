@@ -0,0 +1,101 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+)
+
+// Prefixes distinguishing the hashes of leaves from those of interior
+// nodes, so that an interior node can never be passed off as a leaf.
+const (
+	leafPrefix = 0x00
+	nodePrefix = 0x01
+)
+
+// Step is a sibling hash along the path from a leaf to the root.
+// Left indicates that the sibling is the left child of its parent.
+type Step struct {
+	Hash []byte `json:"hash"`
+	Left bool   `json:"left"`
+}
+
+// LeafHash returns the hash of a leaf holding the given data.
+func LeafHash(data []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{leafPrefix})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// nodeHash returns the hash of an interior node with the given
+// children.
+func nodeHash(left []byte, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{nodePrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// Root returns the root of the tree over the given leaf hashes, in
+// order. A node without a sibling is carried up to the next level
+// unchanged rather than paired with itself. The root of an empty tree
+// is the hash of no data.
+func Root(leaves [][]byte) []byte {
+	if len(leaves) == 0 {
+		h := sha256.Sum256(nil)
+		return h[:]
+	}
+	level := leaves
+	for len(level) > 1 {
+		level = nextLevel(level)
+	}
+	return level[0]
+}
+
+// Proof returns the sibling hashes along the path from the leaf at
+// the given index to the root of the tree over the given leaf hashes.
+func Proof(leaves [][]byte, index int) ([]Step, error) {
+	if index < 0 || index >= len(leaves) {
+		return nil, fmt.Errorf("Leaf index %d out of range", index)
+	}
+	var proof []Step
+	level := leaves
+	for len(level) > 1 {
+		sibling := index ^ 1
+		if sibling < len(level) {
+			proof = append(proof, Step{Hash: level[sibling], Left: sibling < index})
+		}
+		level = nextLevel(level)
+		index /= 2
+	}
+	return proof, nil
+}
+
+// Verify returns whether the proof leads from the leaf hash to the
+// given root.
+func Verify(root []byte, leaf []byte, proof []Step) bool {
+	h := leaf
+	for _, step := range proof {
+		if step.Left {
+			h = nodeHash(step.Hash, h)
+		} else {
+			h = nodeHash(h, step.Hash)
+		}
+	}
+	return bytes.Equal(h, root)
+}
+
+// nextLevel returns the parents of the given nodes.
+func nextLevel(level [][]byte) [][]byte {
+	next := make([][]byte, 0, (len(level)+1)/2)
+	for i := 0; i < len(level); i += 2 {
+		if i+1 == len(level) {
+			next = append(next, level[i])
+			break
+		}
+		next = append(next, nodeHash(level[i], level[i+1]))
+	}
+	return next
+}
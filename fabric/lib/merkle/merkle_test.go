@@ -0,0 +1,48 @@
+package merkle
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func leaves(n int) [][]byte {
+	l := make([][]byte, n)
+	for i := range l {
+		l[i] = LeafHash([]byte(fmt.Sprintf("leaf %d", i)))
+	}
+	return l
+}
+
+func TestRoot(t *testing.T) {
+	// A single leaf is its own root
+	l := leaves(1)
+	assert.Equal(t, l[0], Root(l))
+
+	// Pairs are hashed as interior nodes, odd nodes are carried up
+	l = leaves(3)
+	assert.Equal(t, nodeHash(nodeHash(l[0], l[1]), l[2]), Root(l))
+
+	// The root depends on the order of the leaves
+	assert.NotEqual(t, Root([][]byte{l[0], l[1]}), Root([][]byte{l[1], l[0]}))
+
+	assert.Len(t, Root(nil), 32)
+}
+
+func TestProof(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		l := leaves(n)
+		root := Root(l)
+		for i := range l {
+			proof, err := Proof(l, i)
+			assert.NoError(t, err)
+			assert.True(t, Verify(root, l[i], proof), fmt.Sprintf("leaf %d of %d", i, n))
+			// Proofs do not hold for other leaves
+			assert.False(t, Verify(root, LeafHash([]byte("other")), proof))
+		}
+	}
+
+	_, err := Proof(leaves(2), 2)
+	assert.Error(t, err)
+}
@@ -0,0 +1,38 @@
+package safemath
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// MulDiv returns a * b / c, rounded down. The intermediate product is
+// computed without overflowing, so large amounts may be scaled by a
+// rate or ratio, e.g. a fee in basis points or a pro-rata share of a
+// dividend. An error is returned if c is zero or the result does not
+// fit an unsigned 64-bit integer.
+func MulDiv(a uint64, b uint64, c uint64) (uint64, error) {
+	if c == 0 {
+		return 0, fmt.Errorf("Division by zero")
+	}
+	r := new(big.Int).Mul(new(big.Int).SetUint64(a), new(big.Int).SetUint64(b))
+	r.Quo(r, new(big.Int).SetUint64(c))
+	if !r.IsUint64() {
+		return 0, fmt.Errorf("Result of %d * %d / %d overflows", a, b, c)
+	}
+	return r.Uint64(), nil
+}
+
+// Mul returns a * b. An error is returned if the product does not fit
+// an unsigned 64-bit integer.
+func Mul(a uint64, b uint64) (uint64, error) {
+	return MulDiv(a, b, 1)
+}
+
+// Add returns a + b. An error is returned if the sum does not fit an
+// unsigned 64-bit integer.
+func Add(a uint64, b uint64) (uint64, error) {
+	if a+b < a {
+		return 0, fmt.Errorf("Result of %d + %d overflows", a, b)
+	}
+	return a + b, nil
+}
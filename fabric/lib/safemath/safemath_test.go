@@ -0,0 +1,51 @@
+package safemath
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMulDiv(t *testing.T) {
+	// Fee of 30 basis points
+	r, err := MulDiv(1000000, 30, 10000)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3000), r)
+
+	// The product overflows, the result does not
+	r, err = MulDiv(math.MaxUint64, 9999, 10000)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(18444899399302180659), r)
+
+	// Pro-rata share of a dividend for a large balance
+	r, err = MulDiv(math.MaxUint64/2, 1000000, math.MaxUint64)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(499999), r)
+
+	// Results that do not fit are rejected
+	_, err = MulDiv(math.MaxUint64, 10001, 10000)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "overflows")
+
+	_, err = MulDiv(1, 1, 0)
+	assert.Error(t, err)
+}
+
+func TestMul(t *testing.T) {
+	r, err := Mul(1<<32, 1<<31)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1<<63), r)
+
+	_, err = Mul(1<<32, 1<<32)
+	assert.Error(t, err)
+}
+
+func TestAdd(t *testing.T) {
+	r, err := Add(math.MaxUint64-1, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(math.MaxUint64), r)
+
+	_, err = Add(math.MaxUint64, 1)
+	assert.Error(t, err)
+}
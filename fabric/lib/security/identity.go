@@ -7,8 +7,19 @@ import (
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/hex"
+	"math/big"
+
+	"golang.org/x/crypto/ripemd160"
 )
 
+// bitcoinMainnet is the version byte of Bitcoin mainnet addresses
+// derived from public keys (P2PKH).
+const bitcoinMainnet = 0x00
+
+// base58Alphabet is the alphabet of the Base58 encoding used by
+// Bitcoin, omitting characters easily mistaken for one another.
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
 // X509Certificate embeds an x509.Certificate and implements the
 // Identity interface.
 type X509Certificate struct {
@@ -49,6 +60,20 @@ func NewX509Certificate(cert *x509.Certificate) *X509Certificate {
 	return &X509Certificate{cert}
 }
 
+// IsAddress reports whether the given string is an address in the
+// format returned by GetAddress, i.e. 64 lowercase hex characters.
+func IsAddress(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
 // GetAddress returns a 64 character hex representation of the public
 // key.
 func (c *X509Certificate) GetAddress() string {
@@ -58,10 +83,30 @@ func (c *X509Certificate) GetAddress() string {
 }
 
 // GetBitcoinAddress returns a Bitcoin compatiable address based on
-// the public key.
+// the public key. The address is the Base58Check encoding of the
+// RIPEMD-160 hash of the SHA-256 hash of the uncompressed public key,
+// prefixed by the mainnet version byte. Only ECDSA keys map to Bitcoin
+// addresses, an empty string is returned for other keys.
 func (c *X509Certificate) GetBitcoinAddress() string {
-	// TODO: Implement GetBitcoinAddress
-	return ""
+	k, ok := c.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return ""
+	}
+	// Uncompressed SEC 1 encoding of the public key
+	size := (k.Curve.Params().BitSize + 7) / 8
+	pub := make([]byte, 1+2*size)
+	pub[0] = 0x04
+	x, y := k.X.Bytes(), k.Y.Bytes()
+	copy(pub[1+size-len(x):], x)
+	copy(pub[1+2*size-len(y):], y)
+
+	shaPub := sha256.Sum256(pub)
+	h := ripemd160.New()
+	h.Write(shaPub[:])
+	payload := h.Sum([]byte{bitcoinMainnet})
+	checksum := sha256.Sum256(payload)
+	checksum = sha256.Sum256(checksum[:])
+	return base58Encode(append(payload, checksum[:4]...))
 }
 
 // GetEthereumAddress returns an Ethereum compatible address based
@@ -71,6 +116,29 @@ func (c *X509Certificate) GetEthereumAddress() string {
 	return ""
 }
 
+// base58Encode returns the Base58 encoding of a byte array. Leading
+// zero bytes are encoded as leading '1's.
+func base58Encode(b []byte) string {
+	var out []byte
+	n := new(big.Int).SetBytes(b)
+	radix := big.NewInt(58)
+	mod := new(big.Int)
+	for n.Sign() > 0 {
+		n.DivMod(n, radix, mod)
+		out = append(out, base58Alphabet[mod.Int64()])
+	}
+	for _, v := range b {
+		if v != 0 {
+			break
+		}
+		out = append(out, base58Alphabet[0])
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return string(out)
+}
+
 // publicKeyToBytes converts a public key based on one of RSA, DSA or
 // ECDSA to a byte array.
 func publicKeyToBytes(pub interface{}) []byte {
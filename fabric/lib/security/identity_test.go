@@ -0,0 +1,68 @@
+package security
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetBitcoinAddress(t *testing.T) {
+	// Public key and address of the worked example in the Bitcoin
+	// wiki, "Technical background of version 1 Bitcoin addresses". The
+	// key is on secp256k1, only the size of the curve matters here.
+	x, _ := new(big.Int).SetString("50863AD64A87AE8A2FE83C1AF1A8403CB53F53E486D8511DAD8A04887E5B2352", 16)
+	y, _ := new(big.Int).SetString("2CD470243453A299FA9E77237716103ABC11A1DF38855ED6F2EE187E9C582BA6", 16)
+	cert := NewX509Certificate(&x509.Certificate{
+		PublicKey: &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}})
+	assert.Equal(t, "16UwLL9Risc3QfPqBUvKofHmBQ7wMtjvM", cert.GetBitcoinAddress())
+
+	// Only ECDSA keys map to Bitcoin addresses
+	cert = NewX509Certificate(&x509.Certificate{PublicKey: &rsa.PublicKey{N: big.NewInt(1), E: 3}})
+	assert.Equal(t, "", cert.GetBitcoinAddress())
+}
+
+func TestBase58Encode(t *testing.T) {
+	assert.Equal(t, "", base58Encode(nil))
+	assert.Equal(t, "11", base58Encode([]byte{0, 0}))
+	assert.Equal(t, "1112", base58Encode([]byte{0, 0, 0, 1}))
+	assert.Equal(t, "2NEpo7TZRRrLZSi2U", base58Encode([]byte("Hello World!")))
+}
+
+func TestIsAddress(t *testing.T) {
+	address := strings.Repeat("0123456789abcdef", 4)
+	assert.True(t, IsAddress(address))
+	for _, s := range []string{"", address[1:], address + "0", "0x" + address[2:], address[1:] + "g",
+		strings.ToUpper(address), " " + address[1:]} {
+		assert.False(t, IsAddress(s), s)
+	}
+}
+
+func FuzzIsAddress(f *testing.F) {
+	address := strings.Repeat("0123456789abcdef", 4)
+	for _, seed := range []string{
+		"", address, strings.ToUpper(address), "\t" + address + " ", "0x" + address,
+		address + "00", address[:63], strings.Repeat("0", 64), strings.Repeat("f", 128),
+		"\u212a" + address[1:], "\u0130" + address[1:], strings.Repeat("\uff10", 64),
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		if !IsAddress(s) {
+			return
+		}
+		// Addresses are exactly the hex encodings of SHA-256 digests,
+		// as returned by GetAddress
+		b, err := hex.DecodeString(s)
+		if err != nil || len(b) != sha256.Size || hex.EncodeToString(b) != s {
+			t.Fatalf("Accepted %q, which GetAddress never returns", s)
+		}
+	})
+}